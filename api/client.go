@@ -0,0 +1,223 @@
+// Package api is a client for the Drone Mission Control backend API.
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// DefaultURL is the production backend.
+const DefaultURL = "https://api.dronemissioncontrol.com"
+
+// ErrRefreshUnsupported is returned by Refresh if the backend has no way of
+// refreshing tokens.
+var ErrRefreshUnsupported = errors.New("the backend does not support refreshing tokens")
+
+// Client calls the backend API. Requests that fail with a network error or a
+// 5xx response are retried with exponential backoff.
+type Client struct {
+	// BaseURL is the root of the API, DefaultURL if empty.
+	BaseURL    string
+	HTTPClient *http.Client
+	// Token authorizes requests for user resources, see Client.Login.
+	Token string
+
+	// Retries is the number of times a failed request is retried.
+	Retries int
+	// Backoff is the delay before the first retry, doubled for every retry
+	// after that.
+	Backoff time.Duration
+}
+
+// NewClient returns a client for the API at baseURL with default retries.
+func NewClient(baseURL string, httpClient *http.Client) *Client {
+	return &Client{
+		BaseURL:    baseURL,
+		HTTPClient: httpClient,
+		Retries:    3,
+		Backoff:    500 * time.Millisecond,
+	}
+}
+
+// Drone is a drone registered to the user.
+type Drone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Session is a flight session of a drone. Ended is nil while the session is
+// active.
+type Session struct {
+	ID      string     `json:"id"`
+	DroneID string     `json:"drone"`
+	Started time.Time  `json:"started"`
+	Ended   *time.Time `json:"ended,omitempty"`
+}
+
+// Login exchanges user credentials for a token. The token is returned, not
+// stored in the client.
+func (c *Client) Login(ctx context.Context, email, password string) (string, error) {
+	body := struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}{email, password}
+	var raw json.RawMessage
+	if err := c.do(ctx, "POST", "/drone/gettoken", body, &raw); err != nil {
+		return "", err
+	}
+	token := parseToken(raw)
+	// The backend answers bad credentials with a short message rather than
+	// an error status.
+	if len(token) < 10 {
+		return "", &Error{StatusCode: http.StatusUnauthorized, Message: "invalid email or password"}
+	}
+	return token, nil
+}
+
+// Refresh exchanges the client's token for a new one before it expires. It
+// returns ErrRefreshUnsupported if the backend can't do that.
+func (c *Client) Refresh(ctx context.Context) (string, error) {
+	var raw json.RawMessage
+	err := c.do(ctx, "POST", "/drone/refreshtoken", nil, &raw)
+	if s := statusOf(err); s == http.StatusNotFound || s == http.StatusMethodNotAllowed {
+		return "", ErrRefreshUnsupported
+	} else if err != nil {
+		return "", err
+	}
+	token := parseToken(raw)
+	if len(token) < 10 {
+		return "", &Error{StatusCode: http.StatusUnauthorized, Message: "token could not be refreshed"}
+	}
+	return token, nil
+}
+
+// parseToken accepts tokens sent as a JSON string or as plain text.
+func parseToken(raw []byte) string {
+	var token string
+	if err := json.Unmarshal(raw, &token); err != nil {
+		token = strings.TrimSpace(string(raw))
+	}
+	return token
+}
+
+// Drones lists the drones of the logged in user.
+func (c *Client) Drones(ctx context.Context) ([]Drone, error) {
+	var resp struct {
+		Drones []Drone `json:"drones"`
+	}
+	if err := c.do(ctx, "GET", "/user/drones/", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Drones, nil
+}
+
+// Drone returns a drone of the logged in user.
+func (c *Client) Drone(ctx context.Context, id string) (*Drone, error) {
+	var drone Drone
+	if err := c.do(ctx, "GET", "/user/drones/"+url.PathEscape(id)+"/", nil, &drone); err != nil {
+		return nil, err
+	}
+	return &drone, nil
+}
+
+// Sessions lists the sessions of a drone, most recent first.
+func (c *Client) Sessions(ctx context.Context, droneID string) ([]Session, error) {
+	var resp struct {
+		Sessions []Session `json:"sessions"`
+	}
+	if err := c.do(ctx, "GET", "/user/drones/"+url.PathEscape(droneID)+"/sessions/", nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Sessions, nil
+}
+
+// do sends a request with body encoded as JSON, retrying failures, and
+// decodes the response into out.
+func (c *Client) do(ctx context.Context, method, path string, body, out interface{}) error {
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	backoff := c.Backoff
+	for attempt := 0; ; attempt++ {
+		err := c.send(ctx, method, path, payload, out)
+		if err == nil || attempt >= c.Retries || !retryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+func (c *Client) send(ctx context.Context, method, path string, payload []byte, out interface{}) error {
+	base := c.BaseURL
+	if base == "" {
+		base = DefaultURL
+	}
+	var body io.Reader
+	if payload != nil {
+		body = bytes.NewReader(payload)
+	}
+	req, err := http.NewRequest(method, strings.TrimRight(base, "/")+path, body)
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Accept", "application/json")
+	if payload != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", c.Token)
+	}
+
+	resp, err := c.httpClient().Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if certificateError(err) {
+			return err
+		}
+		return &netError{err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newError(req, resp)
+	}
+	if out == nil {
+		_, err = io.Copy(ioutil.Discard, resp.Body)
+		return err
+	}
+	if raw, ok := out.(*json.RawMessage); ok {
+		*raw, err = ioutil.ReadAll(resp.Body)
+		return err
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return fmt.Errorf("bad response from %s: %s", req.URL.Host, err)
+	}
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
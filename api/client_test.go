@@ -0,0 +1,190 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestClient(t *testing.T, handler http.HandlerFunc) (*Client, func()) {
+	srv := httptest.NewServer(handler)
+	c := NewClient(srv.URL, nil)
+	c.Backoff = time.Millisecond
+	return c, srv.Close
+}
+
+func TestLogin(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		var body map[string]string
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		if r.Method != "POST" || r.URL.Path != "/drone/gettoken" || r.Header.Get("Content-Type") != "application/json" {
+			t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		}
+		if body["password"] != `pa"ss` {
+			fmt.Fprint(w, `"invalid"`)
+			return
+		}
+		fmt.Fprint(w, `"eyJhbGciOiJIUzI1NiJ9.token"`)
+	})
+	defer done()
+
+	token, err := c.Login(context.Background(), "pilot@example.com", `pa"ss`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if token != "eyJhbGciOiJIUzI1NiJ9.token" {
+		t.Errorf("unexpected token %q", token)
+	}
+	if _, err := c.Login(context.Background(), "pilot@example.com", "wrong"); !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+}
+
+func TestDrones(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprint(w, `{"detail":"token expired"}`)
+			return
+		}
+		switch r.URL.Path {
+		case "/user/drones/":
+			fmt.Fprint(w, `{"drones":[{"name":"Quad 3","id":"quad-3"}]}`)
+		case "/user/drones/quad-3/":
+			fmt.Fprint(w, `{"name":"Quad 3","id":"quad-3"}`)
+		case "/user/drones/quad-3/sessions/":
+			fmt.Fprint(w, `{"sessions":[{"id":"s1","drone":"quad-3","started":"2019-06-01T10:00:00Z"}]}`)
+		case "/user/drones/other/":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	defer done()
+	ctx := context.Background()
+
+	_, err := c.Drones(ctx)
+	if !IsUnauthorized(err) || err.(*Error).Message != "token expired" {
+		t.Errorf("expected unauthorized, got %v", err)
+	}
+
+	c.Token = "token"
+	drones, err := c.Drones(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drones) != 1 || drones[0] != (Drone{ID: "quad-3", Name: "Quad 3"}) {
+		t.Errorf("unexpected drones %+v", drones)
+	}
+	drone, err := c.Drone(ctx, "quad-3")
+	if err != nil || drone.Name != "Quad 3" {
+		t.Errorf("unexpected drone %+v, %v", drone, err)
+	}
+	sessions, err := c.Sessions(ctx, "quad-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 || sessions[0].Ended != nil || sessions[0].Started.Hour() != 10 {
+		t.Errorf("unexpected sessions %+v", sessions)
+	}
+	if _, err := c.Drone(ctx, "other"); !IsForbidden(err) {
+		t.Errorf("expected forbidden, got %v", err)
+	}
+	if _, err := c.Drone(ctx, "missing"); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+}
+
+func TestRetries(t *testing.T) {
+	calls, failures := 0, 2
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls <= failures {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, `{"drones":[]}`)
+	})
+	defer done()
+
+	if _, err := c.Drones(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+
+	calls, failures = 0, 10
+	if _, err := c.Drones(context.Background()); !IsServerError(err) {
+		t.Errorf("expected server error, got %v", err)
+	}
+	if calls != c.Retries+1 {
+		t.Errorf("expected %d calls, got %d", c.Retries+1, calls)
+	}
+}
+
+func TestNoRetryOnClientError(t *testing.T) {
+	calls := 0
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.WriteHeader(http.StatusNotFound)
+	})
+	defer done()
+
+	if _, err := c.Drones(context.Background()); !IsNotFound(err) {
+		t.Errorf("expected not found, got %v", err)
+	}
+	if calls != 1 {
+		t.Errorf("client errors should not be retried, got %d calls", calls)
+	}
+}
+
+func TestRetryContextCancel(t *testing.T) {
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	})
+	defer done()
+	c.Backoff = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, err := c.Drones(ctx); err != context.DeadlineExceeded {
+		t.Errorf("expected deadline exceeded, got %v", err)
+	}
+}
+
+func TestRefresh(t *testing.T) {
+	supported := true
+	c, done := newTestClient(t, func(w http.ResponseWriter, r *http.Request) {
+		if !supported {
+			http.NotFound(w, r)
+			return
+		}
+		if r.Method != "POST" || r.URL.Path != "/drone/refreshtoken" || r.Header.Get("Authorization") != "old-token-1234" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, "new-token-5678\n")
+	})
+	defer done()
+	ctx := context.Background()
+
+	if _, err := c.Refresh(ctx); !IsUnauthorized(err) {
+		t.Errorf("expected unauthorized without token, got %v", err)
+	}
+	c.Token = "old-token-1234"
+	token, err := c.Refresh(ctx)
+	if err != nil || token != "new-token-5678" {
+		t.Errorf("got %q, %v", token, err)
+	}
+	supported = false
+	if _, err := c.Refresh(ctx); err != ErrRefreshUnsupported {
+		t.Errorf("expected ErrRefreshUnsupported, got %v", err)
+	}
+}
@@ -0,0 +1,125 @@
+package api
+
+import (
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Error is returned for responses with an error status.
+type Error struct {
+	StatusCode int
+	// Message is the error reported by the backend, if any.
+	Message string
+	Method  string
+	URL     string
+}
+
+func (e *Error) Error() string {
+	msg := e.Message
+	if msg == "" {
+		msg = strings.ToLower(http.StatusText(e.StatusCode))
+	}
+	if e.URL == "" {
+		return msg
+	}
+	return fmt.Sprintf("%s %s: %d %s", e.Method, e.URL, e.StatusCode, msg)
+}
+
+// netError wraps errors from the transport, which are worth retrying.
+type netError struct {
+	err error
+}
+
+func (e *netError) Error() string {
+	return e.err.Error()
+}
+
+func (e *netError) Cause() error {
+	return e.err
+}
+
+func newError(req *http.Request, resp *http.Response) *Error {
+	e := &Error{
+		StatusCode: resp.StatusCode,
+		Method:     req.Method,
+		URL:        req.URL.String(),
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var decoded struct {
+		Message string `json:"message"`
+		Error   string `json:"error"`
+		Detail  string `json:"detail"`
+	}
+	if err := json.Unmarshal(body, &decoded); err == nil {
+		for _, m := range []string{decoded.Message, decoded.Error, decoded.Detail} {
+			if m != "" {
+				e.Message = m
+				break
+			}
+		}
+	} else if text := strings.TrimSpace(string(body)); len(text) < 200 && !strings.HasPrefix(text, "<") {
+		e.Message = text
+	}
+	return e
+}
+
+func statusOf(err error) int {
+	if e, ok := errors.Cause(err).(*Error); ok {
+		return e.StatusCode
+	}
+	return 0
+}
+
+// IsUnauthorized reports whether err is a 401, meaning the token is missing
+// or expired or the credentials are wrong.
+func IsUnauthorized(err error) bool {
+	return statusOf(err) == http.StatusUnauthorized
+}
+
+// IsForbidden reports whether err is a 403.
+func IsForbidden(err error) bool {
+	return statusOf(err) == http.StatusForbidden
+}
+
+// IsNotFound reports whether err is a 404.
+func IsNotFound(err error) bool {
+	return statusOf(err) == http.StatusNotFound
+}
+
+// IsServerError reports whether err is a 5xx.
+func IsServerError(err error) bool {
+	return statusOf(err) >= 500
+}
+
+// certificateError reports whether a transport error is caused by a
+// certificate that won't be accepted however many times it is retried.
+func certificateError(err error) bool {
+	for err != nil {
+		switch e := err.(type) {
+		case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError:
+			return true
+		case *url.Error:
+			err = e.Err
+		case interface{ Unwrap() error }:
+			err = e.Unwrap()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+func retryable(err error) bool {
+	if _, ok := err.(*netError); ok {
+		return true
+	}
+	return IsServerError(err) || statusOf(err) == http.StatusTooManyRequests
+}
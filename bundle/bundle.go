@@ -0,0 +1,237 @@
+// Package bundle reads and writes signed archives of images and config, used
+// to install drones without network access.
+//
+// A bundle is a gzipped tar of the bundled files followed by manifest.json,
+// which lists the images and the sha256 of every file, and manifest.sig, an
+// ECDSA signature of the manifest.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+const (
+	ManifestName  = "manifest.json"
+	SignatureName = "manifest.sig"
+	ConfigName    = "config.yaml"
+	ImagesName    = "images.tar"
+	StackName     = "stack.yaml"
+
+	manifestVersion = 1
+)
+
+// Manifest describes the contents of a bundle.
+type Manifest struct {
+	Version int       `json:"version"`
+	Created time.Time `json:"created"`
+	Profile string    `json:"profile"`
+	Images  []Image   `json:"images"`
+	// Files maps the name of every bundled file to its sha256.
+	Files map[string]string `json:"files"`
+}
+
+// Image is an image in a bundle.
+type Image struct {
+	Ref    string `json:"ref"`
+	Digest string `json:"digest,omitempty"`
+}
+
+// Write writes a bundle of files, which maps names in the bundle to local
+// paths, to w. m.Files is filled in before the manifest is signed with key.
+func Write(w io.Writer, m *Manifest, files map[string]string, key *ecdsa.PrivateKey) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+
+	names := make([]string, 0, len(files))
+	for name := range files {
+		if !allowed(name) {
+			return fmt.Errorf("%s can't be bundled", name)
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	m.Version = manifestVersion
+	m.Files = map[string]string{}
+	for _, name := range names {
+		sum, err := addFile(tw, name, files[name])
+		if err != nil {
+			return err
+		}
+		m.Files[name] = sum
+	}
+
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	sig, err := Sign(key, manifest)
+	if err != nil {
+		return err
+	}
+	if err := addBytes(tw, ManifestName, manifest); err != nil {
+		return err
+	}
+	if err := addBytes(tw, SignatureName, sig); err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func addFile(tw *tar.Writer, name, path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	err = tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0600,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tw, h), f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func addBytes(tw *tar.Writer, name string, data []byte) error {
+	err := tw.WriteHeader(&tar.Header{
+		Name:    name,
+		Mode:    0644,
+		Size:    int64(len(data)),
+		ModTime: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = tw.Write(data)
+	return err
+}
+
+// Read extracts the bundle in r to dir and returns its manifest once the
+// signature and the checksums of all files have been verified. The signature
+// is not checked if pub is nil.
+func Read(r io.Reader, dir string, pub *ecdsa.PublicKey) (*Manifest, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a bundle: %s", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+
+	sums := map[string]string{}
+	var manifest, sig []byte
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case hdr.Name == ManifestName:
+			manifest, err = readAll(tr, 1<<20)
+		case hdr.Name == SignatureName:
+			sig, err = readAll(tr, 1<<10)
+		case allowed(hdr.Name) && hdr.Typeflag == tar.TypeReg:
+			sums[hdr.Name], err = extract(tr, filepath.Join(dir, hdr.Name))
+		default:
+			return nil, fmt.Errorf("unexpected file %s in bundle", hdr.Name)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("bundle has no manifest")
+	}
+	if pub != nil {
+		if sig == nil {
+			return nil, fmt.Errorf("bundle is not signed")
+		}
+		if err := Verify(pub, manifest, sig); err != nil {
+			return nil, err
+		}
+	}
+
+	var m Manifest
+	if err := json.Unmarshal(manifest, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %s", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported bundle version %d", m.Version)
+	}
+	for name, sum := range m.Files {
+		got, ok := sums[name]
+		if !ok {
+			return nil, fmt.Errorf("%s missing from bundle", name)
+		}
+		if got != sum {
+			return nil, fmt.Errorf("checksum mismatch for %s", name)
+		}
+	}
+	for name := range sums {
+		if _, ok := m.Files[name]; !ok {
+			return nil, fmt.Errorf("%s is not in the manifest", name)
+		}
+	}
+	return &m, nil
+}
+
+func readAll(r io.Reader, max int64) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(r, max+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(data)) > max {
+		return nil, fmt.Errorf("bundle file too large")
+	}
+	return data, nil
+}
+
+func extract(r io.Reader, path string) (string, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(f, h), r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// allowed reports whether name may be bundled. Only known names are accepted
+// so that extracting a bundle can't write outside its directory.
+func allowed(name string) bool {
+	return name == ConfigName || name == ImagesName || name == StackName
+}
@@ -0,0 +1,129 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeBundle(t *testing.T, dir string) ([]byte, *Manifest) {
+	config := filepath.Join(dir, "config")
+	images := filepath.Join(dir, "images")
+	if err := ioutil.WriteFile(config, []byte("image: dmc-rpi\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(images, []byte("image data"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteKeys(key, filepath.Join(dir, "bundle.key"), filepath.Join(dir, "bundle.pub")); err != nil {
+		t.Fatal(err)
+	}
+	m := &Manifest{Profile: "default", Images: []Image{{Ref: "docker.io/tobiasfriden/dmc-rpi:1.0.0", Digest: "sha256:100"}}}
+	var buf bytes.Buffer
+	err = Write(&buf, m, map[string]string{ConfigName: config, ImagesName: images}, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes(), m
+}
+
+func TestRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := writeBundle(t, dir)
+
+	pub, err := LoadPublicKey(filepath.Join(dir, "bundle.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	out := filepath.Join(dir, "out")
+	os.Mkdir(out, 0700)
+	m, err := Read(bytes.NewReader(data), out, pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m.Images) != 1 || m.Images[0].Digest != "sha256:100" {
+		t.Errorf("unexpected images %+v", m.Images)
+	}
+	config, err := ioutil.ReadFile(filepath.Join(out, ConfigName))
+	if err != nil || string(config) != "image: dmc-rpi\n" {
+		t.Errorf("unexpected config %q, %v", config, err)
+	}
+}
+
+func TestReadWrongKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := writeBundle(t, dir)
+
+	other, err := GenerateKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Read(bytes.NewReader(data), dir, &other.PublicKey)
+	if err == nil || !strings.Contains(err.Error(), "signature") {
+		t.Fatalf("expected signature error, got %v", err)
+	}
+}
+
+func TestReadTampered(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bundle")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	data, _ := writeBundle(t, dir)
+	pub, err := LoadPublicKey(filepath.Join(dir, "bundle.pub"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Swap the images but keep the signed manifest.
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	gr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gr)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, _ := ioutil.ReadAll(tr)
+		if hdr.Name == ImagesName {
+			content = []byte("evil data!")
+		}
+		hdr.Size = int64(len(content))
+		tw.WriteHeader(hdr)
+		tw.Write(content)
+	}
+	tw.Close()
+	gz.Close()
+
+	_, err = Read(&buf, dir, pub)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch for images.tar") {
+		t.Fatalf("expected checksum error, got %v", err)
+	}
+}
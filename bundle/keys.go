@@ -0,0 +1,113 @@
+package bundle
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"strings"
+)
+
+type signature struct {
+	R, S *big.Int
+}
+
+// GenerateKey returns a new P-256 signing key.
+func GenerateKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// Sign returns the base64 encoded signature of data.
+func Sign(key *ecdsa.PrivateKey, data []byte) ([]byte, error) {
+	sum := sha256.Sum256(data)
+	r, s, err := ecdsa.Sign(rand.Reader, key, sum[:])
+	if err != nil {
+		return nil, err
+	}
+	der, err := asn1.Marshal(signature{r, s})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(base64.StdEncoding.EncodeToString(der)), nil
+}
+
+// Verify checks a signature made by Sign.
+func Verify(pub *ecdsa.PublicKey, data, sig []byte) error {
+	der, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(sig)))
+	if err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	var s signature
+	if _, err := asn1.Unmarshal(der, &s); err != nil {
+		return fmt.Errorf("invalid signature: %s", err)
+	}
+	sum := sha256.Sum256(data)
+	if !ecdsa.Verify(pub, sum[:], s.R, s.S) {
+		return errors.New("bundle signature does not match the public key")
+	}
+	return nil
+}
+
+// WriteKeys writes key as PEM to keyPath, readable only by the owner, and its
+// public key to pubPath.
+func WriteKeys(key *ecdsa.PrivateKey, keyPath, pubPath string) error {
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+	pubDER, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(pubPath, pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pubDER}), 0644)
+}
+
+// LoadPrivateKey reads a key written by WriteKeys.
+func LoadPrivateKey(path string) (*ecdsa.PrivateKey, error) {
+	block, err := readPEM(path, "EC PRIVATE KEY")
+	if err != nil {
+		return nil, err
+	}
+	return x509.ParseECPrivateKey(block.Bytes)
+}
+
+// LoadPublicKey reads a public key written by WriteKeys.
+func LoadPublicKey(path string) (*ecdsa.PublicKey, error) {
+	block, err := readPEM(path, "PUBLIC KEY")
+	if err != nil {
+		return nil, err
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	key, ok := pub.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s is not an ECDSA public key", path)
+	}
+	return key, nil
+}
+
+func readPEM(path, typ string) (*pem.Block, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil || block.Type != typ {
+		return nil, fmt.Errorf("%s does not contain a PEM encoded %s", path, strings.ToLower(typ))
+	}
+	return block, nil
+}
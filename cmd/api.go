@@ -0,0 +1,151 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"net/url"
+	"strings"
+
+	"github.com/airpelago/dmctl/api"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
+)
+
+const defaultAPIURL = api.DefaultURL
+
+var (
+	APIURL string
+
+	apiClient *http.Client
+)
+
+// apiURL returns the backend API selected by --api-url, the DMC_API_URL
+// environment variable or the API_URL setting, without a trailing slash.
+func apiURL() string {
+	u := APIURL
+	if u == "" {
+		// Read here rather than bound to API_URL, which would save it to
+		// the profile with the next config change.
+		u = os.Getenv("DMC_API_URL")
+	}
+	if u == "" {
+		u = viper.GetString("API_URL")
+	}
+	if u == "" {
+		u = defaultAPIURL
+	}
+	return strings.TrimRight(u, "/")
+}
+
+// apiHTTPClient returns the client for backend API calls, trusting
+// API_CA_CERT and presenting API_CLIENT_CERT if they are set.
+func apiHTTPClient() (*http.Client, error) {
+	if apiClient != nil {
+		return apiClient, nil
+	}
+	caCert := viper.GetString("API_CA_CERT")
+	clientCert := viper.GetString("API_CLIENT_CERT")
+	clientKey := viper.GetString("API_CLIENT_KEY")
+	if caCert == "" && clientCert == "" {
+		apiClient = httpClient
+		return apiClient, nil
+	}
+
+	config := &tls.Config{}
+	if caCert != "" {
+		pem, err := ioutil.ReadFile(caCert)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not read API_CA_CERT")
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", caCert)
+		}
+		config.RootCAs = pool
+	}
+	if clientCert != "" {
+		if clientKey == "" {
+			clientKey = clientCert
+		}
+		cert, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return nil, errors.Wrap(err, "could not load API client certificate")
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	apiClient = &http.Client{
+		Transport: &http.Transport{
+			Proxy:           http.ProxyFromEnvironment,
+			TLSClientConfig: config,
+		},
+	}
+	return apiClient, nil
+}
+
+// newAPIClient returns a backend API client authorized with token, which may
+// be empty for calls that don't need it.
+func newAPIClient(token string) (*api.Client, error) {
+	httpClient, err := apiHTTPClient()
+	if err != nil {
+		return nil, err
+	}
+	client := api.NewClient(apiURL(), httpClient)
+	client.Token = token
+	return client, nil
+}
+
+// backendEnv points the onboard software at the backend the CLI uses, unless
+// DMC_URI has been set explicitly.
+func backendEnv(env []string) []string {
+	if uri := viper.GetString("DMC_URI"); uri != "" {
+		if domainOf(uri) != domainOf(apiURL()) {
+			warn(fmt.Sprintf("DMC_URI points at %s but dmctl uses %s", uri, apiURL()))
+		}
+		return env
+	}
+	if apiURL() == defaultAPIURL {
+		return env
+	}
+	return append(env, "DMC_URI="+apiURL())
+}
+
+// domainOf returns the domain of the host in a url, so that services of the
+// same backend on different subdomains are considered equal.
+func domainOf(rawurl string) string {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return rawurl
+	}
+	host := u.Hostname()
+	if net.ParseIP(host) != nil {
+		return host
+	}
+	labels := strings.Split(host, ".")
+	if len(labels) > 2 {
+		labels = labels[len(labels)-2:]
+	}
+	return strings.Join(labels, ".")
+}
@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestAPICustomCA(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/user/drones/" || r.Header.Get("Authorization") != "token" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, `{"drones":[{"name":"Quad 3","id":"quad-3"}]}`)
+	}))
+	defer srv.Close()
+	viper.Set("API_URL", srv.URL+"/")
+
+	client, err := newAPIClient("token")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Drones(context.Background()); err == nil {
+		t.Fatal("expected untrusted certificate to fail")
+	}
+
+	ca := filepath.Join(os.Getenv("HOME"), "ca.pem")
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	if err := ioutil.WriteFile(ca, cert, 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("API_CA_CERT", ca)
+	apiClient = nil
+	if client, err = newAPIClient("token"); err != nil {
+		t.Fatal(err)
+	}
+	drones, err := client.Drones(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(drones) != 1 || drones[0].ID != "quad-3" {
+		t.Errorf("unexpected drones %+v", drones)
+	}
+}
+
+func TestBackendEnv(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	if env := backendEnv(nil); len(env) != 0 {
+		t.Errorf("default backend should not be passed, got %v", env)
+	}
+	APIURL = "https://api.staging.example.com"
+	if env := backendEnv(nil); len(env) != 1 || env[0] != "DMC_URI=https://api.staging.example.com" {
+		t.Errorf("unexpected env %v", env)
+	}
+	viper.Set("DMC_URI", "wss://session.staging.example.com")
+	backendEnv(nil)
+	if out.Len() != 0 {
+		t.Errorf("unexpected warning %q", out.String())
+	}
+	viper.Set("DMC_URI", "https://api.dronemissioncontrol.com")
+	backendEnv(nil)
+	if !strings.Contains(out.String(), "DMC_URI points at") {
+		t.Errorf("missing warning in %q", out.String())
+	}
+}
+
+func TestAPIURLFromEnvNotSaved(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	os.Setenv("DMC_API_URL", "https://staging.example.com/")
+	defer os.Unsetenv("DMC_API_URL")
+
+	if got := apiURL(); got != "https://staging.example.com" {
+		t.Errorf("apiURL() = %s", got)
+	}
+	if err := runConfigSet(nil, []string{"ID", "quad-3"}); err != nil {
+		t.Fatal(err)
+	}
+	path, err := configFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "staging") {
+		t.Errorf("DMC_API_URL saved to the profile:\n%s", raw)
+	}
+}
@@ -0,0 +1,433 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/logarchive"
+	units "github.com/docker/go-units"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	// archiverPort is held by dmctl logs archive run, so that only one
+	// archiver runs and dmctl stop knows it doesn't need to archive.
+	archiverPort = 14592
+
+	defaultSegmentSize = "10MB"
+	defaultArchiveSize = "500MB"
+	defaultArchiveAge  = "720h"
+)
+
+var (
+	ExportFile string
+
+	// archivePollInterval is how often the archiver looks for a new drone
+	// container.
+	archivePollInterval = 2 * time.Second
+)
+
+var logsArchiveCmd = &cobra.Command{
+	Use:   "archive",
+	Short: "Keep the output of the drone container after it is removed",
+	Long: `With LOG_ARCHIVE set, the output of the drone container is captured into
+rotated, gzipped files under LOG_ARCHIVE_DIR, one session per container
+started, named after the time it started. Segments are rotated at
+LOG_ARCHIVE_SEGMENT_SIZE and sessions older than LOG_ARCHIVE_MAX_AGE, or
+beyond LOG_ARCHIVE_MAX_SIZE in total, are removed.
+
+The output is captured continuously by dmctl logs archive run, which
+dmctl service install runs as a systemd unit. Without it, dmctl stop
+archives the output before removing the container.`,
+}
+
+var logsArchiveRunCmd = &cobra.Command{
+	Use:   "run",
+	Short: "Captures the output of the drone container until interrupted",
+	Args:  cobra.NoArgs,
+	RunE:  runLogsArchive,
+}
+
+var logsArchiveListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists the archived sessions, newest first",
+	Args:  cobra.NoArgs,
+	RunE:  runLogsArchiveList,
+}
+
+var logsArchiveShowCmd = &cobra.Command{
+	Use:   "show [SESSION]",
+	Short: "Prints the output of an archived session, the newest by default",
+	Long: `Prints the output of an archived session, the newest by default. A
+session can be given by a unique prefix of its id, such as 20190601.`,
+	Args: cobra.MaximumNArgs(1),
+	RunE: runLogsArchiveShow,
+}
+
+var logsArchiveExportCmd = &cobra.Command{
+	Use:   "export [SESSION...]",
+	Short: "Writes archived sessions, all by default, to a gzipped tar",
+	RunE:  runLogsArchiveExport,
+}
+
+// archiveSession is the schema of a session in dmctl logs archive list
+// --output json|yaml.
+type archiveSession struct {
+	ID         string     `json:"id" yaml:"id"`
+	Container  string     `json:"container" yaml:"container"`
+	Image      string     `json:"image" yaml:"image"`
+	StartedAt  time.Time  `json:"started_at" yaml:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty" yaml:"finished_at,omitempty"`
+	ExitCode   *int       `json:"exit_code,omitempty" yaml:"exit_code,omitempty"`
+	Size       int64      `json:"size" yaml:"size"`
+	Segments   int        `json:"segments" yaml:"segments"`
+}
+
+type archiveListResult struct {
+	Dir      string           `json:"dir" yaml:"dir"`
+	Sessions []archiveSession `json:"sessions" yaml:"sessions"`
+}
+
+func runLogsArchive(cmd *cobra.Command, args []string) error {
+	if !viper.GetBool("LOG_ARCHIVE") {
+		return fmt.Errorf("log archiving is not enabled, run dmctl config set LOG_ARCHIVE true")
+	}
+	a, err := logArchive()
+	if err != nil {
+		return err
+	}
+	lock, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(archiverPort)))
+	if err != nil {
+		return fmt.Errorf("another log archiver is running: %s", err)
+	}
+	defer lock.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	name := containerName(droneService)
+	fmt.Fprintf(stdout, "Archiving %s to %s\n", name, a.Dir)
+	for {
+		if err := a.Prune(time.Now(), ""); err != nil {
+			warn(fmt.Sprintf("Failed to prune the log archive: %s", err))
+		}
+		c, err := findContainer(ctx, name)
+		if err != nil && ctx.Err() == nil {
+			warn(err.Error())
+		} else if c != nil {
+			if err := archiveContainer(ctx, a, c, true); err != nil && ctx.Err() == nil {
+				warn(fmt.Sprintf("Failed to archive %s: %s", name, err))
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(archivePollInterval):
+		}
+	}
+}
+
+// archiveContainer captures the output of c that isn't archived yet,
+// following it until the container stops if follow is set.
+func archiveContainer(ctx context.Context, a *logarchive.Archive, c *engine.Container, follow bool) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	profile := c.Labels[profileLabel]
+	if profile == "" {
+		profile = activeProfile()
+	}
+	w, err := a.Create(logarchive.Session{
+		Container:   c.Name,
+		ContainerID: c.ID,
+		Image:       c.Image,
+		Profile:     profile,
+		StartedAt:   c.Created,
+	})
+	if err != nil {
+		return err
+	}
+	out, err := eng.Logs(ctx, c.ID, engine.LogOptions{Follow: follow})
+	if err != nil {
+		w.Close()
+		return err
+	}
+	defer out.Close()
+	// The output is read from the start, skip what a previous run captured.
+	if _, err := io.CopyN(ioutil.Discard, out, w.Captured()); err != nil && err != io.EOF {
+		w.Close()
+		return err
+	}
+	if _, err := io.Copy(w, out); err != nil {
+		w.Close()
+		return err
+	}
+	if ctx.Err() != nil {
+		return w.Close()
+	}
+	finished := time.Now()
+	var exitCode *int
+	if state, err := eng.Inspect(ctx, c.ID); err == nil && !state.Running {
+		if !state.FinishedAt.IsZero() {
+			finished = state.FinishedAt
+		}
+		exitCode = &state.ExitCode
+	} else if err == nil && follow {
+		// The stream ended but the container runs, pick it up again.
+		return w.Close()
+	}
+	return w.Finish(finished, exitCode)
+}
+
+// archiveBeforeRemove archives the output of the drone container when no
+// archiver is running to capture it.
+func archiveBeforeRemove(ctx context.Context, c *engine.Container) {
+	if !viper.GetBool("LOG_ARCHIVE") || c.Name != containerName(droneService) || archiverRunning() {
+		return
+	}
+	a, err := logArchive()
+	if err == nil {
+		err = archiveContainer(ctx, a, c, false)
+	}
+	if err != nil {
+		warn(fmt.Sprintf("Failed to archive the output of %s: %s", c.Name, err))
+	}
+}
+
+func archiverRunning() bool {
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(archiverPort)))
+	if err != nil {
+		return true
+	}
+	l.Close()
+	return false
+}
+
+// logArchive returns the archive of the drone container of the active
+// profile.
+func logArchive() (*logarchive.Archive, error) {
+	dir := viper.GetString("LOG_ARCHIVE_DIR")
+	if dir == "" {
+		d, err := configDir()
+		if err != nil {
+			return nil, err
+		}
+		dir = filepath.Join(d, "logs")
+	}
+	a := &logarchive.Archive{Dir: filepath.Join(dir, containerName(droneService))}
+	var err error
+	if a.SegmentSize, err = archiveSize("LOG_ARCHIVE_SEGMENT_SIZE", defaultSegmentSize); err != nil {
+		return nil, err
+	}
+	if a.MaxSize, err = archiveSize("LOG_ARCHIVE_MAX_SIZE", defaultArchiveSize); err != nil {
+		return nil, err
+	}
+	age := viper.GetString("LOG_ARCHIVE_MAX_AGE")
+	if age == "" {
+		age = defaultArchiveAge
+	}
+	if a.MaxAge, err = time.ParseDuration(age); err != nil {
+		return nil, fmt.Errorf("invalid LOG_ARCHIVE_MAX_AGE: %s", err)
+	}
+	return a, nil
+}
+
+func archiveSize(key, def string) (int64, error) {
+	v := viper.GetString(key)
+	if v == "" {
+		v = def
+	}
+	size, err := units.RAMInBytes(v)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %s", key, err)
+	}
+	return size, nil
+}
+
+func runLogsArchiveList(cmd *cobra.Command, args []string) error {
+	a, err := logArchive()
+	if err != nil {
+		return err
+	}
+	sessions, err := a.List()
+	if err != nil {
+		return err
+	}
+	result := archiveListResult{Dir: a.Dir, Sessions: []archiveSession{}}
+	for _, s := range sessions {
+		session := archiveSession{
+			ID:        s.ID,
+			Container: s.Container,
+			Image:     s.Image,
+			StartedAt: s.StartedAt,
+			ExitCode:  s.ExitCode,
+			Size:      s.Size,
+			Segments:  s.Segments,
+		}
+		if !s.FinishedAt.IsZero() {
+			finished := s.FinishedAt
+			session.FinishedAt = &finished
+		}
+		result.Sessions = append(result.Sessions, session)
+	}
+	return printResult(result, func(w io.Writer) {
+		if len(result.Sessions) == 0 {
+			bad(fmt.Sprintf("No archived logs in %s", a.Dir))
+			return
+		}
+		fmt.Fprintln(w, "SESSION\tIMAGE\tSTARTED\tDURATION\tEXIT\tSIZE")
+		for _, s := range result.Sessions {
+			duration, exit := "running", "-"
+			if s.FinishedAt != nil {
+				duration = s.FinishedAt.Sub(s.StartedAt).Round(time.Second).String()
+			}
+			if s.ExitCode != nil {
+				exit = strconv.Itoa(*s.ExitCode)
+			}
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\t%s\n", s.ID, s.Image, s.StartedAt.Local().Format("2006-01-02 15:04:05"), duration, exit, units.BytesSize(float64(s.Size)))
+		}
+	})
+}
+
+func runLogsArchiveShow(cmd *cobra.Command, args []string) error {
+	filter, err := newLogFilter(LogLevel, Grep)
+	if err != nil {
+		return err
+	}
+	a, err := logArchive()
+	if err != nil {
+		return err
+	}
+	var id string
+	if len(args) > 0 {
+		s, err := a.Find(args[0])
+		if err != nil {
+			return err
+		}
+		id = s.ID
+	} else {
+		sessions, err := a.List()
+		if err != nil {
+			return err
+		}
+		if len(sessions) == 0 {
+			bad(fmt.Sprintf("No archived logs in %s", a.Dir))
+			return nil
+		}
+		id = sessions[0].ID
+	}
+	r, err := a.Open(id)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return copyLogLines(stdout, &sync.Mutex{}, r, "", filter)
+}
+
+func runLogsArchiveExport(cmd *cobra.Command, args []string) error {
+	a, err := logArchive()
+	if err != nil {
+		return err
+	}
+	var ids []string
+	for _, arg := range args {
+		s, err := a.Find(arg)
+		if err != nil {
+			return err
+		}
+		ids = append(ids, s.ID)
+	}
+	if len(args) == 0 {
+		sessions, err := a.List()
+		if err != nil {
+			return err
+		}
+		for _, s := range sessions {
+			ids = append(ids, s.ID)
+		}
+	}
+	if len(ids) == 0 {
+		bad(fmt.Sprintf("No archived logs in %s", a.Dir))
+		return nil
+	}
+	if ExportFile == "-" {
+		return a.Export(ids, stdout)
+	}
+	path := ExportFile
+	if path == "" {
+		path = fmt.Sprintf("%s-logs-%s.tar.gz", containerName(droneService), time.Now().UTC().Format("20060102T150405Z"))
+	}
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err := a.Export(ids, f); err != nil {
+		f.Close()
+		os.Remove(path)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Exported %d sessions to %s", len(ids), path))
+	return nil
+}
+
+func validateSize(v string) error {
+	if _, err := units.RAMInBytes(v); err != nil {
+		return fmt.Errorf("expected a size such as 10MB")
+	}
+	return nil
+}
+
+func validateDuration(v string) error {
+	if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+		return fmt.Errorf("expected a duration such as 720h")
+	}
+	return nil
+}
+
+func init() {
+	logsCmd.AddCommand(logsArchiveCmd)
+	logsArchiveCmd.AddCommand(logsArchiveRunCmd, logsArchiveListCmd, logsArchiveShowCmd, logsArchiveExportCmd)
+
+	logsArchiveShowCmd.Flags().StringVarP(&LogLevel, "level", "l", "", "Show lines at or above a level: "+strings.Join(logLevels, ", "))
+	logsArchiveShowCmd.Flags().StringVarP(&Grep, "grep", "g", "", "Show lines matching a regular expression")
+	logsArchiveExportCmd.Flags().StringVarP(&ExportFile, "file", "f", "", "File to write, - for stdout (default DRONE-logs-TIME.tar.gz)")
+}
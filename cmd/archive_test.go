@@ -0,0 +1,194 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/viper"
+)
+
+func listArchive(t *testing.T, out *bytes.Buffer) archiveListResult {
+	Output = outputJSON
+	defer func() { Output = outputTable }()
+	var result archiveListResult
+	out.Reset()
+	if err := runLogsArchiveList(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	return result
+}
+
+func TestArchiveOnStop(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("LOG_ARCHIVE", "true")
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "log archiver is not running") {
+		t.Errorf("expected archiver warning in %q", out.String())
+	}
+	fake.SetOutput("drone", "INFO connected to FCU\nERROR heartbeat lost\n")
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	result := listArchive(t, out)
+	home, _ := os.UserHomeDir()
+	if result.Dir != filepath.Join(home, ".dmc", "logs", "drone") {
+		t.Errorf("unexpected dir %s", result.Dir)
+	}
+	if len(result.Sessions) != 1 {
+		t.Fatalf("got %d sessions", len(result.Sessions))
+	}
+	s := result.Sessions[0]
+	if s.Container != "drone" || !strings.Contains(s.Image, "dmc-rpi") || s.FinishedAt == nil {
+		t.Errorf("unexpected session %+v", s)
+	}
+
+	out.Reset()
+	LogLevel = "error"
+	defer resetLogFlags()
+	if err := runLogsArchiveShow(nil, []string{s.ID[:8]}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ERROR heartbeat lost\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	ExportFile = filepath.Join(home, "export.tar.gz")
+	defer func() { ExportFile = "" }()
+	if err := runLogsArchiveExport(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.Open(ExportFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	var names []string
+	for h, err := tr.Next(); err == nil; h, err = tr.Next() {
+		names = append(names, h.Name)
+	}
+	if strings.Join(names, ",") != s.ID+"/session.json,"+s.ID+"/drone.log" {
+		t.Errorf("unexpected export %v", names)
+	}
+	if err := runLogsArchiveExport(nil, nil); err == nil {
+		t.Error("expected error overwriting the export")
+	}
+}
+
+func TestArchiveCrashedContainer(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("LOG_ARCHIVE", "true")
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.OnStart = func(c *engine.FakeContainer) {
+		c.Running = false
+		c.ExitCode = 2
+		c.Output = "FATAL lost FCU link\n"
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.OnStart = nil
+	// Starting again removes the crashed container.
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	result := listArchive(t, out)
+	if len(result.Sessions) != 1 {
+		t.Fatalf("got %d sessions", len(result.Sessions))
+	}
+	if s := result.Sessions[0]; s.ExitCode == nil || *s.ExitCode != 2 {
+		t.Errorf("unexpected session %+v", s)
+	}
+}
+
+func TestArchiveContainerResumes(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	a, err := logArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+	c, err := findContainer(ctx, "drone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "one\n")
+	if err := archiveContainer(ctx, a, c, true); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "one\ntwo\n")
+	if err := archiveContainer(ctx, a, c, true); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runLogsArchiveShow(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "one\ntwo\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if s := listArchive(t, out).Sessions[0]; s.FinishedAt != nil {
+		t.Errorf("session of a running container finished: %+v", s)
+	}
+}
+
+func TestLogArchiveSettings(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	viper.Set("LOG_ARCHIVE_DIR", "/var/log/dmc")
+	viper.Set("LOG_ARCHIVE_SEGMENT_SIZE", "1MB")
+	viper.Set("LOG_ARCHIVE_MAX_AGE", "24h")
+	a, err := logArchive()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.Dir != filepath.Join("/var/log/dmc", "drone") || a.SegmentSize != 1<<20 || a.MaxSize != 500<<20 || a.MaxAge.Hours() != 24 {
+		t.Errorf("unexpected archive %+v", a)
+	}
+	viper.Set("LOG_ARCHIVE_MAX_SIZE", "lots")
+	if _, err := logArchive(); err == nil {
+		t.Error("expected invalid size error")
+	}
+	if err := validateSize("10MB"); err != nil {
+		t.Error(err)
+	}
+	if err := validateDuration("-1h"); err == nil {
+		t.Error("expected negative duration error")
+	}
+}
@@ -0,0 +1,220 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/airpelago/dmctl/api"
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Tokens are refreshed, or a warning printed if they can't be, when they
+// expire within refreshBefore.
+const refreshBefore = time.Hour
+
+// authCmd represents the auth command
+var authCmd = &cobra.Command{
+	Use:   "auth",
+	Short: "Inspect the dmc login",
+}
+
+var authStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows who is logged in and when the login expires",
+	Args:  cobra.NoArgs,
+	RunE:  runAuthStatus,
+}
+
+var logoutCmd = &cobra.Command{
+	Use:   "logout",
+	Short: "Removes the stored dmc login",
+	Args:  cobra.NoArgs,
+	RunE:  runLogout,
+}
+
+// authStatus is the schema of dmctl auth status --output json|yaml.
+type authStatus struct {
+	APIURL   string     `json:"api_url" yaml:"api_url"`
+	LoggedIn bool       `json:"logged_in" yaml:"logged_in"`
+	User     string     `json:"user,omitempty" yaml:"user,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty" yaml:"expires,omitempty"`
+	Expired  bool       `json:"expired" yaml:"expired"`
+	// SecretStore is where the token is kept, keyring or file.
+	SecretStore string `json:"secret_store" yaml:"secret_store"`
+}
+
+// runAuthStatus exits with exitNotLoggedIn unless there is a valid login for
+// the configured backend.
+func runAuthStatus(cmd *cobra.Command, args []string) error {
+	status := authStatus{APIURL: apiURL()}
+	if _, err := getSecretStore(); err == nil {
+		status.SecretStore = secretStoreKind
+	}
+	token := viper.GetString("TOKEN")
+	issuer := viper.GetString("TOKEN_API_URL")
+	if token != "" && (issuer == "" || issuer == apiURL()) {
+		claims, err := tokenClaims(token)
+		if err != nil {
+			return err
+		}
+		status.LoggedIn = true
+		status.User = claims.user()
+		if exp := claims.expiry(); !exp.IsZero() {
+			status.Expires = &exp
+			status.Expired = time.Now().After(exp)
+		}
+	}
+
+	err := printResult(status, func(w io.Writer) {
+		switch {
+		case token == "":
+			bad(fmt.Sprintf("Not logged in to %s", apiURL()))
+		case !status.LoggedIn:
+			bad(fmt.Sprintf("Logged in to %s, not %s", issuer, apiURL()))
+		case status.Expired:
+			bad(fmt.Sprintf("Login as %s expired %s", status.User, status.Expires.Local().Format(time.RFC1123)))
+		default:
+			good(fmt.Sprintf("Logged in to %s as %s", apiURL(), status.User))
+			if status.Expires == nil {
+				fmt.Fprintln(w, "Login does not expire")
+			} else if left := time.Until(*status.Expires); left < refreshBefore {
+				warn(fmt.Sprintf("Login expires %s, in %s", status.Expires.Local().Format(time.RFC1123), left.Truncate(time.Second)))
+			} else {
+				fmt.Fprintf(w, "Login expires %s\n", status.Expires.Local().Format(time.RFC1123))
+			}
+		}
+		if status.SecretStore == "file" {
+			warn("Secrets are kept in a file whose key is stored next to it, anyone who can read the config directory can read them. Set SECRET_STORE to keyring to protect them")
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !status.LoggedIn || status.Expired {
+		return &exitError{Code: exitNotLoggedIn}
+	}
+	return nil
+}
+
+func runLogout(cmd *cobra.Command, args []string) error {
+	if viper.GetString("TOKEN") == "" {
+		bad("Not logged in")
+		return nil
+	}
+	viper.Set("TOKEN", "")
+	viper.Set("TOKEN_API_URL", "")
+	if err := writeConfig(); err != nil {
+		return err
+	}
+	good("Logged out")
+	return nil
+}
+
+// token returns a token for the configured backend, refreshing it if it is
+// about to expire and logging in if there is none or it has expired.
+func token() (string, error) {
+	// A token is only valid for the backend that issued it.
+	current := viper.GetString("TOKEN")
+	if current != "" && viper.GetString("TOKEN_API_URL") == apiURL() {
+		if claims, err := tokenClaims(current); err == nil {
+			exp := claims.expiry()
+			if exp.IsZero() || time.Until(exp) > refreshBefore {
+				return current, nil
+			}
+			if time.Now().Before(exp) {
+				if refreshed, err := refreshToken(current); err == nil {
+					return refreshed, nil
+				}
+				warn(fmt.Sprintf("Login expires in %s, run dmctl login to renew it", time.Until(exp).Truncate(time.Second)))
+				return current, nil
+			}
+		}
+	}
+	token, err := login()
+	if err != nil {
+		return "", err
+	}
+	if err := saveToken(token); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func refreshToken(current string) (string, error) {
+	client, err := newAPIClient(current)
+	if err != nil {
+		return "", err
+	}
+	token, err := client.Refresh(context.Background())
+	if err != nil {
+		if err != api.ErrRefreshUnsupported && Verbose {
+			warn(fmt.Sprintf("Could not refresh login: %s", err))
+		}
+		return "", err
+	}
+	return token, saveToken(token)
+}
+
+func saveToken(token string) error {
+	viper.Set("TOKEN", token)
+	viper.Set("TOKEN_API_URL", apiURL())
+	return writeConfig()
+}
+
+type claims jwt.MapClaims
+
+// tokenClaims decodes the claims of a token without verifying its
+// signature, which only the backend can do. They are only used to tell the
+// user who they are and to decide when to refresh.
+func tokenClaims(token string) (claims, error) {
+	c := jwt.MapClaims{}
+	if _, _, err := new(jwt.Parser).ParseUnverified(token, c); err != nil {
+		return nil, fmt.Errorf("invalid token: %s", err)
+	}
+	return claims(c), nil
+}
+
+func (c claims) expiry() time.Time {
+	switch exp := c["exp"].(type) {
+	case float64:
+		return time.Unix(int64(exp), 0)
+	case json.Number:
+		n, _ := exp.Int64()
+		return time.Unix(n, 0)
+	}
+	return time.Time{}
+}
+
+func (c claims) user() string {
+	for _, key := range []string{"email", "username", "name", "sub"} {
+		if v, ok := c[key].(string); ok && v != "" {
+			return v
+		}
+	}
+	return "unknown user"
+}
+
+func init() {
+	rootCmd.AddCommand(authCmd, logoutCmd)
+	authCmd.AddCommand(authStatusCmd)
+}
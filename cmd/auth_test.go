@@ -0,0 +1,136 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	jwt "github.com/dgrijalva/jwt-go"
+	"github.com/spf13/viper"
+)
+
+func testToken(t *testing.T, email string, expires time.Duration) string {
+	token, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
+		"email": email,
+		"exp":   time.Now().Add(expires).Unix(),
+	}).SignedString([]byte("test"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return token
+}
+
+func TestAuthStatus(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	err := runAuthStatus(nil, nil)
+	if exit, ok := err.(*exitError); !ok || exit.Code != exitNotLoggedIn {
+		t.Fatalf("expected not logged in exit code, got %v", err)
+	}
+	if !strings.Contains(out.String(), "Not logged in") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := saveToken(testToken(t, "pilot@example.com", 24*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runAuthStatus(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "as pilot@example.com") || !strings.Contains(out.String(), "Login expires") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	if !strings.Contains(out.String(), "key is stored next to it") {
+		t.Errorf("file store not warned about: %q", out.String())
+	}
+
+	if err := runLogout(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := secretStore.Get(secretName(defaultProfile, "TOKEN")); err == nil {
+		t.Error("token still stored after logout")
+	}
+}
+
+func TestTokenRefresh(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	refreshed := testToken(t, "pilot@example.com", 24*time.Hour)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/drone/refreshtoken" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprintf(w, "%q", refreshed)
+	}))
+	defer srv.Close()
+	viper.Set("API_URL", srv.URL)
+
+	if err := saveToken(testToken(t, "pilot@example.com", 10*time.Minute)); err != nil {
+		t.Fatal(err)
+	}
+	got, err := token()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != refreshed || viper.GetString("TOKEN") != refreshed {
+		t.Error("token not refreshed")
+	}
+}
+
+func TestSecretsNotInConfig(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	// Config written by older versions has secrets in plain text.
+	path, err := configFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	token := testToken(t, "pilot@example.com", time.Hour)
+	config := fmt.Sprintf("id: quad-3\npassword: hunter2\ntoken: %s\n", token)
+	if err := ioutil.WriteFile(path, []byte(config), 0644); err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(raw), "hunter2") || strings.Contains(string(raw), token) {
+		t.Errorf("secrets left in config:\n%s", raw)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("config has mode %v", info.Mode())
+	}
+	if v, err := secretStore.Get(secretName(defaultProfile, "PASSWORD")); err != nil || v != "hunter2" {
+		t.Errorf("password not stored: %q, %v", v, err)
+	}
+
+	// A fresh start reads them back from the store.
+	viper.Reset()
+	viper.SetConfigFile(path)
+	viper.ReadInConfig()
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("PASSWORD") != "hunter2" || viper.GetString("ID") != "quad-3" {
+		t.Errorf("unexpected settings %v", viper.AllSettings())
+	}
+}
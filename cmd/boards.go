@@ -0,0 +1,216 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// board is an OBC type that the onboard software has an image for.
+type board struct {
+	Key   string `yaml:"key"`
+	Name  string `yaml:"name"`
+	Image string `yaml:"image"`
+	// SimType is set for simulated drones, which are never detected.
+	SimType string `yaml:"sim_type,omitempty"`
+	// Arches are the GOARCH values of hosts that can run Image, the one it
+	// is built for first.
+	Arches []string `yaml:"arches"`
+	// Models are substrings of the device tree model or /proc/cpuinfo
+	// that identify the board.
+	Models []string `yaml:"models,omitempty"`
+}
+
+// builtinBoards is the board catalog shipped with dmctl. Boards in
+// ~/.dmc/boards.yaml are added to it, replacing boards with the same key.
+const builtinBoards = `
+- key: rpi
+  name: Raspberry Pi
+  image: dmc-rpi
+  arches: [arm, arm64]
+  models: [Raspberry Pi]
+- key: x86
+  name: Linux 64-bit
+  image: dmc-x86
+  arches: [amd64]
+- key: sim-copter
+  name: Simulated - Copter
+  image: dmc-sim
+  sim_type: copter
+  arches: [amd64]
+- key: sim-plane
+  name: Simulated - Plane
+  image: dmc-sim
+  sim_type: plane
+  arches: [amd64]
+- key: sim-vtol
+  name: Simulated - VTOL
+  image: dmc-sim
+  sim_type: vtol
+  arches: [amd64]
+- key: sim-rover
+  name: Simulated - Rover
+  image: dmc-sim
+  sim_type: rover
+  arches: [amd64]
+`
+
+// Host files read by detectHost, replaced in tests.
+var (
+	deviceTreeModelPath = "/proc/device-tree/model"
+	cpuInfoPath         = "/proc/cpuinfo"
+)
+
+// loadBoards returns the board catalog.
+func loadBoards() ([]board, error) {
+	var boards []board
+	if err := yaml.Unmarshal([]byte(builtinBoards), &boards); err != nil {
+		return nil, err
+	}
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, "boards.yaml")
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return boards, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var custom []board
+	if err := yaml.Unmarshal(raw, &custom); err != nil {
+		return nil, fmt.Errorf("invalid board catalog %s: %s", path, err)
+	}
+	for _, b := range custom {
+		if b.Key == "" || b.Image == "" || len(b.Arches) == 0 {
+			return nil, fmt.Errorf("invalid board catalog %s: boards need a key, image and arches", path)
+		}
+		replaced := false
+		for i := range boards {
+			if boards[i].Key == b.Key {
+				boards[i], replaced = b, true
+			}
+		}
+		if !replaced {
+			boards = append(boards, b)
+		}
+	}
+	return boards, nil
+}
+
+// findBoard returns the board with the given key, or nil.
+func findBoard(boards []board, key string) *board {
+	for i := range boards {
+		if boards[i].Key == key {
+			return &boards[i]
+		}
+	}
+	return nil
+}
+
+// supports reports whether the board's image runs on arch.
+func (b *board) supports(arch string) bool {
+	for _, a := range b.Arches {
+		if a == arch {
+			return true
+		}
+	}
+	return false
+}
+
+// hostInfo describes the machine dmctl runs on.
+type hostInfo struct {
+	Arch string
+	// Model is the device tree model, or the CPU model where there is no
+	// device tree.
+	Model string
+}
+
+func detectHost() hostInfo {
+	host := hostInfo{Arch: runtime.GOARCH}
+	if raw, err := ioutil.ReadFile(deviceTreeModelPath); err == nil {
+		host.Model = strings.TrimSpace(strings.TrimRight(string(raw), "\x00"))
+	}
+	if host.Model != "" {
+		return host
+	}
+	raw, err := ioutil.ReadFile(cpuInfoPath)
+	if err != nil {
+		return host
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(raw))
+	for scanner.Scan() {
+		parts := strings.SplitN(scanner.Text(), ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch strings.TrimSpace(parts[0]) {
+		case "Model", "Hardware", "model name":
+			host.Model = strings.TrimSpace(parts[1])
+			return host
+		}
+	}
+	return host
+}
+
+// detectBoard returns the board that best matches host, or nil. A board
+// whose model matches beats a generic one, and a board built for the host
+// architecture beats one that merely runs on it.
+func detectBoard(boards []board, host hostInfo) *board {
+	var best *board
+	bestScore := -1
+	for i := range boards {
+		b := &boards[i]
+		if b.SimType != "" || !b.supports(host.Arch) {
+			continue
+		}
+		score := 0
+		if len(b.Models) > 0 {
+			if !matchesModel(b.Models, host.Model) {
+				continue
+			}
+			score += 2
+		}
+		if b.Arches[0] == host.Arch {
+			score++
+		}
+		if score > bestScore {
+			best, bestScore = b, score
+		}
+	}
+	return best
+}
+
+func matchesModel(models []string, model string) bool {
+	model = strings.ToLower(model)
+	for _, m := range models {
+		if strings.Contains(model, strings.ToLower(m)) {
+			return true
+		}
+	}
+	return false
+}
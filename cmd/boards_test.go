@@ -0,0 +1,131 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestDetectBoard(t *testing.T) {
+	boards, err := loadBoards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		host hostInfo
+		want string
+	}{
+		{hostInfo{"arm", "Raspberry Pi 3 Model B Plus Rev 1.3"}, "rpi"},
+		{hostInfo{"arm64", "Raspberry Pi 4 Model B Rev 1.4"}, "rpi"},
+		{hostInfo{"arm64", "NVIDIA Jetson Nano Developer Kit"}, ""},
+		{hostInfo{"amd64", "Intel(R) Core(TM) i5-8365U CPU @ 1.60GHz"}, "x86"},
+		{hostInfo{"arm", "BeagleBone Black"}, ""},
+	}
+	for _, test := range tests {
+		got := ""
+		if b := detectBoard(boards, test.host); b != nil {
+			got = b.Key
+		}
+		if got != test.want {
+			t.Errorf("%+v: detected %q, want %q", test.host, got, test.want)
+		}
+	}
+}
+
+func TestDetectHost(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dmctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(model, cpuinfo string) {
+		deviceTreeModelPath, cpuInfoPath = model, cpuinfo
+	}(deviceTreeModelPath, cpuInfoPath)
+	deviceTreeModelPath = filepath.Join(dir, "model")
+	cpuInfoPath = filepath.Join(dir, "cpuinfo")
+
+	ioutil.WriteFile(cpuInfoPath, []byte("processor\t: 0\nmodel name\t: Intel(R) Atom(TM) x5-Z8350\n"), 0644)
+	if host := detectHost(); host.Arch != runtime.GOARCH || host.Model != "Intel(R) Atom(TM) x5-Z8350" {
+		t.Errorf("unexpected host %+v", host)
+	}
+	ioutil.WriteFile(deviceTreeModelPath, []byte("Raspberry Pi 4 Model B Rev 1.4\x00"), 0644)
+	if host := detectHost(); host.Model != "Raspberry Pi 4 Model B Rev 1.4" {
+		t.Errorf("unexpected host %+v", host)
+	}
+}
+
+func TestCustomBoards(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	dir, err := configDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(dir, 0700)
+	custom := "- key: x86\n  name: Companion PC\n  image: dmc-x86-v3\n  arches: [amd64]\n" +
+		"- key: navio\n  name: Navio2\n  image: dmc-rpi\n  arches: [arm]\n  models: [Navio]\n"
+	if err := ioutil.WriteFile(filepath.Join(dir, "boards.yaml"), []byte(custom), 0644); err != nil {
+		t.Fatal(err)
+	}
+	boards, err := loadBoards()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := findBoard(boards, "x86"); b == nil || b.Image != "dmc-x86-v3" {
+		t.Errorf("x86 not replaced: %+v", b)
+	}
+	if b := findBoard(boards, "navio"); b == nil || b.Name != "Navio2" {
+		t.Errorf("navio not added: %+v", b)
+	}
+	if err := validateImage("dmc-x86-v3"); err != nil {
+		t.Error(err)
+	}
+
+	ioutil.WriteFile(filepath.Join(dir, "boards.yaml"), []byte("- key: broken\n"), 0644)
+	if _, err := loadBoards(); err == nil {
+		t.Error("expected invalid catalog to fail")
+	}
+}
+
+func TestConfigureOBC(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	defer func() {
+		obcKey, anyArch, NonInteractive = "", false, false
+	}()
+	defer func(model, cpuinfo string) {
+		deviceTreeModelPath, cpuInfoPath = model, cpuinfo
+	}(deviceTreeModelPath, cpuInfoPath)
+	deviceTreeModelPath, cpuInfoPath = "/nonexistent", "/nonexistent"
+
+	other := "x86"
+	if runtime.GOARCH == "amd64" {
+		other = "rpi"
+	}
+	obcKey = other
+	err := rungConfigureOBC(obcCmd, nil)
+	if err == nil || !strings.Contains(err.Error(), "--any-arch") {
+		t.Fatalf("expected architecture mismatch, got %v", err)
+	}
+	anyArch = true
+	if err := rungConfigureOBC(obcCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if runtime.GOARCH != "amd64" {
+		return
+	}
+	obcKey, anyArch, NonInteractive = "", false, true
+	if err := rungConfigureOBC(obcCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if img := viper.GetString("IMAGE"); img != "dmc-x86" {
+		t.Errorf("detected image %s, want dmc-x86", img)
+	}
+}
@@ -0,0 +1,400 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/bundle"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+var (
+	BundleKey        string
+	BundlePubKey     string
+	SkipVerify       bool
+	StartAfterBundle bool
+	IncludeSecrets   bool
+)
+
+// bundledKeys are the settings a bundle carries to another machine. Logins,
+// paths and settings of the host, such as RUNTIME or API_CLIENT_CERT, stay
+// where they were set, and PASSWORD is only bundled with --include-secrets.
+var bundledKeys = []string{
+	"ID", "FCU_URL", "GCS_URL", "GCS_FORWARDS", "MAVLINK_ROUTER",
+	"DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION",
+	"REGISTRY", "NAMESPACE", "IMAGE", "IMAGE_VERSION", "IMAGE_DIGEST",
+	"SIM_TYPE", "SIM_HEADING", "SIM_SPEEDUP", "SIM_WIND",
+	"LOG_ARCHIVE", "LOG_ARCHIVE_SEGMENT_SIZE", "LOG_ARCHIVE_MAX_SIZE", "LOG_ARCHIVE_MAX_AGE",
+	"ARMED_INTERLOCK", "STOP_TIMEOUT", "KEEP_STOPPED", "API_URL",
+}
+
+// bundledKey reports whether key is applied when a bundle is installed.
+func bundledKey(key string) bool {
+	if strings.EqualFold(key, "PASSWORD") {
+		return true
+	}
+	for _, k := range bundledKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// bundleCmd represents the bundle command
+var bundleCmd = &cobra.Command{
+	Use:   "bundle",
+	Short: "Create and install signed bundles for drones without internet access",
+}
+
+var bundleKeygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Creates the key used to sign bundles",
+	Args:  cobra.NoArgs,
+	RunE:  runBundleKeygen,
+}
+
+var bundleCreateCmd = &cobra.Command{
+	Use:   "create [FILE]",
+	Short: "Exports the images of the stack and the config to a signed bundle",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runBundleCreate,
+}
+
+var bundleInstallCmd = &cobra.Command{
+	Use:   "install FILE",
+	Short: "Loads the images and applies the config of a bundle",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runBundleInstall,
+}
+
+func runBundleKeygen(cmd *cobra.Command, args []string) error {
+	keyPath, pubPath, err := bundleKeyPaths()
+	if err != nil {
+		return err
+	}
+	if _, err := os.Stat(keyPath); err == nil {
+		return fmt.Errorf("%s already exists", keyPath)
+	}
+	key, err := bundle.GenerateKey()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(keyPath), 0700); err != nil {
+		return err
+	}
+	if err := bundle.WriteKeys(key, keyPath, pubPath); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Created %s", keyPath))
+	fmt.Fprintf(stdout, "Copy %s to %s on the drones to install bundles signed with it\n", pubPath, pubPath)
+	return nil
+}
+
+func runBundleCreate(cmd *cobra.Command, args []string) error {
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return errNoImage
+	}
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	keyPath := BundleKey
+	if keyPath == "" {
+		if keyPath, _, err = bundleKeyPaths(); err != nil {
+			return err
+		}
+	}
+	key, err := bundle.LoadPrivateKey(keyPath)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("no signing key at %s, create one with dmctl bundle keygen", keyPath)
+	} else if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+	ref := imageBase() + img + ":" + imageVersion()
+	digest, err := eng.ImageDigest(ctx, ref)
+	if err != nil {
+		return errors.Wrapf(err, "%s not available, run dmctl pull first", ref)
+	}
+	if pinned := viper.GetString("IMAGE_DIGEST"); pinned != "" && pinned != digest {
+		return fmt.Errorf("%s is %s but %s is pinned, run dmctl pull first", ref, shortDigest(digest), shortDigest(pinned))
+	}
+	// The other services of the stack are bundled too, the drone can't
+	// pull them either.
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	bundled := []bundle.Image{{Ref: ref, Digest: digest}}
+	refs := []string{ref}
+	for _, name := range s.names() {
+		if name == droneService {
+			continue
+		}
+		svcRef := s.Services[name].image()
+		svcDigest, err := eng.ImageDigest(ctx, svcRef)
+		if err != nil {
+			return errors.Wrapf(err, "%s of service %s not available, run dmctl pull first", svcRef, name)
+		}
+		bundled = append(bundled, bundle.Image{Ref: svcRef, Digest: svcDigest})
+		refs = append(refs, svcRef)
+	}
+
+	dir, err := ioutil.TempDir("", "dmctl-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Fprintf(stdout, "Exporting %s..\n", strings.Join(refs, ", "))
+	images := filepath.Join(dir, bundle.ImagesName)
+	if err := saveImages(ctx, refs, images); err != nil {
+		return err
+	}
+	config := filepath.Join(dir, bundle.ConfigName)
+	if IncludeSecrets {
+		warn("The bundle holds the drone verification key unencrypted, keep it safe")
+	}
+	if err := writeConfigSnapshot(config, IncludeSecrets); err != nil {
+		return err
+	}
+
+	path := fmt.Sprintf("%s-%s.bundle", img, imageVersion())
+	if len(args) > 0 {
+		path = args[0]
+	}
+	out, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	m := &bundle.Manifest{
+		Created: time.Now().UTC(),
+		Profile: activeProfile(),
+		Images:  bundled,
+	}
+	files := map[string]string{
+		bundle.ImagesName: images,
+		bundle.ConfigName: config,
+	}
+	if stack, err := stackPath(activeProfile()); err != nil {
+		return err
+	} else if _, err := os.Stat(stack); err == nil {
+		files[bundle.StackName] = stack
+	}
+	err = bundle.Write(out, m, files, key)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	good(fmt.Sprintf("Created %s", path))
+	return nil
+}
+
+func saveImages(ctx context.Context, refs []string, path string) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	err = eng.Save(ctx, refs, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// writeConfigSnapshot writes the bundled keys of the active config, and
+// PASSWORD if includeSecrets is set, to path.
+func writeConfigSnapshot(path string, includeSecrets bool) error {
+	keys := bundledKeys
+	if includeSecrets {
+		keys = append(keys[:len(keys):len(keys)], "PASSWORD")
+	}
+	settings := map[string]interface{}{}
+	for _, key := range keys {
+		if viper.IsSet(key) {
+			settings[strings.ToLower(key)] = viper.Get(key)
+		}
+	}
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+func runBundleInstall(cmd *cobra.Command, args []string) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	pub, err := bundlePublicKey()
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(args[0])
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	dir, err := ioutil.TempDir("", "dmctl-bundle")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+	m, err := bundle.Read(f, dir, pub)
+	if err != nil {
+		return errors.Wrapf(err, "invalid bundle %s", args[0])
+	}
+	fmt.Fprintf(stdout, "Installing bundle created %s from profile %s\n", m.Created.Local().Format(time.RFC822), m.Profile)
+	if StartAfterBundle {
+		// Refuse before the config is changed, like upgrade.
+		if err := checkArmed("install a bundle into " + containerName(droneService)); err != nil {
+			return err
+		}
+	}
+
+	ctx := context.Background()
+	images, err := os.Open(filepath.Join(dir, bundle.ImagesName))
+	if err != nil {
+		return err
+	}
+	err = eng.Load(ctx, images, stdout)
+	images.Close()
+	if err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(filepath.Join(dir, bundle.ConfigName))
+	if err != nil {
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return err
+	}
+	for k, v := range config {
+		// Bundles made by older versions also carried settings of the
+		// machine they were made on.
+		if bundledKey(k) {
+			viper.Set(k, v)
+		}
+	}
+	for _, image := range m.Images {
+		// Only the drone image is pinned.
+		if image.Digest != viper.GetString("IMAGE_DIGEST") {
+			continue
+		}
+		// Registry digests are lost when an image is saved by some runtimes,
+		// in which case the drone has to run the loaded tag.
+		if digest, err := eng.ImageDigest(ctx, image.Ref); err != nil || digest != image.Digest {
+			viper.Set("IMAGE_DIGEST", "")
+		}
+	}
+	if err := writeConfig(); err != nil {
+		return err
+	}
+	if err := installBundledStack(filepath.Join(dir, bundle.StackName)); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Installed %s", args[0]))
+
+	if StartAfterBundle {
+		Recreate = true
+		return runStartDrone(cmd, nil)
+	}
+	return nil
+}
+
+// installBundledStack makes the stack file extracted to path, if the bundle
+// had one, the stack of the active profile.
+func installBundledStack(path string) error {
+	raw, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	dst, err := stackPath(activeProfile())
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dst, raw, 0600)
+}
+
+func bundlePublicKey() (*ecdsa.PublicKey, error) {
+	if SkipVerify {
+		warn("Skipping bundle signature verification")
+		return nil, nil
+	}
+	path := BundlePubKey
+	if path == "" {
+		var err error
+		if _, path, err = bundleKeyPaths(); err != nil {
+			return nil, err
+		}
+	}
+	pub, err := bundle.LoadPublicKey(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("no public key at %s to verify the bundle with, pass --pubkey", path)
+	}
+	return pub, err
+}
+
+// bundleKeyPaths returns the default paths of the bundle signing key and its
+// public key.
+func bundleKeyPaths() (string, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", "", err
+	}
+	return filepath.Join(dir, "bundle.key"), filepath.Join(dir, "bundle.pub"), nil
+}
+
+func init() {
+	rootCmd.AddCommand(bundleCmd)
+	bundleCmd.AddCommand(bundleKeygenCmd, bundleCreateCmd, bundleInstallCmd)
+
+	bundleCreateCmd.Flags().StringVar(&BundleKey, "key", "", "Signing key (default ~/.dmc/bundle.key)")
+	bundleCreateCmd.Flags().BoolVar(&IncludeSecrets, "include-secrets", false, "Include the drone verification key, unencrypted")
+	bundleInstallCmd.Flags().StringVar(&BundlePubKey, "pubkey", "", "Public key to verify the bundle with (default ~/.dmc/bundle.pub)")
+	bundleInstallCmd.Flags().BoolVar(&SkipVerify, "insecure-skip-verify", false, "Install the bundle without verifying its signature")
+	bundleInstallCmd.Flags().BoolVar(&StartAfterBundle, "start", false, "Start the drone container once installed")
+}
@@ -0,0 +1,195 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/viper"
+)
+
+func TestBundle(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	fake.SetDigest(imageBase()+"dmc-rpi:1.4.2", "sha256:142")
+	ImageVersion = "1.4.2"
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("ID", "quad-3")
+	viper.Set("TOKEN", "secret")
+	viper.Set("PASSWORD", "verification-key")
+	viper.Set("RUNTIME", "podman")
+	viper.Set("LOG_ARCHIVE_DIR", "/mnt/logs")
+	path := createTestBundle(t)
+
+	// Install on a drone that has neither the image nor any config.
+	offline := engine.NewFake()
+	containerEngine = offline
+	viper.Reset()
+	StartAfterBundle = true
+	defer func() { StartAfterBundle = false }()
+	if err := runBundleInstall(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if !offline.Pulled(imageBase() + "dmc-rpi:1.4.2") {
+		t.Error("image not loaded")
+	}
+	if viper.GetString("ID") != "quad-3" || viper.GetString("IMAGE_DIGEST") != "sha256:142" {
+		t.Errorf("config not applied: %v", viper.AllSettings())
+	}
+	for _, key := range []string{"TOKEN", "PASSWORD", "RUNTIME", "LOG_ARCHIVE_DIR"} {
+		if viper.GetString(key) != "" {
+			t.Errorf("%s was bundled", key)
+		}
+	}
+	if c := offline.Get("drone"); c == nil || c.Image != imageBase()+"dmc-rpi@sha256:142" {
+		t.Errorf("drone not started from bundle: %+v", c)
+	}
+}
+
+func TestConfigSnapshot(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("ID", "quad-3")
+	viper.Set("PASSWORD", "verification-key")
+	viper.Set("API_CLIENT_CERT", "/etc/dmc/client.pem")
+
+	path := filepath.Join(os.Getenv("HOME"), "config.yaml")
+	for _, include := range []bool{false, true} {
+		if err := writeConfigSnapshot(path, include); err != nil {
+			t.Fatal(err)
+		}
+		raw, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		snapshot := string(raw)
+		if !strings.Contains(snapshot, "quad-3") || strings.Contains(snapshot, "client.pem") {
+			t.Errorf("unexpected snapshot %q", snapshot)
+		}
+		if strings.Contains(snapshot, "verification-key") != include {
+			t.Errorf("unexpected password with include secrets %v: %q", include, snapshot)
+		}
+	}
+}
+
+func createTestBundle(t *testing.T) string {
+	if err := runBundleKeygen(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(os.Getenv("HOME"), "drone.bundle")
+	if err := runBundleCreate(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestBundleInstallWhileArmed(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	fake.SetDigest(imageBase()+"dmc-rpi:1.4.2", "sha256:142")
+	ImageVersion = "1.4.2"
+	defer startArmed(t)()
+	old := fake.Get("drone")
+	viper.Set("MOCK_IMSI", "bundled")
+	path := createTestBundle(t)
+	viper.Set("MOCK_IMSI", "")
+	StartAfterBundle = true
+	defer func() { StartAfterBundle = false }()
+
+	if err := runBundleInstall(nil, []string{path}); !armedRefusal(err) {
+		t.Fatalf("expected install to be refused, got %v", err)
+	}
+	if viper.GetString("MOCK_IMSI") != "" {
+		t.Error("bundle config applied while armed")
+	}
+	if c := fake.Get("drone"); c == nil || c.ID != old.ID {
+		t.Fatal("drone replaced while armed")
+	}
+
+	if bundleInstallCmd.PersistentFlags().Lookup("force-while-armed") == nil {
+		t.Fatal("bundle install has no --force-while-armed flag")
+	}
+	ForceWhileArmed = true
+	oldConfirm := readConfirmation
+	defer func() { readConfirmation = oldConfirm }()
+	readConfirmation = func(label string) (string, error) { return "drone-1", nil }
+	if err := runBundleInstall(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("MOCK_IMSI") != "bundled" {
+		t.Error("bundle config not applied")
+	}
+	if c := fake.Get("drone"); c == nil || c.ID == old.ID {
+		t.Fatal("drone not replaced after override")
+	}
+}
+
+func TestBundleCreateWithoutImage(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runBundleKeygen(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(os.Getenv("HOME"), "drone.bundle")
+	if err := runBundleCreate(nil, []string{path}); err == nil {
+		t.Fatal("expected create to fail before pulling")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("bundle file left behind")
+	}
+}
+
+func TestBundleStack(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	writeStack(t, defaultProfile, testStack)
+	s, err := loadStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range s.names() {
+		fake.SetDigest(s.Services[name].image(), "sha256:"+name)
+	}
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBundleKeygen(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(os.Getenv("HOME"), "drone.bundle")
+	if err := runBundleCreate(nil, []string{path}); err == nil || !strings.Contains(err.Error(), "run dmctl pull") {
+		t.Fatalf("bundle created without the stack images: %v", err)
+	}
+	if err := runPull(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runBundleCreate(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+
+	offline := engine.NewFake()
+	containerEngine = offline
+	stack, _ := stackPath(defaultProfile)
+	os.Remove(stack)
+	StartAfterBundle = true
+	defer func() { StartAfterBundle = false }()
+	if err := runBundleInstall(nil, []string{path}); err != nil {
+		t.Fatal(err)
+	}
+	for _, ref := range []string{s.Services["mavros"].image(), s.Services["camera"].image()} {
+		if !offline.Pulled(ref) {
+			t.Errorf("%s not loaded", ref)
+		}
+	}
+	if c := offline.Get("mavros"); c == nil || !c.Running {
+		t.Error("stack not installed with the bundle")
+	}
+}
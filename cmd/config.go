@@ -16,18 +16,16 @@ limitations under the License.
 package cmd
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
 	"os"
 	"strings"
+	"text/tabwriter"
 
-	"github.com/dgrijalva/jwt-go"
 	"github.com/manifoldco/promptui"
-	homedir "github.com/mitchellh/go-homedir"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 	"gopkg.in/yaml.v2"
@@ -35,6 +33,18 @@ import (
 
 var (
 	httpClient = http.DefaultClient
+
+	droneID         string
+	verificationKey string
+	fcuURL          string
+	probeBeforeSave bool
+	obcKey          string
+	anyArch         bool
+	anipURI         string
+	mockIMSI        string
+	mockPosition    string
+	loginEmail      string
+	passwordStdin   bool
 )
 
 // configCmd represents the config command
@@ -54,8 +64,7 @@ var loginCmd = &cobra.Command{
 		if err != nil {
 			return err
 		}
-		viper.Set("TOKEN", token)
-		return writeConfig()
+		return saveToken(token)
 	},
 }
 
@@ -96,16 +105,14 @@ var clearCmd = &cobra.Command{
 }
 
 func runConfigureDrone(cmd *cobra.Command, args []string) error {
-	t, err := token()
-	if err != nil {
+	if err := requireFlags(cmd, "drone-id", "verification-key"); err != nil {
 		return err
 	}
-	drones, err := getDrones(t)
+	id, pass, url, err := droneConfig()
 	if err != nil {
 		return err
 	}
-	id, pass, url, err := droneConfig(drones)
-	if err != nil {
+	if err := checkFCULink(url); err != nil {
 		return err
 	}
 	viper.Set("ID", id)
@@ -114,63 +121,106 @@ func runConfigureDrone(cmd *cobra.Command, args []string) error {
 	return writeConfig()
 }
 
-var images = []string{
-	"dmc-rpi",
-	"dmc-x86",
-	"dmc-sim",
-	"dmc-sim",
-}
-
 func rungConfigureOBC(cmd *cobra.Command, args []string) error {
-	obcPrompt := &promptui.Select{
-		Label: "Select OBC type",
-		Items: []string{
-			"Raspberry Pi",
-			"Linux 64-bit",
-			"Simulated - Copter",
-			"Simulated - Plane",
-		},
-	}
-	idx, _, err := obcPrompt.Run()
+	boards, err := loadBoards()
 	if err != nil {
 		return err
 	}
-	viper.Set("IMAGE", images[idx])
-	if idx > 1 {
-		var simType string
-		if idx == 2 {
-			simType = "copter"
+	host := detectHost()
+	detected := detectBoard(boards, host)
+	var obc *board
+	switch {
+	case obcKey != "":
+		if obc = findBoard(boards, obcKey); obc == nil {
+			return fmt.Errorf("unknown OBC type %s, must be one of: %s", obcKey, strings.Join(obcKeys(), ", "))
+		}
+	case NonInteractive:
+		if detected == nil {
+			return requireFlags(cmd, "obc")
+		}
+		obc = detected
+		good(fmt.Sprintf("Detected %s", obc.Name))
+	default:
+		// The detected board is listed first, promptui can't move the
+		// cursor to it.
+		ordered := boards
+		names := make([]string, 0, len(boards))
+		if detected != nil {
+			ordered = []board{*detected}
+			names = append(names, detected.Name+" (detected)")
+			for _, b := range boards {
+				if b.Key != detected.Key {
+					ordered = append(ordered, b)
+					names = append(names, b.Name)
+				}
+			}
 		} else {
-			simType = "plane"
+			for _, b := range boards {
+				names = append(names, b.Name)
+			}
 		}
-		viper.Set("SIM_TYPE", simType)
+		obcPrompt := &promptui.Select{
+			Label: "Select OBC type",
+			Items: names,
+		}
+		idx, _, err := obcPrompt.Run()
+		if err != nil {
+			return err
+		}
+		obc = &ordered[idx]
+	}
+	if !obc.supports(host.Arch) {
+		msg := fmt.Sprintf("%s is built for %s but this host is %s", obc.Image, strings.Join(obc.Arches, ", "), host.Arch)
+		if !anyArch {
+			return fmt.Errorf("%s, pass --any-arch to select it anyway", msg)
+		}
+		warn(msg)
+	}
+	viper.Set("IMAGE", obc.Image)
+	if ImageVersion != "" {
+		viper.Set("IMAGE_VERSION", ImageVersion)
+	}
+	// The pinned digest belongs to the previous image or version.
+	viper.Set("IMAGE_DIGEST", "")
+	if obc.SimType != "" {
+		viper.Set("SIM_TYPE", obc.SimType)
 	}
 	return writeConfig()
 }
 
+func obcKeys() []string {
+	// An invalid custom catalog is reported when it is used.
+	boards, _ := loadBoards()
+	keys := make([]string, len(boards))
+	for i, b := range boards {
+		keys[i] = b.Key
+	}
+	return keys
+}
+
 func runConfigureANIP(cmd *cobra.Command, args []string) error {
-	uriPrompt := &promptui.Prompt{
-		Label: "ANIP uri",
+	if err := requireFlags(cmd, "anip-uri"); err != nil {
+		return err
 	}
-	uri, err := uriPrompt.Run()
+	uri, err := promptValue(anipURI, &promptui.Prompt{
+		Label: "ANIP uri",
+	})
 	if err != nil {
 		return err
 	}
 	viper.Set("DMC_ANIP_URI", uri)
 
-	imsiPrompt := &promptui.Prompt{
+	imsi, err := promptValue(mockIMSI, &promptui.Prompt{
 		Label: "Mock IMSI",
-	}
-	imsi, err := imsiPrompt.Run()
+	})
 	if err != nil {
 		return err
 	}
 	viper.Set("MOCK_IMSI", imsi)
 
-	posPrompt := &promptui.Prompt{
+	pos, err := promptValue(mockPosition, &promptui.Prompt{
 		Label: "Mock position (LAT,LNG,ALT)",
-	}
-	pos, err := posPrompt.Run()
+	})
 	if err != nil {
 		return err
 	}
@@ -180,14 +230,16 @@ func runConfigureANIP(cmd *cobra.Command, args []string) error {
 }
 
 func runConfigList(cmd *cobra.Command, args []string) error {
-	dir, err := homedir.Dir()
+	path, err := configFile()
 	if err != nil {
 		return err
 	}
-	path := dir + "/.dmc.yaml"
 	if raw, err := ioutil.ReadFile(path); err != nil {
 		if os.IsNotExist(err) {
-			bad("No config file created")
+			bad("No config file created for profile " + activeProfile())
+			if machineOutput() {
+				return printResult(map[string]interface{}{}, nil)
+			}
 			return nil
 		}
 		return err
@@ -199,131 +251,148 @@ func runConfigList(cmd *cobra.Command, args []string) error {
 		if _, ok := config["token"]; ok {
 			delete(config, "token")
 		}
+		if machineOutput() {
+			settings := map[string]interface{}{}
+			for k, v := range config {
+				settings[strings.ToUpper(k)] = v
+			}
+			return printResult(settings, nil)
+		}
 		filtered, err := yaml.Marshal(&config)
 		if err != nil {
 			return err
 		}
-		fmt.Print(string(filtered))
+		fmt.Fprint(stdout, string(filtered))
 		return nil
 	}
 }
 
 func runConfigClear(cmd *cobra.Command, args []string) error {
-	dir, err := homedir.Dir()
+	path, err := configFile()
 	if err != nil {
 		return err
 	}
-	path := dir + "/.dmc.yaml"
 	err = os.Remove(path)
 	if err != nil {
 		return err
 	}
+	if err := deleteSecrets(activeProfile()); err != nil {
+		return err
+	}
 	good("Config cleared!")
 	return nil
 }
 
-func checkValid(token string) bool {
-	parsed, _ := jwt.Parse(token, nil)
-	if parsed == nil {
-		return false
-	}
-	return parsed.Claims.Valid() == nil
-}
-
 func login() (string, error) {
-	fmt.Println("Enter dronemissioncontrol login details")
-	emailPrompt := &promptui.Prompt{
-		Label: "Email",
+	if NonInteractive && (loginEmail == "" || !passwordStdin) {
+		return "", errors.New("login required, use --email and --password-stdin in non-interactive mode")
+	}
+	if loginEmail == "" || !passwordStdin {
+		fmt.Printf("Enter login details for %s\n", apiURL())
 	}
-	email, err := emailPrompt.Run()
+	email, err := promptValue(loginEmail, &promptui.Prompt{
+		Label: "Email",
+	})
 	if err != nil {
 		return "", err
 	}
 
-	passPrompt := &promptui.Prompt{
-		Label: "Password",
-		Mask:  '*',
-	}
-	pass, err := passPrompt.Run()
+	pass, err := readPassword(passwordStdin)
 	if err != nil {
 		return "", err
 	}
 
-	jsonStr := fmt.Sprintf(`{"email":"%s","password":"%s"}`, email, pass)
-	req, err := http.NewRequest(
-		"POST",
-		"https://api.dronemissioncontrol.com/drone/gettoken",
-		bytes.NewReader([]byte(jsonStr)),
-	)
-	req.Header.Set("Content-Type", "application/json")
+	client, err := newAPIClient("")
 	if err != nil {
 		return "", err
 	}
-
-	resp, err := httpClient.Do(req)
+	token, err := client.Login(context.Background(), email, pass)
 	if err != nil {
 		return "", err
 	}
-	defer resp.Body.Close()
-	body, _ := ioutil.ReadAll(resp.Body)
-	token := strings.Trim(string(body), "\"\n")
-	token = strings.TrimRight(token, `"`)
-	if len(token) < 10 {
-		return "", errors.New("invalid email or password")
-	}
 	good("Login successful!")
 	return token, nil
 }
 
-func token() (string, error) {
-	if token := viper.GetString("TOKEN"); token != "" && checkValid(token) {
-		return token, nil
+func droneConfig() (id, password, url string, err error) {
+	id = droneID
+	if id == "" {
+		id, err = selectDrone()
+		if err != nil {
+			return
+		}
 	}
-	token, err := login()
+
+	password, err = promptValue(verificationKey, &promptui.Prompt{
+		Label: "Drone verification key",
+		Mask:  '*',
+	})
 	if err != nil {
-		return "", nil
-	}
-	viper.Set("TOKEN", token)
-	if err := writeConfig(); err != nil {
-		return "", err
+		return
 	}
-	return token, nil
-}
 
-type dronesResponse struct {
-	Drones []struct {
-		Name string `json:"name"`
-		ID   string `json:"id"`
-	} `json:"drones"`
+	url, err = promptValue(fcuURL, &promptui.Prompt{
+		Label:    "FCU url",
+		Default:  "udp://:14650@",
+		Validate: validateEndpoint,
+	})
+	if err == nil {
+		if verr := validateEndpoint(url); verr != nil {
+			err = fmt.Errorf("invalid FCU url: %s", verr)
+		}
+	}
+	return
 }
 
-func getDrones(token string) (*dronesResponse, error) {
-	req, err := http.NewRequest(
-		"GET",
-		"https://api.dronemissioncontrol.com/user/drones/",
-		nil,
-	)
-	req.Header.Set("Authorization", token)
+// checkFCULink probes the FCU before the drone config is saved, if asked
+// to with --probe or at the prompt. Saving without a heartbeat has to be
+// confirmed.
+func checkFCULink(url string) error {
+	probe := probeBeforeSave
+	if !probe && !NonInteractive {
+		var err error
+		if probe, err = confirm("Check the FCU link before saving", false); err != nil {
+			return err
+		}
+	}
+	if !probe {
+		return nil
+	}
+	result, err := probeFCU(context.Background(), url)
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	resp, err := httpClient.Do(req)
+	if result.Heartbeat {
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		printProbe(tw, result)
+		return tw.Flush()
+	}
+	bad(result.Error)
+	save, err := confirm("Save anyway", false)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
-
-	var drones dronesResponse
-	if err := json.NewDecoder(resp.Body).Decode(&drones); err != nil {
-		return nil, errors.New("bad response from server")
+	if !save {
+		return &exitError{Code: exitNoHeartbeat, Err: errors.New("no heartbeat from the FCU, drone config not saved")}
 	}
-	return &drones, nil
+	return nil
 }
 
-func droneConfig(drones *dronesResponse) (id, password, url string, err error) {
-	names := make([]string, len(drones.Drones))
-	for i, drone := range drones.Drones {
+func selectDrone() (string, error) {
+	t, err := token()
+	if err != nil {
+		return "", err
+	}
+	client, err := newAPIClient(t)
+	if err != nil {
+		return "", err
+	}
+	drones, err := client.Drones(context.Background())
+	if err != nil {
+		return "", err
+	}
+	names := make([]string, len(drones))
+	for i, drone := range drones {
 		names[i] = drone.Name
 	}
 	selectPrompt := &promptui.Select{
@@ -332,37 +401,48 @@ func droneConfig(drones *dronesResponse) (id, password, url string, err error) {
 	}
 	idx, _, err := selectPrompt.Run()
 	if err != nil {
-		return
+		return "", err
 	}
-	id = drones.Drones[idx].ID
+	return drones[idx].ID, nil
+}
 
-	passPrompt := &promptui.Prompt{
-		Label: "Drone verification key",
-		Mask:  '*',
+// promptValue returns value if it was given as a flag, and otherwise runs
+// prompt. In non-interactive mode the prompt default is used instead.
+func promptValue(value string, prompt *promptui.Prompt) (string, error) {
+	if value != "" {
+		return value, nil
 	}
-	password, err = passPrompt.Run()
-
-	urlPromt := &promptui.Prompt{
-		Label:   "FCU url",
-		Default: "udp://:14650@",
+	if NonInteractive {
+		return prompt.Default, nil
 	}
-	url, err = urlPromt.Run()
-
-	return
+	return prompt.Run()
 }
 
-func writeConfig() error {
-	err := viper.WriteConfig()
-	if err != nil {
-		if _, ok := err.(viper.ConfigFileNotFoundError); ok {
-			dir, err := homedir.Dir()
-			if err != nil {
-				return err
-			}
-			return viper.WriteConfigAs(dir + "/.dmc.yaml")
+// requireFlags fails in non-interactive mode if any of the named flags, which
+// would otherwise be prompted for, are not set.
+func requireFlags(cmd *cobra.Command, names ...string) error {
+	if !NonInteractive {
+		return nil
+	}
+	var missing []string
+	for _, name := range names {
+		if f := cmd.Flags().Lookup(name); f != nil && f.Value.String() == "" {
+			missing = append(missing, "--"+name)
 		}
 	}
-	return err
+	if len(missing) > 0 {
+		return fmt.Errorf("missing values in non-interactive mode: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// configFile returns the config file of the active profile, preferring the
+// file viper actually read.
+func configFile() (string, error) {
+	if used := viper.ConfigFileUsed(); used != "" {
+		return used, nil
+	}
+	return profilePath(activeProfile())
 }
 
 func envList(keys ...string) (list []string) {
@@ -374,7 +454,55 @@ func envList(keys ...string) (list []string) {
 	return
 }
 
+func addDroneFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&droneID, "drone-id", "", "Registered drone id, skips drone selection")
+	cmd.Flags().StringVar(&verificationKey, "verification-key", "", "Drone verification key")
+	cmd.Flags().StringVar(&fcuURL, "fcu-url", "", "FCU url (default \"udp://:14650@\")")
+	cmd.Flags().BoolVar(&probeBeforeSave, "probe", false, "Wait for a heartbeat on the FCU url before saving")
+}
+
+func addOBCFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&obcKey, "obc", "", "OBC type, one of: "+strings.Join(obcKeys(), ", ")+" (default detected)")
+	cmd.Flags().BoolVar(&anyArch, "any-arch", false, "Allow an OBC type that is not built for this host")
+	cmd.Flags().StringVar(&ImageVersion, "version", "", "Onboard software version (default latest)")
+}
+
+func addANIPFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&anipURI, "anip-uri", "", "ANIP uri")
+	cmd.Flags().StringVar(&mockIMSI, "mock-imsi", "", "Mock IMSI")
+	cmd.Flags().StringVar(&mockPosition, "mock-position", "", "Mock position (LAT,LNG,ALT)")
+}
+
+// readPassword reads a password from stdin, or prompts for it.
+func readPassword(fromStdin bool) (string, error) {
+	if fromStdin {
+		raw, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(raw), "\r\n"), nil
+	}
+	passPrompt := &promptui.Prompt{
+		Label: "Password",
+		Mask:  '*',
+	}
+	return passPrompt.Run()
+}
+
+func addLoginFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&loginEmail, "email", "", "Login email")
+	cmd.Flags().BoolVar(&passwordStdin, "password-stdin", false, "Read login password from stdin")
+}
+
 func init() {
 	rootCmd.AddCommand(configCmd, loginCmd)
 	configCmd.AddCommand(droneCmd, obcCmd, anipCmd, listCmd, clearCmd)
+
+	addDroneFlags(configCmd)
+	addLoginFlags(configCmd)
+	addDroneFlags(droneCmd)
+	addLoginFlags(droneCmd)
+	addOBCFlags(obcCmd)
+	addANIPFlags(anipCmd)
+	addLoginFlags(loginCmd)
 }
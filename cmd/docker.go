@@ -4,22 +4,18 @@ import (
 	"context"
 	"fmt"
 	"io"
-	"io/ioutil"
-	"os"
-	"strings"
-
-	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/client"
-	"github.com/docker/docker/pkg/jsonmessage"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/registry"
+	"github.com/pkg/errors"
+	"github.com/spf13/viper"
 )
 
 var (
-	dockerClient *client.Client
-)
+	Runtime string
 
-const (
-	imageBase = "docker.io/tobiasfriden/"
+	containerEngine engine.Engine
 )
 
 const dockerFailMessage = `
@@ -32,149 +28,219 @@ If docker is running, you might need to run this CLI as sudo. You can also add p
   sudo usermod -aG docker USER
 
 Note that these changes require logout to take affect.
+
+Run dmctl doctor to diagnose the problem.
 `
 
-func init() {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
-	if err != nil {
-		fmt.Print(dockerFailMessage)
-		os.Exit(1)
+// getEngine connects to the container engine the first time it is needed,
+// so that commands which don't run containers work without docker.
+func getEngine() (engine.Engine, error) {
+	if containerEngine != nil {
+		return containerEngine, nil
+	}
+	name := runtimeName()
+	if name == "" {
+		name = engine.Detect()
 	}
-	_, err = cli.ContainerList(context.Background(), types.ContainerListOptions{})
+	eng, err := engine.New(name)
 	if err != nil {
-		fmt.Print(dockerFailMessage)
-		os.Exit(1)
+		if name == engine.RuntimeDocker {
+			fmt.Fprint(stdout, dockerFailMessage)
+		}
+		return nil, errors.Wrap(err, "could not connect to "+name)
 	}
-	dockerClient = cli
+	containerEngine = eng
+	return containerEngine, nil
 }
 
-func containerLogs(name string) error {
-	ctx := context.Background()
-	containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{})
+// runtimeName returns the runtime selected by --runtime or the RUNTIME
+// setting, empty if it should be detected.
+func runtimeName() string {
+	if Runtime != "" {
+		return Runtime
+	}
+	return viper.GetString("RUNTIME")
+}
+
+func pullImage(name, ref string) error {
+	eng, err := getEngine()
 	if err != nil {
 		return err
 	}
-	var id string
-	for _, c := range containers {
-		for _, n := range c.Names {
-			if n == name {
-				id = c.ID
-				break
-			}
-		}
-	}
-	if id == "" {
-		bad(fmt.Sprintf("Container %s not found", strings.TrimPrefix(name, "/")))
-		return nil
+	fmt.Fprintf(stdout, "Pulling %s..\n", name)
+	var progress io.Writer
+	if Verbose {
+		progress = stdout
 	}
-	out, err := dockerClient.ContainerLogs(ctx, id, types.ContainerLogsOptions{
-		ShowStderr: true,
-		ShowStdout: true,
-		Follow:     Follow,
-	})
+	creds, err := registryCredentials(registry.ParseReference(ref).Registry)
 	if err != nil {
 		return err
 	}
-	_, err = io.Copy(os.Stdout, out)
-	return err
-}
-
-func pullImage(name, imageName string) error {
-	fmt.Printf("Pulling %s..\n", name)
-	out, err := dockerClient.ImagePull(context.Background(), imageBase+imageName, types.ImagePullOptions{})
-	if err != nil {
+	if err := eng.Pull(context.Background(), ref, creds, progress); err != nil {
 		return err
 	}
-	defer out.Close()
-	if Verbose {
-		err := jsonmessage.DisplayJSONMessagesStream(
-			out,
-			os.Stdout,
-			os.Stdout.Fd(),
-			true,
-			func(message jsonmessage.JSONMessage) {},
-		)
-		if err != nil {
-			return err
-		}
-	} else {
-		_, err = io.Copy(ioutil.Discard, out)
-		if err != nil {
-			return err
-		}
-	}
 	good("Done!")
-	return err
+	return nil
 }
 
-func startContainer(name, imageName string, config *container.Config, hostConfig *container.HostConfig) error {
-	running, err := containerRunning(imageName)
+func startContainer(name, image string, spec *engine.Spec) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	prepareSpec(name, image, spec)
+	c, err := findContainer(ctx, name)
 	if err != nil {
 		return err
 	}
-	if running {
-		fmt.Printf("Container %s is already running\n", name)
+	if c != nil {
+		fmt.Fprintf(stdout, "Container %s is already running\n", name)
 		if !Recreate {
+			if c.Labels[configLabel] != spec.Labels[configLabel] {
+				warn(fmt.Sprintf("%s doesn't match the current configuration, run dmctl start --recreate to apply it", name))
+			}
 			return nil
 		} else {
-			if err := stopContainer(name, imageName); err != nil {
+			if err := stopContainer(name, false); err != nil {
 				return err
 			}
 		}
+	} else if state, err := eng.Inspect(ctx, name); err == nil {
+		// A container that exited, e.g. after crashing or being stopped with
+		// --keep, still holds the name. One that dmctl didn't create is only
+		// replaced with --recreate.
+		if state.Labels[profileLabel] != activeProfile() {
+			if !Recreate {
+				return fmt.Errorf("container %s wasn't created by dmctl, run dmctl start --recreate to replace it", name)
+			}
+			if state.Running {
+				if err := checkArmed("stop " + name); err != nil {
+					return err
+				}
+				fmt.Fprintf(stdout, "Stopping %s..\n", name)
+				if err := eng.Stop(ctx, state.ID, stopTimeout()); err != nil {
+					return err
+				}
+			}
+		}
+		if err := removeContainer(ctx, state.ID, name); err != nil {
+			return err
+		}
 	}
-	fmt.Printf("Creating %s..\n", name)
-	config.Image = imageBase + imageName
-	ctx := context.Background()
-	resp, err := dockerClient.ContainerCreate(
-		ctx,
-		config,
-		hostConfig,
-		nil,
-		name,
-	)
+	fmt.Fprintf(stdout, "Creating %s..\n", name)
+	id, err := eng.Create(ctx, spec)
 	if err != nil {
 		return err
 	}
-	fmt.Printf("Starting %s..\n", name)
-	if err := dockerClient.ContainerStart(
-		ctx,
-		resp.ID,
-		types.ContainerStartOptions{},
-	); err != nil {
+	fmt.Fprintf(stdout, "Starting %s..\n", name)
+	if err := eng.Start(ctx, id); err != nil {
 		return err
 	}
 	good("Done!")
 	return nil
 }
 
-func containerRunning(imageName string) (bool, error) {
-	ctx := context.Background()
-	containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{})
+// prepareSpec fills in the parts of spec that are common to all containers
+// managed by dmctl.
+func prepareSpec(name, image string, spec *engine.Spec) {
+	spec.Name = name
+	spec.Image = image
+	if spec.Labels == nil {
+		spec.Labels = map[string]string{}
+	}
+	spec.Labels[profileLabel] = activeProfile()
+	spec.Labels[versionLabel] = Version
+	spec.Labels[configLabel] = configHash(image, spec)
+	spec.StopTimeout = stopTimeout()
+}
+
+// findContainer returns the running container with the given name that
+// dmctl created for the active profile, or nil if there is none. Containers
+// that only share the name or image are left alone.
+func findContainer(ctx context.Context, name string) (*engine.Container, error) {
+	eng, err := getEngine()
 	if err != nil {
-		return false, err
+		return nil, err
+	}
+	containers, err := eng.List(ctx)
+	if err != nil {
+		return nil, err
 	}
 	for _, c := range containers {
-		if c.Image == imageBase+imageName {
-			return true, nil
+		if c.Name == name && c.Labels[profileLabel] == activeProfile() {
+			return &c, nil
 		}
 	}
-	return false, nil
+	return nil, nil
+}
+
+func containerRunning(name string) (bool, error) {
+	c, err := findContainer(context.Background(), name)
+	if err != nil {
+		return false, err
+	}
+	return c != nil, nil
 }
 
-func stopContainer(name, imageName string) error {
-	fmt.Printf("Stopping %s..\n", name)
+// stopContainer stops name, giving it the stop timeout to exit after
+// SIGTERM, and removes it unless keep is set.
+func stopContainer(name string, keep bool) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "Stopping %s..\n", name)
 	ctx := context.Background()
-	containers, err := dockerClient.ContainerList(ctx, types.ContainerListOptions{})
+	c, err := findContainer(ctx, name)
 	if err != nil {
 		return err
 	}
-	for _, c := range containers {
-		if c.Image == imageBase+imageName {
-			if err := dockerClient.ContainerRemove(ctx, c.ID, types.ContainerRemoveOptions{Force: true}); err != nil {
-				return err
-			}
+	if c != nil {
+		if err := checkArmed("stop " + c.Name); err != nil {
+			return err
+		}
+		if err := eng.Stop(ctx, c.ID, stopTimeout()); err != nil {
+			return err
+		}
+		if keep {
+			good(fmt.Sprintf("Stopped, %s is kept until dmctl rm", c.Name))
+			return nil
+		}
+		if err := removeContainer(ctx, c.ID, c.Name); err != nil {
+			return err
 		}
 	}
 	good("Done!")
 	return nil
 }
+
+// removeContainer removes a stopped container, archiving its output first.
+func removeContainer(ctx context.Context, id, name string) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	state, err := eng.Inspect(ctx, id)
+	if err != nil {
+		return err
+	}
+	archiveBeforeRemove(ctx, &engine.Container{ID: state.ID, Name: name, Image: state.Image, Created: state.Created})
+	return eng.Remove(ctx, id, true)
+}
+
+// stopTimeout returns how long containers get to exit after SIGTERM before
+// they are killed.
+func stopTimeout() time.Duration {
+	if StopTimeout > 0 {
+		return StopTimeout
+	}
+	if d, err := time.ParseDuration(viper.GetString("STOP_TIMEOUT")); err == nil && d > 0 {
+		return d
+	}
+	return defaultStopTimeout
+}
+
+func keepStopped() bool {
+	return KeepStopped || viper.GetBool("KEEP_STOPPED")
+}
@@ -0,0 +1,574 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/registry"
+	"github.com/airpelago/dmctl/secrets"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/spf13/viper"
+)
+
+// setupFake runs commands against an in-memory engine, with config written
+// to a temporary home directory.
+func setupFake(t *testing.T) (*engine.Fake, *bytes.Buffer, func()) {
+	home, err := ioutil.TempDir("", "dmctl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHome := os.Getenv("HOME")
+	os.Setenv("HOME", home)
+	homedir.DisableCache = true
+
+	fake := engine.NewFake()
+	out := &bytes.Buffer{}
+	containerEngine = fake
+	secretStore = secrets.NewFileStore(filepath.Join(home, "secrets"), filepath.Join(home, "secrets.key"))
+	secretStoreKind = "file"
+	stdout = out
+	Output = outputTable
+	Profile = defaultProfile
+	Recreate = false
+	viper.Reset()
+	viper.Set("IMAGE", "dmc-rpi")
+	// There is no flight controller to read the armed state from.
+	viper.Set("ARMED_INTERLOCK", "off")
+	return fake, out, func() {
+		containerEngine = nil
+		stdout = os.Stdout
+		stderr = os.Stderr
+		Output = ""
+		Profile = ""
+		Recreate = false
+		StopTimeout = 0
+		KeepStopped = false
+		RmForce = false
+		RmForeign = false
+		ForceWhileArmed = false
+		armedOverridden = false
+		ImageVersion = ""
+		APIURL = ""
+		apiClient = nil
+		secretStore = nil
+		secretStoreKind = ""
+		secretsErr = nil
+		viper.Reset()
+		os.Setenv("HOME", oldHome)
+		os.RemoveAll(home)
+	}
+}
+
+func TestStartDrone(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Pulled(imageBase() + "dmc-rpi:latest") {
+		t.Fatal("image not pulled")
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone")
+	if c == nil || !c.Running {
+		t.Fatal("drone container not running")
+	}
+	digest := viper.GetString("IMAGE_DIGEST")
+	if digest == "" {
+		t.Fatal("digest not pinned")
+	}
+	if c.Image != imageBase()+"dmc-rpi@"+digest {
+		t.Errorf("unexpected image %s", c.Image)
+	}
+	if c.Labels[profileLabel] != defaultProfile {
+		t.Errorf("unexpected profile label %q", c.Labels[profileLabel])
+	}
+	if c.Spec.RestartPolicy != "unless-stopped" || c.Spec.NetworkMode != "host" || !c.Spec.Privileged {
+		t.Errorf("unexpected spec %+v", c.Spec)
+	}
+}
+
+func TestStartDroneWithoutImage(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runStartDrone(nil, nil); err == nil {
+		t.Fatal("expected start to fail before pulling")
+	}
+}
+
+func TestStartAlreadyRunning(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := fake.Get("drone").ID
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone").ID != id {
+		t.Error("container was recreated without --recreate")
+	}
+	if !strings.Contains(out.String(), "already running") {
+		t.Errorf("missing already running message in %q", out.String())
+	}
+}
+
+func TestStartRecreate(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	id := fake.Get("drone").ID
+	Recreate = true
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone")
+	if c == nil || !c.Running {
+		t.Fatal("drone container not running")
+	}
+	if c.ID == id {
+		t.Error("container was not recreated")
+	}
+}
+
+func TestStartProfile(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	Profile = "quad-3"
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone-quad-3")
+	if c == nil || !c.Running {
+		t.Fatal("profile container not running")
+	}
+	if c.Labels[profileLabel] != "quad-3" {
+		t.Errorf("unexpected profile label %q", c.Labels[profileLabel])
+	}
+	if fake.Get("drone") == nil {
+		t.Error("default profile container was removed")
+	}
+}
+
+func TestStopDrone(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Error("drone container not removed")
+	}
+}
+
+func TestStopNotRunning(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "drone not running") {
+		t.Errorf("missing not running message in %q", out.String())
+	}
+}
+
+func TestPs(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	err := runPs(nil, nil)
+	if exit, ok := err.(*exitError); !ok || exit.Code != exitNotRunning {
+		t.Fatalf("expected not running exit code, got %v", err)
+	}
+	if !strings.Contains(out.String(), "No containers running") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runPs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Running for") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestLogs(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runLogs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "Container drone not found") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := fake.Pull(context.Background(), imageBase()+"dmc-rpi:latest", nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "connected to FCU\n")
+	out.Reset()
+	if err := runLogs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "connected to FCU\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestPullVersion(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+
+	fake.SetDigest(imageBase()+"dmc-rpi:1.4.2", "sha256:142")
+	ImageVersion = "1.4.2"
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("IMAGE_VERSION") != "1.4.2" || viper.GetString("IMAGE_DIGEST") != "sha256:142" {
+		t.Fatalf("version not pinned: %v", viper.AllSettings())
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("drone"); c.Image != imageBase()+"dmc-rpi@sha256:142" {
+		t.Errorf("unexpected image %s", c.Image)
+	}
+
+	// The tag moving in the registry doesn't change what start runs until
+	// the next pull.
+	fake.SetDigest(imageBase()+"dmc-rpi:1.4.2", "sha256:142b")
+	ImageVersion = ""
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("IMAGE_DIGEST") != "sha256:142b" {
+		t.Errorf("digest not updated after pull")
+	}
+	if !strings.Contains(out.String(), "Updated drone from 142 to 142b") {
+		t.Errorf("missing update message in %q", out.String())
+	}
+}
+
+func TestPullPrivateRegistry(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	defer os.Setenv("DOCKER_CONFIG", os.Getenv("DOCKER_CONFIG"))
+	os.Unsetenv("DOCKER_CONFIG")
+
+	viper.Set("REGISTRY", "mirror.local:5000")
+	viper.Set("NAMESPACE", "dmc")
+	path, err := registryAuthPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := registry.LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := &registry.Credentials{Username: "drone", Password: "hunter2"}
+	auth.Set("mirror.local:5000", creds)
+	if err := auth.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ref := "mirror.local:5000/dmc/dmc-rpi:latest"
+	if !fake.Pulled(ref) {
+		t.Fatal("image not pulled from mirror")
+	}
+	if got := fake.PulledWith(ref); got == nil || *got != *creds {
+		t.Errorf("pulled with %+v", got)
+	}
+}
+
+func TestUnlabelledContainers(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	// Containers started by hand from the drone image aren't dmctl's.
+	ctx := context.Background()
+	ref := "docker.io/tobiasfriden/dmc-rpi:latest"
+	fake.Pull(ctx, ref, nil, nil)
+	for _, name := range []string{"happy_drone", "drone"} {
+		id, err := fake.Create(ctx, &engine.Spec{Name: name, Image: ref})
+		if err != nil {
+			t.Fatal(err)
+		}
+		fake.Start(ctx, id)
+	}
+
+	if running, err := containerRunning("drone"); err != nil || running {
+		t.Fatalf("unlabelled container found: %v", err)
+	}
+	if err := stopContainer("drone", false); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("happy_drone"); c == nil || !c.Running {
+		t.Error("unlabelled container stopped")
+	}
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err == nil {
+		t.Fatal("expected start to refuse replacing an unlabelled container")
+	}
+	if c := fake.Get("drone"); c == nil || c.Labels[profileLabel] != "" {
+		t.Fatal("unlabelled container replaced without --recreate")
+	}
+	Recreate = true
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running || c.Labels[profileLabel] != defaultProfile {
+		t.Errorf("unlabelled container not replaced: %+v", c)
+	}
+	if c := fake.Get("happy_drone"); c == nil || !c.Running {
+		t.Error("unrelated container stopped")
+	}
+}
+
+func TestConfigDrift(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	Version = "1.2.3"
+	defer func() { Version = "dev" }()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone")
+	if c.Labels[versionLabel] != "1.2.3" || c.Labels[configLabel] == "" {
+		t.Fatalf("unexpected labels %v", c.Labels)
+	}
+
+	ps := func() containerStatus {
+		out.Reset()
+		Output = outputJSON
+		defer func() { Output = outputTable }()
+		if err := runPs(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		var result psResult
+		if err := json.Unmarshal(out.Bytes(), &result); err != nil || len(result.Containers) != 1 {
+			t.Fatalf("unexpected ps output %q: %v", out.String(), err)
+		}
+		return result.Containers[0]
+	}
+	if got := ps(); got.Drift != "" || got.DmctlVersion != "1.2.3" {
+		t.Fatalf("unexpected drift %+v", got)
+	}
+	// Flags that aren't configuration don't count as drift.
+	NoRestart = true
+	StopTimeout = time.Minute
+	got := ps()
+	NoRestart = false
+	if got.Drift != "" {
+		t.Fatalf("unexpected drift %+v", got)
+	}
+
+	viper.Set("GCS_URL", "udp://@127.0.0.1:14550")
+	if got := ps(); !strings.Contains(got.Drift, "configuration changed since dmctl 1.2.3") {
+		t.Fatalf("drift not detected %+v", got)
+	}
+	out.Reset()
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone").ID != c.ID {
+		t.Fatal("drone recreated without --recreate")
+	}
+	Recreate = true
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone").ID == c.ID {
+		t.Fatal("drone not recreated")
+	}
+	if got := ps(); got.Drift != "" {
+		t.Fatalf("drift after recreate %+v", got)
+	}
+}
+
+func TestStopKeepAndRm(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("STOP_TIMEOUT", "30s")
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := fake.Get("drone").Spec.StopTimeout; got != 30*time.Second {
+		t.Errorf("unexpected spec stop timeout %s", got)
+	}
+	KeepStopped = true
+	StopTimeout = 5 * time.Second
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone")
+	if c == nil || c.Running {
+		t.Fatal("stopped container not kept")
+	}
+	if c.StopTimeout != 5*time.Second {
+		t.Errorf("stopped with timeout %s", c.StopTimeout)
+	}
+	if !strings.Contains(out.String(), "kept until dmctl rm") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+
+	if err := runRm(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Error("container not removed")
+	}
+	out.Reset()
+	if err := runRm(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(out.String(), "No containers to remove") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestRmRunning(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRm(nil, []string{"drone"}); err == nil || !strings.Contains(err.Error(), "--force") {
+		t.Fatalf("expected running error, got %v", err)
+	}
+	if fake.Get("drone") == nil {
+		t.Fatal("running container removed")
+	}
+	RmForce = true
+	if err := runRm(nil, []string{"drone"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Error("container not removed")
+	}
+	if err := runRm(nil, []string{"camera"}); err == nil {
+		t.Error("expected unknown service error")
+	}
+}
+
+func TestRmUnlabelled(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+
+	ctx := context.Background()
+	ref := "docker.io/someone/other:latest"
+	fake.Pull(ctx, ref, nil, nil)
+	id, err := fake.Create(ctx, &engine.Spec{Name: "drone", Image: ref})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Start(ctx, id)
+
+	RmForce = true
+	if err := runRm(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRm(nil, []string{"drone"}); err == nil || !strings.Contains(err.Error(), "--force-foreign") {
+		t.Fatalf("expected foreign container error, got %v", err)
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running {
+		t.Fatal("unlabelled container removed")
+	}
+	RmForeign = true
+	if err := runRm(nil, []string{"drone"}); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Error("unlabelled container not removed with --force-foreign")
+	}
+}
+
+func TestRestart(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("KEEP_STOPPED", "true")
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	before := fake.Get("drone").ID
+	viper.Set("ID", "drone-2")
+	if err := runRestart(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	c := fake.Get("drone")
+	if c == nil || !c.Running || c.ID == before {
+		t.Fatalf("drone not restarted: %+v", c)
+	}
+	if !strings.Contains(strings.Join(c.Spec.Env, " "), "ID=drone-2") {
+		t.Errorf("configuration not applied: %v", c.Spec.Env)
+	}
+}
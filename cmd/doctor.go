@@ -0,0 +1,414 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/mavlink"
+	"github.com/airpelago/dmctl/registry"
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	checkOK   = "ok"
+	checkWarn = "warn"
+	checkFail = "fail"
+)
+
+// minFreeSpace is roughly what pulling a new onboard software image takes.
+const minFreeSpace = 2 << 30
+
+// maxClockSkew is how far the clock may be off before logins start failing
+// token validation.
+const maxClockSkew = 30 * time.Second
+
+var doctorTimeout = 5 * time.Second
+
+// doctorCmd represents the doctor command
+var doctorCmd = &cobra.Command{
+	Use:   "doctor",
+	Short: "Check that this host can run the onboard software",
+	Long: `Check that this host can run the onboard software.
+
+Checks the container runtime, disk space, architecture, clock, network
+access to the backend and registry, the FCU link and the configuration,
+and prints how to fix each problem found. Exits with 1 if a check fails.`,
+	Args: cobra.NoArgs,
+	RunE: runDoctor,
+}
+
+// doctorCheck is one entry of dmctl doctor --output json|yaml.
+type doctorCheck struct {
+	Name    string `json:"name" yaml:"name"`
+	Status  string `json:"status" yaml:"status"`
+	Message string `json:"message" yaml:"message"`
+	Fix     string `json:"fix,omitempty" yaml:"fix,omitempty"`
+}
+
+type doctorResult struct {
+	Checks []doctorCheck `json:"checks" yaml:"checks"`
+}
+
+func runDoctor(cmd *cobra.Command, args []string) error {
+	var checks []doctorCheck
+	eng, runtimeChecks := doctorRuntime()
+	checks = append(checks, runtimeChecks...)
+	checks = append(checks, doctorDisk())
+	checks = append(checks, doctorArch())
+	checks = append(checks, doctorAPI()...)
+	checks = append(checks, doctorRegistry())
+	checks = append(checks, doctorFCU(eng)...)
+	checks = append(checks, doctorConfig()...)
+
+	result := doctorResult{Checks: checks}
+	err := printResult(result, func(w io.Writer) {
+		for _, c := range checks {
+			icon := promptui.IconGood
+			switch c.Status {
+			case checkWarn:
+				icon = promptui.IconWarn
+			case checkFail:
+				icon = promptui.IconBad
+			}
+			fmt.Fprintf(w, "%s %s\t%s\n", icon, c.Name, c.Message)
+			if c.Fix != "" {
+				fmt.Fprintf(w, "  \t%s\n", strings.Replace(c.Fix, "\n", "\n  \t", -1))
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	for _, c := range checks {
+		if c.Status == checkFail {
+			return &exitError{Code: 1}
+		}
+	}
+	return nil
+}
+
+func checkPassed(name, message string) doctorCheck {
+	return doctorCheck{Name: name, Status: checkOK, Message: message}
+}
+
+func checkFailed(name, message, fix string) doctorCheck {
+	return doctorCheck{Name: name, Status: checkFail, Message: message, Fix: fix}
+}
+
+// doctorRuntime connects to the container runtime, returning nil if it
+// can't.
+func doctorRuntime() (engine.Engine, []doctorCheck) {
+	name := runtimeName()
+	if name == "" {
+		name = engine.Detect()
+	}
+	eng := containerEngine
+	if eng == nil {
+		if name == engine.RuntimeDocker && os.Getenv("DOCKER_HOST") == "" {
+			if check, failed := doctorDockerSocket(); failed {
+				return nil, []doctorCheck{check}
+			}
+		}
+		var err error
+		if eng, err = engine.New(name); err != nil {
+			fix := "Install it, or select another runtime with dmctl config set RUNTIME docker|podman|containerd"
+			if name == engine.RuntimeDocker {
+				fix = "Install docker by following https://docs.docker.com/install/ and start it with sudo systemctl enable --now docker"
+			}
+			return nil, []doctorCheck{checkFailed("runtime", fmt.Sprintf("could not connect to %s: %s", name, err), fix)}
+		}
+		containerEngine = eng
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	version, err := eng.Version(ctx)
+	if err != nil {
+		return eng, []doctorCheck{checkFailed("runtime", fmt.Sprintf("%s is not responding: %s", name, err), "Restart it with sudo systemctl restart "+name)}
+	}
+	return eng, []doctorCheck{checkPassed("runtime", fmt.Sprintf("%s %s", name, version))}
+}
+
+// doctorDockerSocket reports a missing socket or one the user may not use,
+// the most common reasons for dockerFailMessage.
+func doctorDockerSocket() (doctorCheck, bool) {
+	const socket = "/var/run/docker.sock"
+	if _, err := os.Stat(socket); os.IsNotExist(err) {
+		return checkFailed("runtime", "docker is not running, "+socket+" does not exist",
+			"Install docker by following https://docs.docker.com/install/ and start it with sudo systemctl enable --now docker"), true
+	}
+	conn, err := net.Dial("unix", socket)
+	if err != nil {
+		if isPermission(err) {
+			return checkFailed("runtime", "permission denied on "+socket,
+				"Run dmctl as root, or add yourself to the docker group and log in again:\nsudo usermod -aG docker $USER"), true
+		}
+		return checkFailed("runtime", "could not connect to "+socket+": "+err.Error(), "Restart docker with sudo systemctl restart docker"), true
+	}
+	conn.Close()
+	return doctorCheck{}, false
+}
+
+func isPermission(err error) bool {
+	if op, ok := err.(*net.OpError); ok {
+		err = op.Err
+	}
+	if sys, ok := err.(*os.SyscallError); ok {
+		err = sys.Err
+	}
+	return os.IsPermission(err)
+}
+
+func doctorDisk() doctorCheck {
+	dir := map[string]string{
+		engine.RuntimeDocker:     "/var/lib/docker",
+		engine.RuntimePodman:     "/var/lib/containers",
+		engine.RuntimeContainerd: "/var/lib/containerd",
+	}[runtimeName()]
+	if dir == "" {
+		dir = "/var/lib/docker"
+	}
+	free, err := freeSpace(dir)
+	if err != nil {
+		dir = "/"
+		if free, err = freeSpace(dir); err != nil {
+			return doctorCheck{Name: "disk", Status: checkWarn, Message: "could not check free space: " + err.Error()}
+		}
+	}
+	message := fmt.Sprintf("%s free on %s", formatBytes(free), dir)
+	if free < minFreeSpace {
+		return checkFailed("disk", message+", images need about "+formatBytes(minFreeSpace),
+			"Remove unused images with docker image prune -a, or free up space on "+dir)
+	}
+	return checkPassed("disk", message)
+}
+
+func doctorArch() doctorCheck {
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return doctorCheck{Name: "architecture", Status: checkWarn, Message: runtime.GOARCH + ", no image configured"}
+	}
+	boards, err := loadBoards()
+	if err != nil {
+		return checkFailed("architecture", err.Error(), "Fix or remove ~/.dmc/boards.yaml")
+	}
+	host := detectHost()
+	var arches []string
+	for _, b := range boards {
+		if b.Image != img {
+			continue
+		}
+		if b.supports(host.Arch) {
+			return checkPassed("architecture", fmt.Sprintf("%s runs on %s", img, host.Arch))
+		}
+		arches = append(arches, b.Arches...)
+	}
+	if arches == nil {
+		return doctorCheck{Name: "architecture", Status: checkWarn, Message: fmt.Sprintf("unknown image %s, could not check it runs on %s", img, host.Arch)}
+	}
+	fix := "Select the OBC type matching this host with dmctl config obc"
+	if b := detectBoard(boards, host); b != nil {
+		fix = fmt.Sprintf("This looks like a %s, select it with dmctl config obc --obc %s", b.Name, b.Key)
+	}
+	return checkFailed("architecture", fmt.Sprintf("%s is built for %s but this host is %s", img, strings.Join(arches, ", "), host.Arch), fix)
+}
+
+// doctorAPI checks that the backend API resolves and answers over HTTPS, and
+// compares the clock with the Date the API responds with.
+func doctorAPI() []doctorCheck {
+	u, err := url.Parse(apiURL())
+	if err != nil {
+		return []doctorCheck{checkFailed("api", err.Error(), "Fix API_URL with dmctl config set API_URL URL")}
+	}
+	if check, resolved := doctorResolve("api", u.Hostname()); !resolved {
+		return []doctorCheck{check}
+	}
+	client, err := apiHTTPClient()
+	if err != nil {
+		return []doctorCheck{checkFailed("api", err.Error(), "Check API_CA_CERT, API_CLIENT_CERT and API_CLIENT_KEY with dmctl config list")}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return []doctorCheck{checkFailed("api", err.Error(), "Fix API_URL with dmctl config set API_URL URL")}
+	}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return []doctorCheck{checkFailed("api", err.Error(), "Check that outgoing HTTPS is allowed by the network and any firewall or proxy (HTTPS_PROXY)")}
+	}
+	resp.Body.Close()
+	latency := time.Since(start)
+	checks := []doctorCheck{checkPassed("api", fmt.Sprintf("%s reachable in %dms", u.Host, latency/time.Millisecond))}
+
+	date, err := http.ParseTime(resp.Header.Get("Date"))
+	if err != nil {
+		return append(checks, doctorCheck{Name: "clock", Status: checkWarn, Message: "could not compare the clock, the API sent no Date"})
+	}
+	// The Date header has second precision and was sent during the
+	// request.
+	skew := start.Add(latency / 2).Sub(date).Truncate(time.Second)
+	if skew < -maxClockSkew || skew > maxClockSkew {
+		return append(checks, checkFailed("clock", fmt.Sprintf("clock is off by %s, logins will be rejected", skew),
+			"Enable time synchronization with sudo timedatectl set-ntp true"))
+	}
+	return append(checks, checkPassed("clock", fmt.Sprintf("off by %s", skew)))
+}
+
+func doctorRegistry() doctorCheck {
+	host := registryHost()
+	lookup := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		lookup = h
+	}
+	if check, resolved := doctorResolve("registry", lookup); !resolved {
+		return check
+	}
+	creds, err := registryCredentials(host)
+	if err != nil {
+		return checkFailed("registry", err.Error(), "Log in again with dmctl registry login "+host)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), doctorTimeout)
+	defer cancel()
+	client := &registry.Client{HTTPClient: httpClient, Credentials: creds}
+	if err := client.Ping(ctx, host); err != nil {
+		return checkFailed("registry", err.Error(), "Check that outgoing HTTPS is allowed, and the credentials with dmctl registry login "+host)
+	}
+	return checkPassed("registry", host+" reachable")
+}
+
+func doctorResolve(name, host string) (doctorCheck, bool) {
+	if _, err := net.LookupHost(host); err != nil {
+		return checkFailed(name, "could not resolve "+host+": "+err.Error(),
+			"Check the network connection and the DNS servers in /etc/resolv.conf"), false
+	}
+	return doctorCheck{}, true
+}
+
+// doctorFCU checks that the FCU endpoint can be opened. It is held by the
+// drone container, or the MAVLink router, while it runs, which is fine.
+func doctorFCU(eng engine.Engine) []doctorCheck {
+	if isSimImage() {
+		return nil
+	}
+	fcuURL := viper.GetString("FCU_URL")
+	if fcuURL == "" {
+		// Reported by doctorConfig.
+		return nil
+	}
+	ep, err := mavlink.ParseURL(fcuURL)
+	if err != nil {
+		return []doctorCheck{checkFailed("fcu", err.Error(), "Fix FCU_URL with dmctl config set FCU_URL URL")}
+	}
+	running := false
+	if eng != nil {
+		running, _ = containerRunning(containerName("drone"))
+	}
+
+	switch ep.Scheme {
+	case "serial", "serial-hwfc":
+		if _, err := os.Stat(ep.Device); os.IsNotExist(err) {
+			return []doctorCheck{checkFailed("fcu", ep.Device+" does not exist",
+				"Check the FCU cable, and list serial devices with ls /dev/serial/by-id")}
+		}
+		f, err := os.OpenFile(ep.Device, os.O_RDWR|syscall.O_NONBLOCK, 0)
+		if err != nil {
+			if os.IsPermission(err) {
+				return []doctorCheck{checkFailed("fcu", "permission denied on "+ep.Device,
+					"Run dmctl as root, or add yourself to the dialout group and log in again:\nsudo usermod -aG dialout $USER")}
+			}
+			return []doctorCheck{checkFailed("fcu", err.Error(), "Check the FCU cable and device "+ep.Device)}
+		}
+		f.Close()
+		return []doctorCheck{checkPassed("fcu", fmt.Sprintf("%s present at %d baud", ep.Device, ep.Baud))}
+	case "udp", "udp-b", "tcp-l":
+		// Only bind, opening a tcp-l endpoint would wait for the FCU to
+		// connect.
+		var l io.Closer
+		var err error
+		if ep.Scheme == "tcp-l" {
+			l, err = net.Listen("tcp", ep.Bind)
+		} else {
+			l, err = net.ListenPacket("udp", ep.Bind)
+		}
+		if err == nil {
+			l.Close()
+			return []doctorCheck{checkPassed("fcu", ep.Bind+" is free")}
+		}
+		if running && !routerEnabled() {
+			return []doctorCheck{checkPassed("fcu", ep.Bind+" is held by the drone container")}
+		}
+		if routerEnabled() && routerRunning() {
+			return []doctorCheck{checkPassed("fcu", ep.Bind+" is held by the MAVLink router")}
+		}
+		_, port, _ := net.SplitHostPort(ep.Bind)
+		return []doctorCheck{checkFailed("fcu", fmt.Sprintf("could not bind %s: %s", ep.Bind, err),
+			fmt.Sprintf("Find the process using it with sudo ss -lpn 'sport = :%s' and stop it, or change FCU_URL", port))}
+	}
+	return []doctorCheck{{Name: "fcu", Status: checkWarn, Message: "not checked, connects to " + ep.Remote}}
+}
+
+// doctorConfig reports missing settings the drone container needs and
+// settings that no longer validate.
+func doctorConfig() []doctorCheck {
+	required := []string{"IMAGE", "ID", "PASSWORD", "FCU_URL"}
+	if isSimImage() {
+		required = []string{"IMAGE", "ID", "PASSWORD", "SIM_TYPE", "MOCK_POSITION"}
+	}
+	var missing []string
+	for _, key := range required {
+		if viper.GetString(key) == "" {
+			missing = append(missing, key)
+		}
+	}
+	var checks []doctorCheck
+	if len(missing) > 0 {
+		checks = append(checks, checkFailed("config", "missing "+strings.Join(missing, ", "),
+			"Run dmctl init, or set them with dmctl config set KEY VALUE"))
+	}
+	for _, key := range configKeys {
+		value := viper.GetString(key.Name)
+		if key.Validate == nil || value == "" {
+			continue
+		}
+		if err := key.Validate(value); err != nil {
+			checks = append(checks, checkFailed("config", fmt.Sprintf("invalid %s: %s", key.Name, err),
+				fmt.Sprintf("Fix it with dmctl config set %s VALUE", key.Name)))
+		}
+	}
+	if len(checks) == 0 {
+		checks = append(checks, checkPassed("config", "profile "+activeProfile()+" is complete"))
+	}
+	return checks
+}
+
+func init() {
+	rootCmd.AddCommand(doctorCmd)
+}
@@ -0,0 +1,117 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func runDoctorJSON(t *testing.T, out *bytes.Buffer) (map[string]doctorCheck, error) {
+	out.Reset()
+	err := runDoctor(nil, nil)
+	var result doctorResult
+	if jerr := json.Unmarshal(out.Bytes(), &result); jerr != nil {
+		t.Fatalf("invalid json %q: %v", out.String(), jerr)
+	}
+	checks := map[string]doctorCheck{}
+	for _, c := range result.Checks {
+		// Keep the first failure of checks reported more than once.
+		if prev, ok := checks[c.Name]; !ok || prev.Status != checkFail {
+			checks[c.Name] = c
+		}
+	}
+	return checks, err
+}
+
+func TestDoctor(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+	defer func(timeout time.Duration) { doctorTimeout = timeout }(doctorTimeout)
+	doctorTimeout = 500 * time.Millisecond
+	Output = outputJSON
+	stderr = &bytes.Buffer{}
+
+	skew := time.Hour
+	api := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Date", time.Now().Add(-skew).UTC().Format(http.TimeFormat))
+	}))
+	defer api.Close()
+	viper.Set("API_URL", api.URL)
+	viper.Set("REGISTRY", "127.0.0.1:1")
+	viper.Set("FCU_URL", "udp://"+freeUDPAddr(t)+"@")
+
+	checks, err := runDoctorJSON(t, out)
+	if exit, ok := err.(*exitError); !ok || exit.Code != 1 {
+		t.Fatalf("expected exit code 1, got %v", err)
+	}
+	if c := checks["runtime"]; c.Status != checkOK || c.Message != "docker fake" {
+		t.Errorf("unexpected runtime check %+v", c)
+	}
+	if c := checks["clock"]; c.Status != checkFail || !strings.Contains(c.Fix, "timedatectl") {
+		t.Errorf("unexpected clock check %+v", c)
+	}
+	if c := checks["registry"]; c.Status != checkFail {
+		t.Errorf("unexpected registry check %+v", c)
+	}
+	if c := checks["fcu"]; c.Status != checkOK {
+		t.Errorf("unexpected fcu check %+v", c)
+	}
+	if c := checks["config"]; c.Status != checkFail || c.Message != "missing ID, PASSWORD" {
+		t.Errorf("unexpected config check %+v", c)
+	}
+
+	skew = 0
+	viper.Set("ID", "quad-3")
+	viper.Set("PASSWORD", "key")
+	checks, _ = runDoctorJSON(t, out)
+	if c := checks["clock"]; c.Status != checkOK {
+		t.Errorf("unexpected clock check %+v", c)
+	}
+	if c := checks["config"]; c.Status != checkOK {
+		t.Errorf("unexpected config check %+v", c)
+	}
+}
+
+func TestDoctorArch(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	other := "dmc-x86"
+	if runtime.GOARCH == "amd64" {
+		other = "dmc-rpi"
+	}
+	viper.Set("IMAGE", other)
+	if c := doctorArch(); c.Status != checkFail {
+		t.Errorf("expected %s to fail on %s, got %+v", other, runtime.GOARCH, c)
+	}
+	viper.Set("IMAGE", "dmc-custom")
+	if c := doctorArch(); c.Status != checkWarn {
+		t.Errorf("unexpected check %+v", c)
+	}
+}
+
+func TestDoctorFCUInUse(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	// Hold the port like another process would.
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	viper.Set("FCU_URL", "udp://"+l.LocalAddr().String()+"@")
+
+	checks := doctorFCU(containerEngine)
+	if len(checks) != 1 || checks[0].Status != checkFail || !strings.Contains(checks[0].Fix, "ss -lpn") {
+		t.Errorf("unexpected checks %+v", checks)
+	}
+}
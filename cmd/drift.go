@@ -0,0 +1,79 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/airpelago/dmctl/engine"
+)
+
+const (
+	versionLabel = "dmctl.version"
+	// configLabel is the configHash of the spec a container was created
+	// with.
+	configLabel = "dmctl.config"
+)
+
+// configHash identifies the image and configuration of a container. The
+// restart policy and stop timeout, which are set by flags, are left out so
+// that using them doesn't count as drift.
+func configHash(image string, spec *engine.Spec) string {
+	env := append([]string{}, spec.Env...)
+	sort.Strings(env)
+	raw, _ := json.Marshal(struct {
+		Image       string
+		Env         []string
+		Cmd         []string
+		Tty         bool
+		Privileged  bool
+		NetworkMode string
+		Devices     []string
+		Ports       []string
+		Mounts      []string
+	}{image, env, spec.Cmd, spec.Tty, spec.Privileged, spec.NetworkMode, spec.Devices, spec.Ports, spec.Mounts})
+	return fmt.Sprintf("%x", sha256.Sum256(raw))
+}
+
+// configDrift returns why a container with the given labels doesn't match
+// the image and spec it would be created with now, or "" if it does.
+func configDrift(labels map[string]string, image string, spec *engine.Spec) string {
+	switch {
+	case labels[profileLabel] != activeProfile():
+		return "it wasn't created by dmctl"
+	case labels[configLabel] == "":
+		return "it was created by an older dmctl"
+	case labels[configLabel] != configHash(image, spec):
+		return fmt.Sprintf("the configuration changed since dmctl %s created it", labels[versionLabel])
+	}
+	return ""
+}
+
+// serviceDrift is configDrift for a service of the stack. Simulators are
+// not compared, their spec depends on the options dmctl sim was run with.
+func serviceDrift(s *stack, name string, labels map[string]string) string {
+	if labels[profileLabel] == activeProfile() && name == droneService && isSimImage() {
+		return ""
+	}
+	img, spec, err := serviceSpec(s, name)
+	if err != nil {
+		return ""
+	}
+	return configDrift(labels, img, spec)
+}
@@ -0,0 +1,88 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// dronesCmd represents the drones command
+var dronesCmd = &cobra.Command{
+	Use:   "drones",
+	Short: "Show drones registered to your dmc account",
+}
+
+var dronesListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists registered drones",
+	Args:  cobra.NoArgs,
+	RunE:  runDronesList,
+}
+
+// droneInfo is the schema of dmctl drones list --output json|yaml.
+type droneInfo struct {
+	ID   string `json:"id" yaml:"id"`
+	Name string `json:"name" yaml:"name"`
+	// Configured is set for the drone of the active profile.
+	Configured bool `json:"configured" yaml:"configured"`
+}
+
+type dronesResult struct {
+	Drones []droneInfo `json:"drones" yaml:"drones"`
+}
+
+func runDronesList(cmd *cobra.Command, args []string) error {
+	t, err := token()
+	if err != nil {
+		return err
+	}
+	client, err := newAPIClient(t)
+	if err != nil {
+		return err
+	}
+	drones, err := client.Drones(context.Background())
+	if err != nil {
+		return err
+	}
+	result := dronesResult{Drones: []droneInfo{}}
+	for _, d := range drones {
+		result.Drones = append(result.Drones, droneInfo{
+			ID:         d.ID,
+			Name:       d.Name,
+			Configured: d.ID == viper.GetString("ID"),
+		})
+	}
+	return printResult(result, func(w io.Writer) {
+		fmt.Fprintln(w, "  ID\tNAME")
+		for _, d := range result.Drones {
+			mark := " "
+			if d.Configured {
+				mark = "*"
+			}
+			fmt.Fprintf(w, "%s %s\t%s\n", mark, d.ID, d.Name)
+		}
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(dronesCmd)
+	dronesCmd.AddCommand(dronesListCmd)
+}
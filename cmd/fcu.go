@@ -0,0 +1,644 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/airpelago/dmctl/mavlink"
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// The router and the drone container talk over these loopback ports when
+// the MAVLink router is enabled.
+const (
+	routerPort      = 14590
+	routerDronePort = 14591
+)
+
+var (
+	gcsURL      string
+	gcsForwards []string
+	fcuRouter   bool
+
+	ProbeURL      string
+	ProbeTimeout  time.Duration
+	ProbeDuration time.Duration
+
+	// serialGlobs match the devices flight controllers show up as, most
+	// stable names first.
+	serialGlobs = []string{
+		"/dev/serial/by-id/*",
+		"/dev/ttyACM*",
+		"/dev/ttyUSB*",
+		"/dev/ttyAMA*",
+		"/dev/ttyTHS*",
+		"/dev/cu.usbmodem*",
+		"/dev/cu.usbserial*",
+	}
+	// baudRates are tried in order when detecting the baud rate of a
+	// serial FCU.
+	baudRates        = []int{57600, 115200, 921600, 500000, 230400, 1500000}
+	baudProbeTimeout = 2 * time.Second
+)
+
+var fcuConfigCmd = &cobra.Command{
+	Use:   "fcu",
+	Short: "Configures the FCU link and GCS forwarding",
+	Long: `Configures how the drone connects to the flight controller (FCU_URL),
+where mavros forwards MAVLink to (GCS_URL) and any additional forwarding
+endpoints, such as QGroundControl on the LAN or a telemetry radio.
+
+Additional endpoints need the built-in MAVLink router, which owns the FCU
+link and shares it between the drone container and the endpoints. Run it
+with dmctl fcu router, or install it as a service with dmctl service install.
+
+Endpoints use the mavros url format:
+
+  serial:///dev/ttyACM0:57600
+  udp://[bind_host][:port]@[remote_host][:port]
+  udp-b://[bind_host][:port]@[:port]
+  tcp://host[:port]
+  tcp-l://[bind_host][:port]`,
+	Args: cobra.NoArgs,
+	RunE: runConfigureFCU,
+	PostRun: func(cmd *cobra.Command, args []string) {
+		good("FCU config saved!")
+	},
+}
+
+// fcuCmd represents the fcu command
+var fcuCmd = &cobra.Command{
+	Use:   "fcu",
+	Short: "Work with the flight controller link",
+}
+
+var fcuRouterCmd = &cobra.Command{
+	Use:   "router",
+	Short: "Runs the MAVLink router in the foreground",
+	Long: `Runs the MAVLink router, forwarding MAVLink between FCU_URL, the drone
+container and GCS_FORWARDS until interrupted. Enable it with
+dmctl config fcu --router.`,
+	Args: cobra.NoArgs,
+	RunE: runFCURouter,
+}
+
+var fcuProbeCmd = &cobra.Command{
+	Use:   "probe",
+	Short: "Checks the FCU link by waiting for a heartbeat",
+	Long: `Opens FCU_URL, or --url, and waits for a heartbeat from the flight
+controller. Reports its system and component id, autopilot, vehicle type,
+armed state and the rate it sends messages at.
+
+Exits with 5 if no heartbeat arrives within --timeout. FCU_URL can't be
+opened while the drone container or the MAVLink router holds it, probe a
+local forward with --url instead.`,
+	Args: cobra.NoArgs,
+	RunE: runFCUProbe,
+}
+
+// probeResult is the schema of dmctl fcu probe --output json|yaml.
+type probeResult struct {
+	URL            string  `json:"url" yaml:"url"`
+	Heartbeat      bool    `json:"heartbeat" yaml:"heartbeat"`
+	SystemID       uint8   `json:"system_id" yaml:"system_id"`
+	ComponentID    uint8   `json:"component_id" yaml:"component_id"`
+	Autopilot      string  `json:"autopilot" yaml:"autopilot"`
+	Type           string  `json:"type" yaml:"type"`
+	Armed          bool    `json:"armed" yaml:"armed"`
+	MavlinkVersion int     `json:"mavlink_version" yaml:"mavlink_version"`
+	MessageRate    float64 `json:"message_rate" yaml:"message_rate"`
+	Error          string  `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// runFCUProbe exits with exitNoHeartbeat unless a heartbeat arrives.
+func runFCUProbe(cmd *cobra.Command, args []string) error {
+	url := ProbeURL
+	if url == "" {
+		url = viper.GetString("FCU_URL")
+	}
+	if url == "" {
+		return fmt.Errorf("FCU_URL is not configured, run dmctl config fcu")
+	}
+	result, err := probeFCU(context.Background(), url)
+	if err != nil {
+		return err
+	}
+	err = printResult(result, func(w io.Writer) {
+		if !result.Heartbeat {
+			bad(result.Error)
+			return
+		}
+		printProbe(w, result)
+	})
+	if err != nil {
+		return err
+	}
+	if !result.Heartbeat {
+		return &exitError{Code: exitNoHeartbeat}
+	}
+	return nil
+}
+
+// probeFCU waits ProbeTimeout for a heartbeat on url and then measures the
+// message rate for ProbeDuration. Only an invalid url is returned as an
+// error, failing to reach the FCU is reported in the result.
+func probeFCU(ctx context.Context, url string) (probeResult, error) {
+	result := probeResult{URL: url}
+	ep, err := mavlink.ParseURL(url)
+	if err != nil {
+		return result, err
+	}
+	if !machineOutput() {
+		fmt.Fprintf(stdout, "Waiting for a heartbeat on %s..\n", ep)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	conn, err := ep.Open(ctx)
+	if err == mavlink.ErrInUse {
+		result.Error = fmt.Sprintf("%s is in use, by the drone container or MAVLink router if they are running", ep)
+		return result, nil
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	defer conn.Close()
+
+	found, err := mavlink.Probe(ctx, conn, ProbeTimeout, ProbeDuration)
+	if err == mavlink.ErrNoHeartbeat {
+		result.Error = fmt.Sprintf("no heartbeat within %s", ProbeTimeout)
+		return result, nil
+	}
+	if err != nil {
+		result.Error = err.Error()
+		return result, nil
+	}
+	hb := found.Heartbeat
+	result.Heartbeat = true
+	result.SystemID = hb.SystemID
+	result.ComponentID = hb.ComponentID
+	result.Autopilot = hb.AutopilotName()
+	result.Type = hb.TypeName()
+	result.Armed = hb.Armed()
+	result.MavlinkVersion = found.Version
+	result.MessageRate = found.Rate
+	return result, nil
+}
+
+func printProbe(w io.Writer, p probeResult) {
+	good(fmt.Sprintf("Heartbeat from system %d component %d", p.SystemID, p.ComponentID))
+	armed := "no"
+	if p.Armed {
+		armed = "yes"
+	}
+	fmt.Fprintf(w, "Autopilot\t%s\n", p.Autopilot)
+	fmt.Fprintf(w, "Type\t%s\n", p.Type)
+	fmt.Fprintf(w, "Armed\t%s\n", armed)
+	fmt.Fprintf(w, "MAVLink\tv%d\n", p.MavlinkVersion)
+	fmt.Fprintf(w, "Rate\t%.1f msg/s\n", p.MessageRate)
+}
+
+func runConfigureFCU(cmd *cobra.Command, args []string) error {
+	fcu := fcuURL
+	if fcu == "" {
+		current := viper.GetString("FCU_URL")
+		if NonInteractive {
+			fcu = current
+			if fcu == "" {
+				fcu = "udp://:14650@"
+			}
+		} else {
+			var err error
+			if fcu, err = buildEndpoint("FCU", current, 14650); err != nil {
+				return err
+			}
+		}
+	}
+	if err := validateEndpoint(fcu); err != nil {
+		return fmt.Errorf("invalid FCU url: %s", err)
+	}
+
+	gcs := gcsURL
+	if !cmd.Flags().Changed("gcs-url") {
+		var err error
+		gcs, err = promptValue("", &promptui.Prompt{
+			Label:    "GCS url (empty for none)",
+			Default:  viper.GetString("GCS_URL"),
+			Validate: validateOptionalEndpoint,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	if err := validateOptionalEndpoint(gcs); err != nil {
+		return fmt.Errorf("invalid GCS url: %s", err)
+	}
+
+	forwards := gcsForwards
+	if !cmd.Flags().Changed("forward") {
+		forwards = splitList(viper.GetString("GCS_FORWARDS"))
+		if !NonInteractive {
+			var err error
+			if forwards, err = editForwards(forwards); err != nil {
+				return err
+			}
+		}
+	}
+	for _, f := range forwards {
+		if err := validateEndpoint(f); err != nil {
+			return fmt.Errorf("invalid forwarding endpoint: %s", err)
+		}
+	}
+
+	router := fcuRouter
+	if !cmd.Flags().Changed("router") {
+		router = viper.GetBool("MAVLINK_ROUTER") || len(forwards) > 0
+		if !router && !NonInteractive {
+			var err error
+			if router, err = confirm("Run the built-in MAVLink router", false); err != nil {
+				return err
+			}
+		}
+	}
+	if len(forwards) > 0 && !router {
+		return fmt.Errorf("forwarding endpoints need the MAVLink router, pass --router")
+	}
+
+	viper.Set("FCU_URL", fcu)
+	viper.Set("GCS_URL", gcs)
+	viper.Set("GCS_FORWARDS", strings.Join(forwards, ","))
+	viper.Set("MAVLINK_ROUTER", strconv.FormatBool(router))
+	if err := writeConfig(); err != nil {
+		return err
+	}
+	if router && !routerRunning() {
+		fmt.Fprintln(messages(), "Run the router with dmctl fcu router, or install it as a service with dmctl service install")
+	}
+	return nil
+}
+
+// buildEndpoint asks for an endpoint piece by piece. bindPort is the
+// default local port of udp endpoints.
+func buildEndpoint(label, current string, bindPort int) (string, error) {
+	kinds := []string{"Serial", "UDP", "UDP broadcast", "TCP client", "TCP server", "Enter url"}
+	if current != "" {
+		kinds = append([]string{"Keep " + current}, kinds...)
+	}
+	kindPrompt := &promptui.Select{
+		Label: label + " connection",
+		Items: kinds,
+	}
+	_, kind, err := kindPrompt.Run()
+	if err != nil {
+		return "", err
+	}
+	switch kind {
+	case "Serial":
+		return buildSerialEndpoint()
+	case "UDP":
+		port, err := promptPort("Local port", bindPort)
+		if err != nil {
+			return "", err
+		}
+		remote, err := (&promptui.Prompt{Label: "Remote host:port (empty to reply to the sender)"}).Run()
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("udp://:%d@%s", port, remote), nil
+	case "UDP broadcast":
+		port, err := promptPort("Broadcast port", mavlink.DefaultRemotePort)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("udp-b://:%d@:%d", bindPort, port), nil
+	case "TCP client":
+		remote, err := (&promptui.Prompt{
+			Label:    "Host:port",
+			Default:  fmt.Sprintf("127.0.0.1:%d", mavlink.DefaultTCPPort),
+			Validate: func(v string) error { return validateEndpoint("tcp://" + v) },
+		}).Run()
+		if err != nil {
+			return "", err
+		}
+		return "tcp://" + remote, nil
+	case "TCP server":
+		port, err := promptPort("Port", mavlink.DefaultTCPPort)
+		if err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("tcp-l://:%d", port), nil
+	case "Enter url":
+		return (&promptui.Prompt{
+			Label:    label + " url",
+			Default:  current,
+			Validate: validateEndpoint,
+		}).Run()
+	}
+	return current, nil
+}
+
+// buildSerialEndpoint offers the serial ports found on this host and
+// detects the baud rate by listening for a heartbeat.
+func buildSerialEndpoint() (string, error) {
+	ports := serialPorts()
+	device := ""
+	if len(ports) > 0 {
+		portPrompt := &promptui.Select{
+			Label: "Serial port",
+			Items: append(ports, "Other"),
+		}
+		i, _, err := portPrompt.Run()
+		if err != nil {
+			return "", err
+		}
+		if i < len(ports) {
+			device = ports[i]
+		}
+	} else {
+		warn("No serial ports found")
+	}
+	if device == "" {
+		var err error
+		device, err = (&promptui.Prompt{
+			Label: "Serial device",
+			Validate: func(v string) error {
+				if !filepath.IsAbs(v) {
+					return fmt.Errorf("expected a path such as /dev/ttyACM0")
+				}
+				return nil
+			},
+		}).Run()
+		if err != nil {
+			return "", err
+		}
+	}
+
+	fmt.Fprintf(stdout, "Detecting baud rate of %s..\n", device)
+	baud, err := detectBaud(context.Background(), device, baudRates)
+	if err == nil {
+		good(fmt.Sprintf("Heartbeat received at %d baud", baud))
+		return fmt.Sprintf("serial://%s:%d", device, baud), nil
+	}
+	warn(fmt.Sprintf("Could not detect the baud rate: %s", err))
+	items := make([]string, len(baudRates))
+	for i, rate := range baudRates {
+		items[i] = strconv.Itoa(rate)
+	}
+	baudPrompt := &promptui.Select{
+		Label: "Baud rate",
+		Items: items,
+	}
+	_, rate, err := baudPrompt.Run()
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("serial://%s:%s", device, rate), nil
+}
+
+// editForwards shows the configured forwarding endpoints and asks for more.
+func editForwards(forwards []string) ([]string, error) {
+	if len(forwards) > 0 {
+		fmt.Fprintln(stdout, "Forwarding endpoints:")
+		for _, f := range forwards {
+			fmt.Fprintln(stdout, "  "+f)
+		}
+		keep, err := confirm("Keep these endpoints", true)
+		if err != nil {
+			return nil, err
+		}
+		if !keep {
+			forwards = nil
+		}
+	}
+	for {
+		add, err := confirm("Add a forwarding endpoint", false)
+		if err != nil || !add {
+			return forwards, err
+		}
+		f, err := buildEndpoint("Forwarding", "", 0)
+		if err != nil {
+			return nil, err
+		}
+		forwards = append(forwards, f)
+	}
+}
+
+func promptPort(label string, def int) (int, error) {
+	v, err := (&promptui.Prompt{
+		Label:   label,
+		Default: strconv.Itoa(def),
+		Validate: func(v string) error {
+			if n, err := strconv.Atoi(v); err != nil || n < 0 || n > 65535 {
+				return fmt.Errorf("invalid port %s", v)
+			}
+			return nil
+		},
+	}).Run()
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(v)
+}
+
+// confirm asks a yes or no question, answering def in non-interactive mode.
+func confirm(label string, def bool) (bool, error) {
+	if NonInteractive {
+		return def, nil
+	}
+	p := &promptui.Prompt{Label: label, IsConfirm: true}
+	if def {
+		p.Default = "y"
+	}
+	_, err := p.Run()
+	if err == promptui.ErrAbort {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// serialPorts lists the serial devices matching serialGlobs. Devices that
+// are also reachable through a /dev/serial/by-id link are only listed once,
+// by the link.
+func serialPorts() []string {
+	var ports []string
+	seen := map[string]bool{}
+	for _, pattern := range serialGlobs {
+		matches, _ := filepath.Glob(pattern)
+		sort.Strings(matches)
+		for _, m := range matches {
+			target, err := filepath.EvalSymlinks(m)
+			if err != nil {
+				target = m
+			}
+			if seen[target] {
+				continue
+			}
+			seen[target] = true
+			ports = append(ports, m)
+		}
+	}
+	return ports
+}
+
+// detectBaud returns the first of rates at which a heartbeat is received
+// from device.
+func detectBaud(ctx context.Context, device string, rates []int) (int, error) {
+	for _, rate := range rates {
+		ep := &mavlink.Endpoint{Scheme: "serial", Device: device, Baud: rate}
+		ok, err := probeBaud(ctx, ep)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			return rate, nil
+		}
+	}
+	return 0, fmt.Errorf("no heartbeat at %s baud", joinInts(rates))
+}
+
+func probeBaud(ctx context.Context, ep *mavlink.Endpoint) (bool, error) {
+	ctx, cancel := context.WithTimeout(ctx, baudProbeTimeout)
+	defer cancel()
+	conn, err := ep.Open(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+	_, err = mavlink.WaitHeartbeat(ctx, conn)
+	return err == nil, nil
+}
+
+func joinInts(values []int) string {
+	s := make([]string, len(values))
+	for i, v := range values {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ", ")
+}
+
+func runFCURouter(cmd *cobra.Command, args []string) error {
+	if !routerEnabled() {
+		return fmt.Errorf("the MAVLink router is not enabled, run dmctl config fcu --router")
+	}
+	endpoints, err := routerEndpoints()
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(sig)
+	go func() {
+		<-sig
+		cancel()
+	}()
+
+	router := &mavlink.Router{
+		Endpoints: endpoints,
+		Logf: func(format string, args ...interface{}) {
+			fmt.Fprintf(stderr, format+"\n", args...)
+		},
+	}
+	for _, ep := range endpoints {
+		fmt.Fprintf(stdout, "Routing %s\n", ep)
+	}
+	return router.Run(ctx)
+}
+
+func routerEnabled() bool {
+	return viper.GetBool("MAVLINK_ROUTER") && !isSimImage()
+}
+
+// routerEndpoints returns the FCU link, the drone container's side of the
+// router and the forwarding endpoints.
+func routerEndpoints() ([]*mavlink.Endpoint, error) {
+	fcu, err := mavlink.ParseURL(viper.GetString("FCU_URL"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid FCU_URL: %s", err)
+	}
+	endpoints := []*mavlink.Endpoint{fcu, {
+		Scheme: "udp",
+		Bind:   net.JoinHostPort("127.0.0.1", strconv.Itoa(routerPort)),
+		Remote: net.JoinHostPort("127.0.0.1", strconv.Itoa(routerDronePort)),
+	}}
+	for _, f := range splitList(viper.GetString("GCS_FORWARDS")) {
+		ep, err := mavlink.ParseURL(f)
+		if err != nil {
+			return nil, fmt.Errorf("invalid GCS_FORWARDS: %s", err)
+		}
+		endpoints = append(endpoints, ep)
+	}
+	return endpoints, nil
+}
+
+// droneFCUURL is the FCU_URL passed to the drone container, which talks to
+// the router instead of the FCU when the router is enabled.
+func droneFCUURL() string {
+	if routerEnabled() {
+		return fmt.Sprintf("udp://127.0.0.1:%d@127.0.0.1:%d", routerDronePort, routerPort)
+	}
+	return viper.GetString("FCU_URL")
+}
+
+// routerRunning reports whether something holds the router's port.
+func routerRunning() bool {
+	conn, err := net.ListenPacket("udp", net.JoinHostPort("127.0.0.1", strconv.Itoa(routerPort)))
+	if err != nil {
+		return true
+	}
+	conn.Close()
+	return false
+}
+
+func splitList(v string) []string {
+	var list []string
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+func init() {
+	configCmd.AddCommand(fcuConfigCmd)
+	rootCmd.AddCommand(fcuCmd)
+	fcuCmd.AddCommand(fcuRouterCmd, fcuProbeCmd)
+
+	fcuProbeCmd.Flags().StringVar(&ProbeURL, "url", "", "Endpoint to probe (default FCU_URL)")
+	fcuProbeCmd.Flags().DurationVar(&ProbeTimeout, "timeout", 5*time.Second, "How long to wait for a heartbeat")
+	fcuProbeCmd.Flags().DurationVar(&ProbeDuration, "duration", 2*time.Second, "How long to measure the message rate for")
+
+	fcuConfigCmd.Flags().StringVar(&fcuURL, "fcu-url", "", "FCU url, skips the endpoint builder")
+	fcuConfigCmd.Flags().StringVar(&gcsURL, "gcs-url", "", "Url mavros forwards MAVLink to, empty for none")
+	fcuConfigCmd.Flags().StringArrayVar(&gcsForwards, "forward", nil, "Additional forwarding endpoint url, can be repeated")
+	fcuConfigCmd.Flags().BoolVar(&fcuRouter, "router", false, "Run the built-in MAVLink router")
+}
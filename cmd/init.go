@@ -24,6 +24,9 @@ var initCmd = &cobra.Command{
 	Use:   "init",
 	Short: "Configure, download and start container",
 	RunE: func(cmd *cobra.Command, args []string) error {
+		if err := requireFlags(cmd, "drone-id", "verification-key"); err != nil {
+			return err
+		}
 		if err := runConfigureDrone(cmd, args); err != nil {
 			return err
 		}
@@ -42,4 +45,8 @@ var initCmd = &cobra.Command{
 
 func init() {
 	rootCmd.AddCommand(initCmd)
+
+	addDroneFlags(initCmd)
+	addLoginFlags(initCmd)
+	addOBCFlags(initCmd)
 }
@@ -0,0 +1,176 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/manifoldco/promptui"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	ForceWhileArmed bool
+
+	// armedOverridden is set once an override is confirmed, so that
+	// commands stopping several containers only ask once.
+	armedOverridden bool
+
+	// readConfirmation prompts for the text confirming an override.
+	readConfirmation = func(label string) (string, error) {
+		return (&promptui.Prompt{Label: label}).Run()
+	}
+)
+
+// armedOverride is a line of the override log.
+type armedOverride struct {
+	Time     time.Time `json:"time"`
+	User     string    `json:"user"`
+	SudoUser string    `json:"sudo_user,omitempty"`
+	Profile  string    `json:"profile"`
+	Action   string    `json:"action"`
+	Command  string    `json:"command"`
+	// Armed is false if the override was for an unknown state.
+	Armed    bool   `json:"armed"`
+	SystemID uint8  `json:"system_id,omitempty"`
+	FCUError string `json:"fcu_error,omitempty"`
+}
+
+// checkArmed refuses action, which would disrupt the onboard software,
+// while the vehicle is armed unless --force-while-armed is passed and the
+// drone id is typed to confirm. The drone container holds the FCU link while
+// it runs, so if the armed state can't be read then action is refused too,
+// unless ARMED_INTERLOCK is warn.
+func checkArmed(action string) error {
+	mode := viper.GetString("ARMED_INTERLOCK")
+	if armedOverridden || mode == "off" || isSimImage() {
+		return nil
+	}
+	running, err := containerRunning(containerName(droneService))
+	if err != nil {
+		return err
+	}
+	fcu := checkFCU(context.Background(), running)
+	switch {
+	case fcu.Heartbeat && !fcu.Armed:
+		return nil
+	case fcu.Heartbeat:
+		bad(fmt.Sprintf("The vehicle is armed (system %d, %s %s)", fcu.SystemID, fcu.Autopilot, fcu.Type))
+	case running && mode != "warn":
+		bad(fmt.Sprintf("Can't tell whether the vehicle is armed: %s", fcu.Error))
+		warn("Set GCS_URL to a local udp endpoint so that it can be read, or ARMED_INTERLOCK to warn to allow this anyway")
+	default:
+		warn(fmt.Sprintf("Can't tell whether the vehicle is armed: %s", fcu.Error))
+		return nil
+	}
+	if !ForceWhileArmed {
+		return &exitError{Code: exitArmed, Err: fmt.Errorf("refusing to %s, pass --force-while-armed to override", action)}
+	}
+	if NonInteractive {
+		return &exitError{Code: exitArmed, Err: errors.New("--force-while-armed needs a typed confirmation and can't be used with --non-interactive")}
+	}
+	want := viper.GetString("ID")
+	if want == "" {
+		want = "armed"
+	}
+	typed, err := readConfirmation(fmt.Sprintf("Type %s to %s anyway", want, action))
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(typed) != want {
+		return &exitError{Code: exitArmed, Err: fmt.Errorf("confirmation doesn't match %s, not continuing", want)}
+	}
+	path, err := logArmedOverride(armedOverride{
+		Action:   action,
+		Armed:    fcu.Heartbeat,
+		SystemID: fcu.SystemID,
+		FCUError: fcu.Error,
+	})
+	if err != nil {
+		return fmt.Errorf("failed to log the override, not continuing: %s", err)
+	}
+	armedOverridden = true
+	warn(fmt.Sprintf("Override logged to %s", path))
+	return nil
+}
+
+// armedRefusal reports whether err is checkArmed refusing an action.
+func armedRefusal(err error) bool {
+	e, ok := err.(*exitError)
+	return ok && e.Code == exitArmed
+}
+
+// logArmedOverride appends o to ~/.dmc/overrides.log and returns the path.
+func logArmedOverride(o armedOverride) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	o.Time = time.Now().UTC()
+	o.Profile = activeProfile()
+	o.Command = strings.Join(os.Args, " ")
+	o.User = os.Getenv("USER")
+	if u, err := user.Current(); err == nil {
+		o.User = u.Username
+	}
+	o.SudoUser = os.Getenv("SUDO_USER")
+	line, err := json.Marshal(o)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(dir, "overrides.log")
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return "", err
+	}
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		f.Close()
+		return "", err
+	}
+	return path, f.Close()
+}
+
+// addForceWhileArmedFlag adds --force-while-armed to a command that stops
+// or replaces containers.
+func addForceWhileArmedFlag(cmd *cobra.Command) {
+	cmd.PersistentFlags().BoolVar(&ForceWhileArmed, "force-while-armed", false, "Stop containers although the vehicle is armed, after typing the drone id")
+}
+
+func validateInterlock(v string) error {
+	switch v {
+	case "on", "warn", "off":
+		return nil
+	}
+	return fmt.Errorf("expected on, warn or off")
+}
+
+func init() {
+	for _, cmd := range []*cobra.Command{stopCmd, restartCmd, rmCmd, startCmd, upgradeCmd, rollbackCmd, serviceCmd, bundleInstallCmd} {
+		addForceWhileArmedFlag(cmd)
+	}
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// armedHeartbeats sends armed heartbeats to GCS_URL until the returned
+// func is called.
+func armedHeartbeats(t *testing.T) func() {
+	StatusTimeout = time.Second
+	gcs := freeUDPAddr(t)
+	viper.Set("FCU_URL", "serial:///dev/ttyACM0:921600")
+	viper.Set("GCS_URL", "udp://@"+gcs)
+	viper.Set("ID", "drone-1")
+	viper.Set("ARMED_INTERLOCK", "on")
+	stop := make(chan struct{})
+	sendHeartbeats(t, gcs, stop)
+	return func() { close(stop) }
+}
+
+// startArmed starts the drone with armed heartbeats on its GCS_URL.
+func startArmed(t *testing.T) func() {
+	stop := armedHeartbeats(t)
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	return stop
+}
+
+func TestStopWhileArmed(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	defer startArmed(t)()
+
+	err := runStopDrone(nil, nil)
+	if e, ok := err.(*exitError); !ok || e.Code != exitArmed {
+		t.Fatalf("expected exit code %d, got %v", exitArmed, err)
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running {
+		t.Fatal("drone stopped while armed")
+	}
+
+	ForceWhileArmed = true
+	NonInteractive = true
+	err = runStopDrone(nil, nil)
+	NonInteractive = false
+	if e, ok := err.(*exitError); !ok || e.Code != exitArmed {
+		t.Fatalf("expected non-interactive override to be refused, got %v", err)
+	}
+
+	old := readConfirmation
+	defer func() { readConfirmation = old }()
+	readConfirmation = func(label string) (string, error) { return "drone-2", nil }
+	if err := runStopDrone(nil, nil); err == nil {
+		t.Fatal("expected mismatched confirmation to be refused")
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running {
+		t.Fatal("drone stopped without confirmation")
+	}
+
+	readConfirmation = func(label string) (string, error) { return "drone-1", nil }
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Fatal("drone not stopped after override")
+	}
+	dir, err := configDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join(dir, "overrides.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var o armedOverride
+	if err := json.Unmarshal(data, &o); err != nil {
+		t.Fatalf("invalid override log %q: %v", data, err)
+	}
+	if !o.Armed || o.SystemID != 1 || !strings.HasPrefix(o.Action, "stop ") || o.Profile != defaultProfile {
+		t.Errorf("unexpected override %+v", o)
+	}
+}
+
+func TestStopInterlockOff(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	defer startArmed(t)()
+	viper.Set("ARMED_INTERLOCK", "off")
+
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Fatal("drone not stopped")
+	}
+}
+
+func TestStopUnknownArmedState(t *testing.T) {
+	fake, _, teardown := setupFake(t)
+	defer teardown()
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// The running drone holds FCU_URL and GCS_URL forwards elsewhere.
+	viper.Set("FCU_URL", "serial:///dev/ttyACM0:921600")
+	viper.Set("GCS_URL", "udp://@192.0.2.1:14550")
+	viper.Set("ARMED_INTERLOCK", "on")
+	err := runStopDrone(nil, nil)
+	if e, ok := err.(*exitError); !ok || e.Code != exitArmed {
+		t.Fatalf("expected unknown armed state to be refused, got %v", err)
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running {
+		t.Fatal("drone stopped with unknown armed state")
+	}
+	viper.Set("ARMED_INTERLOCK", "warn")
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if fake.Get("drone") != nil {
+		t.Fatal("drone not stopped")
+	}
+}
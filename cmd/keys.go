@@ -0,0 +1,329 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/mavlink"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+type configKey struct {
+	Name        string
+	Description string
+	Validate    func(string) error
+}
+
+// configKeys lists every setting that can be changed with dmctl config set.
+var configKeys = []configKey{
+	{"ID", "Registered drone id", nil},
+	{"PASSWORD", "Drone verification key", nil},
+	{"FCU_URL", "FCU url", validateEndpoint},
+	{"GCS_URL", "GCS url", validateOptionalEndpoint},
+	{"GCS_FORWARDS", "Comma separated MAVLink forwarding endpoints", validateEndpoints},
+	{"MAVLINK_ROUTER", "Run the built-in MAVLink router (true, false)", validateBool},
+	{"DMC_URI", "Onboard software backend uri", validateURL},
+	{"DMC_SESSION_URI", "Onboard software session uri", validateURL},
+	{"DMC_ANIP_URI", "ANIP uri", validateURL},
+	{"MOCK_IMSI", "Mock IMSI", nil},
+	{"MOCK_POSITION", "Mock position (LAT,LNG,ALT)", validatePosition},
+	{"REGISTRY", "Registry to pull images from (default docker.io)", validateRegistry},
+	{"NAMESPACE", "Image namespace in the registry (default tobiasfriden)", validateNamespace},
+	{"IMAGE", "Onboard software image", validateImage},
+	{"IMAGE_VERSION", "Onboard software version", nil},
+	{"IMAGE_DIGEST", "Pinned onboard software digest", validateDigest},
+	{"SIM_TYPE", "Simulated vehicle type (copter, plane, vtol, rover)", validateSimType},
+	{"SIM_HEADING", "Simulated home heading in degrees (default 0)", validateHeading},
+	{"SIM_SPEEDUP", "Simulation speedup factor (default 1)", validateSpeedup},
+	{"SIM_WIND", "Simulated wind as SPEED,DIRECTION in m/s and degrees", validateWind},
+	{"SIM_PARAMS", "Comma separated parameter files loaded by the simulator", validateParams},
+	{"LOG_ARCHIVE", "Archive the output of the drone container (true, false)", validateBool},
+	{"LOG_ARCHIVE_DIR", "Log archive directory (default ~/.dmc/logs)", nil},
+	{"LOG_ARCHIVE_SEGMENT_SIZE", "Size at which archived output is rotated (default " + defaultSegmentSize + ")", validateSize},
+	{"LOG_ARCHIVE_MAX_SIZE", "Total size of archived output kept (default " + defaultArchiveSize + ")", validateSize},
+	{"LOG_ARCHIVE_MAX_AGE", "How long archived output is kept (default " + defaultArchiveAge + ")", validateDuration},
+	{"ARMED_INTERLOCK", "Refuse to stop containers while armed or unknown (on, warn to allow when unknown, off)", validateInterlock},
+	{"STOP_TIMEOUT", "How long containers get to exit before they are killed (default 10s)", validateDuration},
+	{"KEEP_STOPPED", "Keep stopped containers for inspection (true, false)", validateBool},
+	{"RUNTIME", "Container runtime (docker, podman, containerd)", validateRuntime},
+	{"API_URL", "Backend API url (default " + defaultAPIURL + ")", validateURL},
+	{"API_CA_CERT", "CA bundle to trust for the backend API", validateFile},
+	{"API_CLIENT_CERT", "Client certificate for the backend API", validateFile},
+	{"API_CLIENT_KEY", "Client certificate key (default API_CLIENT_CERT)", validateFile},
+	{"TOKEN", "Login token", nil},
+	{"SECRET_STORE", "Where PASSWORD and TOKEN are kept (auto, keyring, file; auto is resolved on first save)", validateSecretStore},
+}
+
+var configSetCmd = &cobra.Command{
+	Use:   "set KEY VALUE",
+	Short: "Sets a configuration value",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runConfigSet,
+}
+
+var configGetCmd = &cobra.Command{
+	Use:   "get KEY",
+	Short: "Prints a configuration value",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigGet,
+}
+
+var configUnsetCmd = &cobra.Command{
+	Use:   "unset KEY",
+	Short: "Removes a configuration value",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runConfigUnset,
+}
+
+var configKeysCmd = &cobra.Command{
+	Use:   "keys",
+	Short: "Lists all configuration keys",
+	Args:  cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+		for _, k := range configKeys {
+			fmt.Fprintf(tw, "%s\t%s\n", k.Name, k.Description)
+		}
+		tw.Flush()
+	},
+}
+
+func runConfigSet(cmd *cobra.Command, args []string) error {
+	key, err := lookupKey(args[0])
+	if err != nil {
+		return err
+	}
+	if key.Validate != nil {
+		if err := key.Validate(args[1]); err != nil {
+			return fmt.Errorf("invalid value for %s: %s", key.Name, err)
+		}
+	}
+	if key.Name == "SECRET_STORE" {
+		old, err := getSecretStore()
+		if err != nil {
+			return err
+		}
+		viper.Set(key.Name, args[1])
+		secretStore = nil
+		store, err := getSecretStore()
+		if err != nil {
+			return err
+		}
+		if err := moveSecrets(old, store, activeProfile()); err != nil {
+			return fmt.Errorf("could not move secrets to the %s store: %s", args[1], err)
+		}
+	}
+	viper.Set(key.Name, args[1])
+	if key.Name == "IMAGE" || key.Name == "IMAGE_VERSION" {
+		viper.Set("IMAGE_DIGEST", "")
+	}
+	return writeConfig()
+}
+
+func runConfigGet(cmd *cobra.Command, args []string) error {
+	key, err := lookupKey(args[0])
+	if err != nil {
+		return err
+	}
+	if !viper.IsSet(key.Name) {
+		return fmt.Errorf("%s is not set", key.Name)
+	}
+	fmt.Fprintln(stdout, viper.GetString(key.Name))
+	return nil
+}
+
+// runConfigUnset edits the config file directly since viper has no way of
+// removing a key once it has been read.
+func runConfigUnset(cmd *cobra.Command, args []string) error {
+	key, err := lookupKey(args[0])
+	if err != nil {
+		return err
+	}
+	if isSecret(key.Name) {
+		// Also drops it from STORED_SECRETS.
+		viper.Set(key.Name, "")
+		return writeConfig()
+	}
+	path, err := configFile()
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	var config map[string]interface{}
+	if err := yaml.Unmarshal(raw, &config); err != nil {
+		return err
+	}
+	delete(config, strings.ToLower(key.Name))
+	out, err := yaml.Marshal(&config)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, out, 0600)
+}
+
+func lookupKey(name string) (*configKey, error) {
+	for i := range configKeys {
+		if strings.EqualFold(configKeys[i].Name, name) {
+			return &configKeys[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown key %s, run dmctl config keys to list valid keys", name)
+}
+
+func validateURL(v string) error {
+	u, err := url.Parse(v)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "" {
+		return fmt.Errorf("%s is missing a scheme", v)
+	}
+	return nil
+}
+
+// validateEndpoint checks a mavros style MAVLink endpoint url.
+func validateEndpoint(v string) error {
+	_, err := mavlink.ParseURL(v)
+	return err
+}
+
+func validateOptionalEndpoint(v string) error {
+	if v == "" {
+		return nil
+	}
+	return validateEndpoint(v)
+}
+
+func validateEndpoints(v string) error {
+	for _, ep := range splitList(v) {
+		if err := validateEndpoint(ep); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func validateBool(v string) error {
+	if _, err := strconv.ParseBool(v); err != nil {
+		return fmt.Errorf("expected true or false")
+	}
+	return nil
+}
+
+func validatePosition(v string) error {
+	parts := strings.Split(v, ",")
+	if len(parts) != 3 {
+		return fmt.Errorf("expected LAT,LNG,ALT")
+	}
+	for _, p := range parts {
+		if _, err := strconv.ParseFloat(strings.TrimSpace(p), 64); err != nil {
+			return fmt.Errorf("%s is not a number", p)
+		}
+	}
+	return nil
+}
+
+func validateImage(v string) error {
+	boards, err := loadBoards()
+	if err != nil {
+		return err
+	}
+	for _, b := range boards {
+		if b.Image == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown image %s", v)
+}
+
+// validateRegistry accepts a registry host with an optional port, like
+// mirror.local:5000.
+func validateRegistry(v string) error {
+	u, err := url.Parse("//" + v)
+	if err != nil || u.Host != v || v == "" {
+		return fmt.Errorf("expected a registry host such as mirror.local:5000")
+	}
+	return nil
+}
+
+func validateNamespace(v string) error {
+	if v == "" || strings.ContainsAny(v, ":@ ") {
+		return fmt.Errorf("expected a repository path such as tobiasfriden")
+	}
+	return nil
+}
+
+func validateSecretStore(v string) error {
+	switch v {
+	case "auto", "keyring", "file":
+		return nil
+	}
+	return fmt.Errorf("unknown secret store %s", v)
+}
+
+func validateFile(v string) error {
+	_, err := os.Stat(v)
+	return err
+}
+
+func validateDigest(v string) error {
+	if !strings.HasPrefix(v, "sha256:") {
+		return fmt.Errorf("expected sha256:DIGEST")
+	}
+	return nil
+}
+
+func validateSimType(v string) error {
+	boards, err := loadBoards()
+	if err != nil {
+		return err
+	}
+	for _, b := range boards {
+		if b.SimType != "" && b.SimType == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown simulation type %s", v)
+}
+
+func validateRuntime(v string) error {
+	for _, r := range engine.Runtimes {
+		if r == v {
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown runtime %s", v)
+}
+
+func init() {
+	configCmd.AddCommand(configSetCmd, configGetCmd, configUnsetCmd, configKeysCmd)
+}
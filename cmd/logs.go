@@ -16,31 +16,333 @@ limitations under the License.
 package cmd
 
 import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/docker/docker/pkg/term"
+	"github.com/manifoldco/promptui"
 	"github.com/spf13/cobra"
 )
 
 var (
-	Follow bool
+	Follow      bool
+	Tail        int
+	Since       string
+	Until       string
+	Timestamps  bool
+	LogLevel    string
+	Grep        string
+	AllServices bool
+	NoColor     bool
+)
+
+// logLevels are the levels of the onboard software's log lines, least
+// severe first.
+var logLevels = []string{"trace", "debug", "info", "warn", "error", "fatal"}
+
+var (
+	levelRe = regexp.MustCompile(`(?i)\blevel=([a-z]+)|\b(trace|debug|info|warn|warning|error|fatal|critical|panic)\b`)
+
+	logColors = []func(interface{}) string{
+		promptui.Styler(promptui.FGCyan),
+		promptui.Styler(promptui.FGMagenta),
+		promptui.Styler(promptui.FGGreen),
+		promptui.Styler(promptui.FGYellow),
+		promptui.Styler(promptui.FGBlue),
+		promptui.Styler(promptui.FGRed),
+	}
 )
 
 // logsCmd represents the logs command
 var logsCmd = &cobra.Command{
-	Use:   "logs",
+	Use:   "logs [SERVICE...]",
 	Short: "Show logs from running containers",
-	Args:  cobra.MaximumNArgs(1),
-	RunE:  runLogs,
+	Long: `Shows the logs of services of the stack, drone by default. A container
+name can be given instead of a service. The lines of several services are
+interleaved and prefixed with the service name.
+
+--since and --until take a duration before now, such as 10m, or a time such
+as 2019-06-01T12:00:00Z, "2019-06-01 12:00:00" or 2019-06-01 in local time.
+--level shows lines at or above the level, lines without a level, such as
+stack traces, belong to the line before them.`,
+	Example: `  dmctl logs --tail 100 -f
+  dmctl logs --since 1h --level warn
+  dmctl logs --all --grep "(?i)mavlink"`,
+	RunE: runLogs,
 }
 
 func runLogs(cmd *cobra.Command, args []string) error {
-	if len(args) == 1 {
-		return containerLogs("/" + args[0])
+	opts, err := logOptions(time.Now())
+	if err != nil {
+		return err
+	}
+	filter, err := newLogFilter(LogLevel, Grep)
+	if err != nil {
+		return err
+	}
+	names, err := logContainers(args)
+	if err != nil {
+		return err
+	}
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	var found []string
+	var streams []io.ReadCloser
+	defer func() {
+		for _, s := range streams {
+			s.Close()
+		}
+	}()
+	for _, name := range names {
+		c, err := findContainer(ctx, name)
+		if err != nil {
+			return err
+		}
+		id := ""
+		if c != nil {
+			id = c.ID
+		} else if state, err := eng.Inspect(ctx, name); err == nil && state.Labels[profileLabel] == activeProfile() {
+			// A container that exited or was kept by dmctl stop --keep.
+			id = state.ID
+		}
+		if id == "" {
+			bad(fmt.Sprintf("Container %s not found", name))
+			continue
+		}
+		out, err := eng.Logs(ctx, id, opts)
+		if err != nil {
+			return err
+		}
+		found = append(found, name)
+		streams = append(streams, out)
+	}
+	if len(streams) == 0 {
+		return nil
+	}
+	prefixes := logPrefixes(found, !NoColor && isTerminal(stdout))
+	var mu sync.Mutex
+	errs := make(chan error, len(streams))
+	for i, s := range streams {
+		go func(r io.Reader, prefix string) {
+			errs <- copyLogLines(stdout, &mu, r, prefix, filter.clone())
+		}(s, prefixes[i])
+	}
+	for range streams {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// logContainers maps the arguments, or every service with --all, to
+// container names.
+func logContainers(args []string) ([]string, error) {
+	if len(args) == 0 && !AllServices {
+		return []string{containerName(droneService)}, nil
+	}
+	s, err := loadStack()
+	if err != nil {
+		return nil, err
+	}
+	if AllServices {
+		if len(args) > 0 {
+			return nil, fmt.Errorf("--all can't be combined with services")
+		}
+		args, err = s.order(s.names())
+		if err != nil {
+			return nil, err
+		}
+	}
+	names := make([]string, len(args))
+	for i, arg := range args {
+		if s.Services[arg] != nil {
+			names[i] = containerName(arg)
+		} else {
+			names[i] = arg
+		}
+	}
+	return names, nil
+}
+
+func logOptions(now time.Time) (engine.LogOptions, error) {
+	opts := engine.LogOptions{
+		Follow:     Follow,
+		Tail:       Tail,
+		Timestamps: Timestamps,
+	}
+	if Tail < 0 {
+		return opts, fmt.Errorf("--tail must not be negative")
+	}
+	var err error
+	if opts.Since, err = parseLogTime(Since, now); err != nil {
+		return opts, fmt.Errorf("invalid --since: %v", err)
+	}
+	if opts.Until, err = parseLogTime(Until, now); err != nil {
+		return opts, fmt.Errorf("invalid --until: %v", err)
+	}
+	if !opts.Since.IsZero() && !opts.Until.IsZero() && !opts.Since.Before(opts.Until) {
+		return opts, fmt.Errorf("--since must be before --until")
+	}
+	return opts, nil
+}
+
+// parseLogTime parses a duration before now or a time, the zero time if v
+// is empty.
+func parseLogTime(v string, now time.Time) (time.Time, error) {
+	if v == "" {
+		return time.Time{}, nil
+	}
+	if d, err := time.ParseDuration(v); err == nil {
+		if d < 0 {
+			return time.Time{}, fmt.Errorf("duration %s is negative", v)
+		}
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339Nano, v); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02"} {
+		if t, err := time.ParseInLocation(layout, v, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("%q is neither a duration such as 10m nor a time such as 2019-06-01T12:00:00Z", v)
+}
+
+// logFilter selects log lines by level and pattern.
+type logFilter struct {
+	min  int
+	grep *regexp.Regexp
+	// last is the level of the last line with one, -1 before the first.
+	last int
+}
+
+func newLogFilter(level, grep string) (*logFilter, error) {
+	f := &logFilter{min: -1, last: -1}
+	if level != "" {
+		if f.min = lineLevel(level); f.min < 0 {
+			return nil, fmt.Errorf("invalid --level %q, must be one of %s", level, strings.Join(logLevels, ", "))
+		}
+	}
+	if grep != "" {
+		re, err := regexp.Compile(grep)
+		if err != nil {
+			return nil, fmt.Errorf("invalid --grep: %v", err)
+		}
+		f.grep = re
+	}
+	return f, nil
+}
+
+// clone returns a filter with the same settings for another stream.
+func (f *logFilter) clone() *logFilter {
+	c := *f
+	c.last = -1
+	return &c
+}
+
+func (f *logFilter) match(line string) bool {
+	if l := lineLevel(line); l >= 0 {
+		f.last = l
 	}
-	return containerLogs("/drone")
+	if f.min >= 0 && f.last >= 0 && f.last < f.min {
+		return false
+	}
+	return f.grep == nil || f.grep.MatchString(line)
+}
+
+// lineLevel returns the index in logLevels of the first level in line, or
+// -1 if it has none.
+func lineLevel(line string) int {
+	m := levelRe.FindStringSubmatch(line)
+	if m == nil {
+		return -1
+	}
+	name := strings.ToLower(m[1] + m[2])
+	switch name {
+	case "warning":
+		name = "warn"
+	case "critical", "panic":
+		name = "fatal"
+	}
+	for i, l := range logLevels {
+		if l == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// logPrefixes returns the prefix of the lines of each container, none if
+// there is only one.
+func logPrefixes(names []string, color bool) []string {
+	prefixes := make([]string, len(names))
+	if len(names) < 2 {
+		return prefixes
+	}
+	width := 0
+	for _, n := range names {
+		if len(n) > width {
+			width = len(n)
+		}
+	}
+	for i, n := range names {
+		p := fmt.Sprintf("%-*s", width, n)
+		if color {
+			p = logColors[i%len(logColors)](p)
+		}
+		prefixes[i] = p + " | "
+	}
+	return prefixes
+}
+
+// copyLogLines writes the lines of r that pass filter to w, holding mu for
+// each line so that lines of concurrent streams don't mix.
+func copyLogLines(w io.Writer, mu *sync.Mutex, r io.Reader, prefix string, filter *logFilter) error {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !filter.match(line) {
+			continue
+		}
+		mu.Lock()
+		_, err := fmt.Fprintf(w, "%s%s\n", prefix, line)
+		mu.Unlock()
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
 
+func isTerminal(w io.Writer) bool {
+	f, ok := w.(*os.File)
+	return ok && term.IsTerminal(f.Fd())
 }
 
 func init() {
 	rootCmd.AddCommand(logsCmd)
 
-	logsCmd.PersistentFlags().BoolVarP(&Follow, "follow", "f", false, "Attach and continously output logs")
+	logsCmd.Flags().BoolVarP(&Follow, "follow", "f", false, "Attach and continously output logs")
+	logsCmd.Flags().IntVarP(&Tail, "tail", "n", 0, "Number of lines to show from the end of the logs, all if 0")
+	logsCmd.Flags().StringVar(&Since, "since", "", "Show logs since a duration ago or a time")
+	logsCmd.Flags().StringVar(&Until, "until", "", "Show logs until a duration ago or a time")
+	logsCmd.Flags().BoolVarP(&Timestamps, "timestamps", "t", false, "Prefix lines with the time they were logged")
+	logsCmd.Flags().StringVarP(&LogLevel, "level", "l", "", "Show lines at or above a level: "+strings.Join(logLevels, ", "))
+	logsCmd.Flags().StringVarP(&Grep, "grep", "g", "", "Show lines matching a regular expression")
+	logsCmd.Flags().BoolVarP(&AllServices, "all", "a", false, "Show the logs of every service of the stack")
+	logsCmd.Flags().BoolVar(&NoColor, "no-color", false, "Don't color the service names")
 }
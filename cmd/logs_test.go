@@ -0,0 +1,193 @@
+package cmd
+
+import (
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func resetLogFlags() {
+	Follow, Tail, Since, Until, Timestamps = false, 0, "", "", false
+	LogLevel, Grep, AllServices, NoColor = "", "", false, false
+}
+
+func TestParseLogTime(t *testing.T) {
+	now := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"", time.Time{}},
+		{"10m", now.Add(-10 * time.Minute)},
+		{"1h30m", now.Add(-90 * time.Minute)},
+		{"2019-05-31T08:00:00Z", time.Date(2019, 5, 31, 8, 0, 0, 0, time.UTC)},
+		{"2019-05-31T08:00:00+02:00", time.Date(2019, 5, 31, 6, 0, 0, 0, time.UTC)},
+		{"2019-05-31 08:00:00", time.Date(2019, 5, 31, 8, 0, 0, 0, time.Local)},
+		{"2019-05-31", time.Date(2019, 5, 31, 0, 0, 0, 0, time.Local)},
+	}
+	for _, tt := range tests {
+		got, err := parseLogTime(tt.in, now)
+		if err != nil {
+			t.Errorf("%q: %v", tt.in, err)
+		} else if !got.Equal(tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.in, got, tt.want)
+		}
+	}
+	for _, in := range []string{"-5m", "yesterday", "2019-13-01"} {
+		if _, err := parseLogTime(in, now); err == nil {
+			t.Errorf("%q: expected error", in)
+		}
+	}
+}
+
+func TestLogFilter(t *testing.T) {
+	lines := []string{
+		"starting",
+		"2019-06-01 12:00:00 INFO connected to FCU",
+		"2019-06-01 12:00:01 DEBUG heartbeat",
+		"time=12:00:02 level=warning msg=\"link degraded\"",
+		"[ERROR] mission upload failed",
+		"  at upload.go:42",
+		"[info] mission retried",
+	}
+	filter := func(level, grep string) []string {
+		f, err := newLogFilter(level, grep)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, l := range lines {
+			if f.match(l) {
+				got = append(got, l)
+			}
+		}
+		return got
+	}
+	if got := filter("", ""); len(got) != len(lines) {
+		t.Errorf("unfiltered: got %q", got)
+	}
+	want := []string{lines[0], lines[3], lines[4], lines[5]}
+	if got := filter("warn", ""); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("warn: got %q", got)
+	}
+	want = []string{lines[4], lines[6]}
+	if got := filter("", "(?i)mission"); strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("grep: got %q", got)
+	}
+	if _, err := newLogFilter("verbose", ""); err == nil {
+		t.Error("expected invalid level error")
+	}
+	if _, err := newLogFilter("", "("); err == nil {
+		t.Error("expected invalid grep error")
+	}
+}
+
+func TestLogsOptions(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	defer resetLogFlags()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "INFO one\nERROR two\nINFO three\n")
+	Tail, Since, Timestamps, LogLevel = 2, "1h", true, "error"
+	out.Reset()
+	before := time.Now()
+	if err := runLogs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	after := time.Now()
+	if out.String() != "ERROR two\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+	opts := fake.Get("drone").LogOptions
+	if opts.Tail != 2 || !opts.Timestamps || opts.Since.Before(before.Add(-time.Hour)) || opts.Since.After(after.Add(-time.Hour)) {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	resetLogFlags()
+	Since, Until = "1h", "2h"
+	if err := runLogs(nil, nil); err == nil {
+		t.Error("expected error for --since after --until")
+	}
+	resetLogFlags()
+	Tail = -1
+	if err := runLogs(nil, nil); err == nil {
+		t.Error("expected error for negative --tail")
+	}
+}
+
+func TestLogsMultipleServices(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	defer resetLogFlags()
+
+	writeStack(t, defaultProfile, testStack)
+	if err := runPull(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStart(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "connected to FCU\n")
+	fake.SetOutput("mavros", "FCU: ArduCopter\n")
+	fake.SetOutput("camera", "streaming\n")
+
+	AllServices = true
+	out.Reset()
+	if err := runLogs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	got := strings.Split(strings.TrimSpace(out.String()), "\n")
+	sort.Strings(got)
+	want := []string{"camera | streaming", "drone  | connected to FCU", "mavros | FCU: ArduCopter"}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	if err := runLogs(nil, []string{"drone"}); err == nil {
+		t.Error("expected error for --all with services")
+	}
+
+	AllServices = false
+	out.Reset()
+	if err := runLogs(nil, []string{"mavros"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "FCU: ArduCopter\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestLogsKeptContainer(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	defer resetLogFlags()
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetOutput("drone", "ERROR crashed\n")
+	KeepStopped = true
+	if err := runStopDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("drone"); c == nil || c.Running {
+		t.Fatal("drone not kept")
+	}
+	out.Reset()
+	if err := runLogs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "ERROR crashed\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	outputTable = "table"
+	outputJSON  = "json"
+	outputYAML  = "yaml"
+)
+
+// Exit codes for commands that report state. Errors exit with 1.
+const (
+	exitNotRunning  = 3
+	exitNotLoggedIn = 4
+	exitNoHeartbeat = 5
+	exitArmed       = 6
+)
+
+var Output string
+
+// exitError makes Execute exit with a specific code. A nil Err exits
+// without printing anything, for states the command has already reported.
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func validateOutput() error {
+	switch Output {
+	case outputTable, outputJSON, outputYAML:
+		return nil
+	}
+	return fmt.Errorf("unknown output format %s, use one of: table, json, yaml", Output)
+}
+
+// machineOutput reports whether the output is meant for scripts, in which
+// case messages are written to stderr to keep stdout parseable.
+func machineOutput() bool {
+	return Output == outputJSON || Output == outputYAML
+}
+
+// printResult writes v as JSON or YAML, or calls table to print it for
+// humans.
+func printResult(v interface{}, table func(w io.Writer)) error {
+	switch Output {
+	case outputJSON:
+		out, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(stdout, string(out))
+		return err
+	case outputYAML:
+		out, err := yaml.Marshal(v)
+		if err != nil {
+			return err
+		}
+		_, err = stdout.Write(out)
+		return err
+	}
+	tw := tabwriter.NewWriter(stdout, 0, 4, 2, ' ', 0)
+	table(tw)
+	return tw.Flush()
+}
+
+// messages returns where good, warn and bad write to.
+func messages() io.Writer {
+	if machineOutput() {
+		return stderr
+	}
+	return stdout
+}
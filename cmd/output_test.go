@@ -0,0 +1,129 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+func TestPsJSON(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+	stderr = &bytes.Buffer{}
+	Output = outputJSON
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	if err := runPs(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var result psResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("invalid json %q: %v", out.String(), err)
+	}
+	if len(result.Containers) != 1 || result.Containers[0].Name != "drone" || result.Containers[0].Profile != defaultProfile {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestPsJSONNotRunning(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+	stderr = &bytes.Buffer{}
+	Output = outputJSON
+
+	err := runPs(nil, nil)
+	if exit, ok := err.(*exitError); !ok || exit.Code != exitNotRunning {
+		t.Fatalf("expected not running exit code, got %v", err)
+	}
+	if strings.TrimSpace(out.String()) != `{
+  "containers": []
+}` {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
+
+func TestConfigListYAML(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+	stderr = &bytes.Buffer{}
+	Output = outputYAML
+
+	viper.Set("DRONE_ID", "quad")
+	viper.Set("TOKEN", "secret")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runConfigList(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var settings map[string]interface{}
+	if err := yaml.Unmarshal(out.Bytes(), &settings); err != nil {
+		t.Fatalf("invalid yaml %q: %v", out.String(), err)
+	}
+	if settings["DRONE_ID"] != "quad" || settings["IMAGE"] != "dmc-rpi" {
+		t.Errorf("unexpected settings %v", settings)
+	}
+	if _, ok := settings["TOKEN"]; ok {
+		t.Error("token listed")
+	}
+}
+
+func TestProfileListJSON(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+	Output = outputJSON
+
+	if err := runProfileList(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var result profilesResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("invalid json %q: %v", out.String(), err)
+	}
+	if result.Active != defaultProfile || result.Profiles == nil {
+		t.Errorf("unexpected result %+v", result)
+	}
+}
+
+func TestConfigKeysAligned(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	configKeysCmd.Run(nil, nil)
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != len(configKeys) {
+		t.Fatalf("got %d lines for %d keys", len(lines), len(configKeys))
+	}
+	column := -1
+	for i, line := range lines {
+		at := strings.Index(line, configKeys[i].Description)
+		if column == -1 {
+			column = at
+		}
+		if at != column || at <= len(configKeys[i].Name) {
+			t.Errorf("misaligned line %q", line)
+		}
+	}
+}
+
+func TestConfigGet(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	if err := runConfigGet(nil, []string{"image"}); err != nil {
+		t.Fatal(err)
+	}
+	if out.String() != "dmc-rpi\n" {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
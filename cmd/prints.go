@@ -2,18 +2,27 @@ package cmd
 
 import (
 	"fmt"
+	"io"
+	"os"
 
 	"github.com/manifoldco/promptui"
 )
 
+// stdout is where command output goes and stderr where messages go when the
+// output is for scripts, replaced in tests.
+var (
+	stdout io.Writer = os.Stdout
+	stderr io.Writer = os.Stderr
+)
+
 func good(msg string) {
-	fmt.Println(promptui.IconGood + " " + msg)
+	fmt.Fprintln(messages(), promptui.IconGood+" "+msg)
 }
 
 func warn(msg string) {
-	fmt.Println(promptui.IconWarn + " " + msg)
+	fmt.Fprintln(messages(), promptui.IconWarn+" "+msg)
 }
 
 func bad(msg string) {
-	fmt.Println(promptui.IconBad + " " + msg)
+	fmt.Fprintln(messages(), promptui.IconBad+" "+msg)
 }
@@ -0,0 +1,310 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+)
+
+const (
+	defaultProfile = "default"
+	profileLabel   = "dmctl.profile"
+)
+
+var (
+	Profile string
+
+	profileNameRe = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// profileCmd represents the config profile command
+var profileCmd = &cobra.Command{
+	Use:   "profile",
+	Short: "Manage named configuration profiles",
+	RunE:  runProfileList,
+}
+
+var profileListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists all profiles",
+	Args:  cobra.NoArgs,
+	RunE:  runProfileList,
+}
+
+var profileUseCmd = &cobra.Command{
+	Use:   "use PROFILE",
+	Short: "Sets the active profile",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runProfileUse,
+}
+
+var profileCopyCmd = &cobra.Command{
+	Use:   "copy SOURCE DESTINATION",
+	Short: "Copies a profile",
+	Args:  cobra.ExactArgs(2),
+	RunE:  runProfileCopy,
+}
+
+var profileDeleteCmd = &cobra.Command{
+	Use:   "delete PROFILE",
+	Short: "Deletes a profile",
+	Args:  cobra.ExactArgs(1),
+	RunE:  runProfileDelete,
+}
+
+// profilesResult is the schema of dmctl config profile list --output
+// json|yaml.
+type profilesResult struct {
+	Active   string   `json:"active" yaml:"active"`
+	Profiles []string `json:"profiles" yaml:"profiles"`
+}
+
+func runProfileList(cmd *cobra.Command, args []string) error {
+	names, err := profileNames()
+	if err != nil {
+		return err
+	}
+	if names == nil {
+		names = []string{}
+	}
+	result := profilesResult{Active: activeProfile(), Profiles: names}
+	return printResult(result, func(w io.Writer) {
+		for _, name := range names {
+			if name == result.Active {
+				fmt.Fprintln(w, "* "+name)
+			} else {
+				fmt.Fprintln(w, "  "+name)
+			}
+		}
+	})
+}
+
+func runProfileUse(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	// The default profile is always there, even before it is configured.
+	if name != defaultProfile && !profileExists(name) {
+		return fmt.Errorf("profile %s does not exist, create it with dmctl --profile %s init", name, name)
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	if name == defaultProfile {
+		if err := os.Remove(filepath.Join(dir, "profile")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		good("Using profile " + name)
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "profile"), []byte(name+"\n"), 0600); err != nil {
+		return err
+	}
+	good("Using profile " + name)
+	return nil
+}
+
+func runProfileCopy(cmd *cobra.Command, args []string) error {
+	src, dst := args[0], args[1]
+	for _, name := range args {
+		if err := validateProfile(name); err != nil {
+			return err
+		}
+	}
+	if profileExists(dst) {
+		return fmt.Errorf("profile %s already exists", dst)
+	}
+	srcPath, err := profilePath(src)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(srcPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("profile %s does not exist", src)
+		}
+		return err
+	}
+	dstPath, err := profilePath(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(dstPath, raw, 0600); err != nil {
+		return err
+	}
+	if err := copySecrets(src, dst); err != nil {
+		return err
+	}
+	if err := copyStack(src, dst); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Copied profile %s to %s", src, dst))
+	return nil
+}
+
+func runProfileDelete(cmd *cobra.Command, args []string) error {
+	name := args[0]
+	if err := validateProfile(name); err != nil {
+		return err
+	}
+	path, err := profilePath(name)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return fmt.Errorf("profile %s does not exist", name)
+		}
+		return err
+	}
+	if err := deleteSecrets(name); err != nil {
+		return err
+	}
+	if err := deleteStack(name); err != nil {
+		return err
+	}
+	if name == activeProfile() && name != defaultProfile {
+		dir, err := configDir()
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(filepath.Join(dir, "profile")); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	good("Deleted profile " + name)
+	return nil
+}
+
+// activeProfile returns the profile selected by --profile, DMC_PROFILE or
+// dmctl config profile use, in that order.
+func activeProfile() string {
+	if Profile != "" {
+		return Profile
+	}
+	if env := os.Getenv("DMC_PROFILE"); env != "" {
+		return env
+	}
+	dir, err := configDir()
+	if err != nil {
+		return defaultProfile
+	}
+	raw, err := ioutil.ReadFile(filepath.Join(dir, "profile"))
+	if err != nil {
+		return defaultProfile
+	}
+	if name := strings.TrimSpace(string(raw)); name != "" {
+		return name
+	}
+	return defaultProfile
+}
+
+func validateProfile(name string) error {
+	if !profileNameRe.MatchString(name) {
+		return fmt.Errorf("invalid profile name %q", name)
+	}
+	return nil
+}
+
+// configDir is where everything except the default profile is stored.
+func configDir() (string, error) {
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".dmc"), nil
+}
+
+// profilePath returns the config file of a profile. The default profile
+// lives in ~/.dmc.yaml so existing installations keep working.
+func profilePath(name string) (string, error) {
+	if name == defaultProfile {
+		home, err := homedir.Dir()
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(home, ".dmc.yaml"), nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "profiles", name+".yaml"), nil
+}
+
+func profileExists(name string) bool {
+	path, err := profilePath(name)
+	if err != nil {
+		return false
+	}
+	_, err = os.Stat(path)
+	return err == nil
+}
+
+func profileNames() ([]string, error) {
+	names := []string{defaultProfile}
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(filepath.Join(dir, "profiles"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, errors.Wrap(err, "failed reading profiles")
+	}
+	var named []string
+	for _, f := range files {
+		if f.IsDir() || filepath.Ext(f.Name()) != ".yaml" {
+			continue
+		}
+		named = append(named, strings.TrimSuffix(f.Name(), ".yaml"))
+	}
+	sort.Strings(named)
+	return append(names, named...), nil
+}
+
+// containerName scopes a container name to the active profile so that
+// several profiles can run side by side.
+func containerName(service string) string {
+	if p := activeProfile(); p != defaultProfile {
+		return service + "-" + p
+	}
+	return service
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&Profile, "profile", "p", "", "Configuration profile to use")
+	configCmd.AddCommand(profileCmd)
+	profileCmd.AddCommand(profileListCmd, profileUseCmd, profileCopyCmd, profileDeleteCmd)
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestProfileUseDefault(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	// Only a named profile is configured.
+	Profile = "field"
+	viper.Set("ID", "quad-1")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	Profile = ""
+	if err := runProfileUse(nil, []string{"field"}); err != nil {
+		t.Fatal(err)
+	}
+	if activeProfile() != "field" {
+		t.Fatalf("active profile %s", activeProfile())
+	}
+	if err := runProfileUse(nil, []string{defaultProfile}); err != nil {
+		t.Fatal(err)
+	}
+	if activeProfile() != defaultProfile {
+		t.Errorf("active profile %s", activeProfile())
+	}
+	if err := runProfileUse(nil, []string{"lab"}); err == nil {
+		t.Error("expected missing profile error")
+	}
+}
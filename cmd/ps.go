@@ -18,9 +18,9 @@ package cmd
 import (
 	"context"
 	"fmt"
+	"io"
 	"time"
 
-	"github.com/docker/docker/api/types"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
@@ -32,27 +32,98 @@ var psCmd = &cobra.Command{
 	RunE:  runPs,
 }
 
+// containerStatus is the schema of dmctl ps --output json|yaml.
+type containerStatus struct {
+	Service       string    `json:"service" yaml:"service"`
+	Name          string    `json:"name" yaml:"name"`
+	Profile       string    `json:"profile" yaml:"profile"`
+	Image         string    `json:"image" yaml:"image"`
+	Created       time.Time `json:"created" yaml:"created"`
+	UptimeSeconds int64     `json:"uptime_seconds" yaml:"uptime_seconds"`
+	// DmctlVersion is the version of dmctl that created the container.
+	DmctlVersion string `json:"dmctl_version,omitempty" yaml:"dmctl_version,omitempty"`
+	// Drift is why the container doesn't match the current configuration.
+	Drift string `json:"drift,omitempty" yaml:"drift,omitempty"`
+}
+
+type psResult struct {
+	Containers []containerStatus `json:"containers" yaml:"containers"`
+}
+
+// runPs lists the running services of the stack. It exits with
+// exitNotRunning if the drone container isn't running.
 func runPs(cmd *cobra.Command, args []string) error {
-	containers, err := dockerClient.ContainerList(context.Background(), types.ContainerListOptions{})
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return errNoImage
+	}
+	s, err := loadStack()
 	if err != nil {
 		return err
 	}
-	if len(containers) == 0 {
-		bad("No containers running!")
-		return nil
+	order, err := s.order(s.names())
+	if err != nil {
+		return err
 	}
-	img := viper.GetString("IMAGE")
-	if img == "" {
-		return errNoImage
+	result := psResult{Containers: []containerStatus{}}
+	running := map[string]bool{}
+	for _, name := range order {
+		c, err := findContainer(context.Background(), containerName(name))
+		if err != nil {
+			return err
+		}
+		if c == nil {
+			continue
+		}
+		running[name] = true
+		result.Containers = append(result.Containers, containerStatus{
+			Service:       name,
+			Name:          c.Name,
+			Profile:       c.Labels[profileLabel],
+			Image:         c.Image,
+			Created:       c.Created,
+			UptimeSeconds: int64(time.Since(c.Created).Seconds()),
+			DmctlVersion:  c.Labels[versionLabel],
+			Drift:         serviceDrift(s, name, c.Labels),
+		})
 	}
-	for _, c := range containers {
-		if c.Image == imageBase+img {
-			good(fmt.Sprintf("Running for %s", time.Since(time.Unix(c.Created, 0)).Truncate(time.Second)))
+	err = printResult(result, func(w io.Writer) {
+		if len(result.Containers) == 0 {
+			bad("No containers running!")
+			return
 		}
+		if len(order) == 1 {
+			good(fmt.Sprintf("Running for %s", time.Since(result.Containers[0].Created).Truncate(time.Second)))
+			warnDrift(result.Containers[0])
+			return
+		}
+		i := 0
+		for _, name := range order {
+			if !running[name] {
+				bad(name + " not running")
+				continue
+			}
+			c := result.Containers[i]
+			i++
+			good(fmt.Sprintf("%s running for %s", name, time.Since(c.Created).Truncate(time.Second)))
+			warnDrift(c)
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if !running[droneService] {
+		return &exitError{Code: exitNotRunning}
 	}
 	return nil
 }
 
+func warnDrift(c containerStatus) {
+	if c.Drift != "" {
+		warn(fmt.Sprintf("%s doesn't match the current configuration, %s. Run dmctl start --recreate to apply it", c.Name, c.Drift))
+	}
+}
+
 func init() {
 	rootCmd.AddCommand(psCmd)
 }
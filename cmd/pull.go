@@ -16,23 +16,28 @@ limitations under the License.
 package cmd
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"strings"
 
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
 var (
+	ImageVersion string
+
 	errNoImage = errors.New("OBC not configured, select version by running dmctl config obc")
 )
 
 // pullCmd represents the pull command
 var pullCmd = &cobra.Command{
-	Use:   "pull",
+	Use:   "pull [SERVICE...]",
 	Short: "Download latest image versions",
-	RunE: func(cmd *cobra.Command, args []string) error {
-		return runPullDrone(cmd, args)
-	},
+	Long: `Pulls the images of the stack, or only of the given services and the
+services they depend on. --version only applies to the drone image.`,
+	RunE: runPull,
 }
 
 // pullDrone represents the pull drone command
@@ -42,15 +47,90 @@ var pullDrone = &cobra.Command{
 	RunE:  runPullDrone,
 }
 
+func runPull(cmd *cobra.Command, args []string) error {
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	names := args
+	if len(names) == 0 {
+		names = s.names()
+	}
+	order, err := s.order(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		if err := pullService(s, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func runPullDrone(cmd *cobra.Command, args []string) error {
 	img := viper.GetString("IMAGE")
 	if img == "" {
 		return errNoImage
 	}
-	return pullImage("drone", img)
+	if ImageVersion != "" {
+		viper.Set("IMAGE_VERSION", ImageVersion)
+	}
+	ref := imageBase() + img + ":" + imageVersion()
+	if err := pullImage("drone", ref); err != nil {
+		return err
+	}
+	return pinDigest(ref)
+}
+
+// pinDigest records the digest ref was resolved to, so that start keeps
+// running exactly that image until the next pull.
+func pinDigest(ref string) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	digest, err := eng.ImageDigest(context.Background(), ref)
+	if err != nil {
+		warn(fmt.Sprintf("Could not resolve digest of %s, start will use the tag: %s", ref, err))
+		viper.Set("IMAGE_DIGEST", "")
+		return writeConfig()
+	}
+	if old := viper.GetString("IMAGE_DIGEST"); old != "" && old != digest {
+		fmt.Fprintf(stdout, "Updated drone from %s to %s\n", shortDigest(old), shortDigest(digest))
+	}
+	viper.Set("IMAGE_DIGEST", digest)
+	return writeConfig()
+}
+
+// droneImage returns the reference the drone container runs: the pinned
+// digest if one has been recorded, otherwise the configured version.
+func droneImage(imageName string) string {
+	ref := imageBase() + imageName
+	if digest := viper.GetString("IMAGE_DIGEST"); digest != "" {
+		return ref + "@" + digest
+	}
+	return ref + ":" + imageVersion()
+}
+
+func imageVersion() string {
+	if v := viper.GetString("IMAGE_VERSION"); v != "" {
+		return v
+	}
+	return "latest"
+}
+
+func shortDigest(digest string) string {
+	digest = strings.TrimPrefix(digest, "sha256:")
+	if len(digest) > 12 {
+		return digest[:12]
+	}
+	return digest
 }
 
 func init() {
 	rootCmd.AddCommand(pullCmd)
 	pullCmd.AddCommand(pullDrone)
+
+	pullCmd.PersistentFlags().StringVar(&ImageVersion, "version", "", "Image version to pull and pin (default configured version)")
 }
@@ -0,0 +1,197 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/airpelago/dmctl/registry"
+	"github.com/manifoldco/promptui"
+	homedir "github.com/mitchellh/go-homedir"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const defaultNamespace = "tobiasfriden"
+
+var (
+	registryUsername      string
+	registryPasswordStdin bool
+)
+
+// registryCmd represents the registry command
+var registryCmd = &cobra.Command{
+	Use:   "registry",
+	Short: "Manage credentials for the image registry",
+}
+
+var registryLoginCmd = &cobra.Command{
+	Use:   "login [REGISTRY]",
+	Short: "Stores credentials for a registry (default configured registry)",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runRegistryLogin,
+}
+
+var registryLogoutCmd = &cobra.Command{
+	Use:   "logout [REGISTRY]",
+	Short: "Removes the credentials stored for a registry by dmctl",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runRegistryLogout,
+}
+
+func runRegistryLogin(cmd *cobra.Command, args []string) error {
+	host := registryHost()
+	if len(args) == 1 {
+		host = args[0]
+	}
+	if err := validateRegistry(host); err != nil {
+		return err
+	}
+	if NonInteractive && (registryUsername == "" || !registryPasswordStdin) {
+		return errors.New("use --username and --password-stdin in non-interactive mode")
+	}
+	username, err := promptValue(registryUsername, &promptui.Prompt{
+		Label: "Username",
+	})
+	if err != nil {
+		return err
+	}
+	password, err := readPassword(registryPasswordStdin)
+	if err != nil {
+		return err
+	}
+	creds := &registry.Credentials{Username: username, Password: password}
+
+	client := &registry.Client{HTTPClient: httpClient, Credentials: creds}
+	if err := client.Ping(context.Background(), host); err != nil {
+		return errors.Wrap(err, "login failed")
+	}
+	path, err := registryAuthPath()
+	if err != nil {
+		return err
+	}
+	auth, err := registry.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	auth.Set(host, creds)
+	if err := auth.Save(); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Logged in to %s", host))
+	return nil
+}
+
+func runRegistryLogout(cmd *cobra.Command, args []string) error {
+	host := registryHost()
+	if len(args) == 1 {
+		host = args[0]
+	}
+	path, err := registryAuthPath()
+	if err != nil {
+		return err
+	}
+	auth, err := registry.LoadConfigFile(path)
+	if err != nil {
+		return err
+	}
+	if !auth.Remove(host) {
+		bad(fmt.Sprintf("Not logged in to %s", host))
+		return nil
+	}
+	if err := auth.Save(); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Logged out of %s", host))
+	return nil
+}
+
+// registryHost returns the registry images are pulled from.
+func registryHost() string {
+	if host := viper.GetString("REGISTRY"); host != "" {
+		return host
+	}
+	return registry.DefaultRegistry
+}
+
+// imageBase returns the registry and namespace that image names are
+// relative to, such as docker.io/tobiasfriden/.
+func imageBase() string {
+	namespace := viper.GetString("NAMESPACE")
+	if namespace == "" {
+		namespace = defaultNamespace
+	}
+	return registryHost() + "/" + strings.Trim(namespace, "/") + "/"
+}
+
+// registryCredentials returns the credentials for a registry stored by
+// dmctl registry login, falling back to those of docker login. It returns nil
+// if there are none.
+func registryCredentials(host string) (*registry.Credentials, error) {
+	path, err := registryAuthPath()
+	if err != nil {
+		return nil, err
+	}
+	paths := []string{path}
+	if path, err := dockerConfigPath(); err == nil {
+		paths = append(paths, path)
+	}
+	for _, path := range paths {
+		auth, err := registry.LoadConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		creds, err := auth.Credentials(host)
+		if err != nil || creds != nil {
+			return creds, err
+		}
+	}
+	return nil, nil
+}
+
+// registryAuthPath returns the file dmctl registry login stores credentials
+// in. It is shared by all profiles, like docker's.
+func registryAuthPath() (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "auth.json"), nil
+}
+
+func dockerConfigPath() (string, error) {
+	if dir := os.Getenv("DOCKER_CONFIG"); dir != "" {
+		return filepath.Join(dir, "config.json"), nil
+	}
+	home, err := homedir.Dir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(home, ".docker", "config.json"), nil
+}
+
+func init() {
+	rootCmd.AddCommand(registryCmd)
+	registryCmd.AddCommand(registryLoginCmd, registryLogoutCmd)
+
+	registryLoginCmd.Flags().StringVarP(&registryUsername, "username", "u", "", "Registry user name")
+	registryLoginCmd.Flags().BoolVar(&registryPasswordStdin, "password-stdin", false, "Read registry password from stdin")
+}
@@ -0,0 +1,43 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+// restartCmd represents the restart command
+var restartCmd = &cobra.Command{
+	Use:   "restart [SERVICE...]",
+	Short: "Restart dmc containers",
+	Long: `Stops the services of the stack, or only the given services, like
+dmctl stop and starts them again with the current configuration, like
+dmctl start.`,
+	RunE: runRestart,
+}
+
+func runRestart(cmd *cobra.Command, args []string) error {
+	if err := runStopStack(cmd, args); err != nil {
+		return err
+	}
+	return runStart(cmd, args)
+}
+
+func init() {
+	rootCmd.AddCommand(restartCmd)
+
+	restartCmd.Flags().DurationVarP(&StopTimeout, "time", "t", 0, "How long containers get to exit before they are killed (default STOP_TIMEOUT or 10s)")
+}
@@ -0,0 +1,112 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	RmForce   bool
+	RmForeign bool
+)
+
+// rmCmd represents the rm command
+var rmCmd = &cobra.Command{
+	Use:   "rm [SERVICE...]",
+	Short: "Remove stopped dmc containers",
+	Long: `Removes the containers of the services of the stack, or of the given
+services, that were kept by dmctl stop --keep or exited. Running containers
+are only stopped and removed with --force, and containers that dmctl didn't
+create only with --force-foreign.`,
+	RunE: runRm,
+}
+
+func runRm(cmd *cobra.Command, args []string) error {
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	if _, err := s.order(args); err != nil {
+		return err
+	}
+	order, err := s.order(s.names())
+	if err != nil {
+		return err
+	}
+	remove := map[string]bool{}
+	for _, name := range args {
+		remove[name] = true
+	}
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	removed := 0
+	for i := len(order) - 1; i >= 0; i-- {
+		if len(args) > 0 && !remove[order[i]] {
+			continue
+		}
+		name := containerName(order[i])
+		state, err := eng.Inspect(ctx, name)
+		if err != nil {
+			if len(args) > 0 {
+				bad(fmt.Sprintf("Container %s not found", name))
+			}
+			continue
+		}
+		if state.Labels[profileLabel] != activeProfile() && !RmForeign {
+			if len(args) > 0 {
+				return fmt.Errorf("%s wasn't created by dmctl, pass --force-foreign to remove it", name)
+			}
+			warn(fmt.Sprintf("Skipping %s, it wasn't created by dmctl", name))
+			continue
+		}
+		if state.Running {
+			if !RmForce {
+				return fmt.Errorf("%s is running, stop it first or pass --force", name)
+			}
+			if err := checkArmed("stop " + name); err != nil {
+				return err
+			}
+			fmt.Fprintf(stdout, "Stopping %s..\n", name)
+			if err := eng.Stop(ctx, state.ID, stopTimeout()); err != nil {
+				return err
+			}
+		}
+		if err := removeContainer(ctx, state.ID, name); err != nil {
+			return fmt.Errorf("failed removing %s: %s", name, err)
+		}
+		good(fmt.Sprintf("Removed %s", name))
+		removed++
+	}
+	if removed == 0 && len(args) == 0 {
+		bad("No containers to remove")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(rmCmd)
+
+	rmCmd.Flags().BoolVarP(&RmForce, "force", "f", false, "Stop and remove running containers")
+	rmCmd.Flags().BoolVar(&RmForeign, "force-foreign", false, "Also remove containers with the name of a service that dmctl didn't create")
+	rmCmd.Flags().DurationVarP(&StopTimeout, "time", "t", 0, "How long containers get to exit before they are killed (default STOP_TIMEOUT or 10s)")
+}
@@ -18,14 +18,23 @@ package cmd
 import (
 	"fmt"
 	"os"
+	"strings"
 
+	"github.com/airpelago/dmctl/engine"
 	"github.com/spf13/cobra"
 
 	"github.com/mitchellh/go-homedir"
 	"github.com/spf13/viper"
 )
 
-var Verbose bool
+var (
+	Verbose        bool
+	NonInteractive bool
+
+	// Version is set when building releases with
+	// -ldflags "-X github.com/airpelago/dmctl/cmd.Version=VERSION".
+	Version = "dev"
+)
 
 // rootCmd represents the base command when called without any subcommands
 var rootCmd = &cobra.Command{
@@ -37,13 +46,25 @@ To perform initial configuration and start the drone software, run:
 
   dmctl init
   `,
+	Version:       Version,
 	SilenceErrors: true,
+	// Flags and arguments have been validated by now, errors from here on
+	// are not usage errors.
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {
+		cmd.SilenceUsage = true
+	},
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
 // This is called by main.main(). It only needs to happen once to the rootCmd.
 func Execute() {
 	if err := rootCmd.Execute(); err != nil {
+		if exit, ok := err.(*exitError); ok {
+			if exit.Err != nil {
+				bad(exit.Err.Error())
+			}
+			os.Exit(exit.Code)
+		}
 		bad(err.Error())
 		os.Exit(1)
 	}
@@ -52,23 +73,49 @@ func Execute() {
 func init() {
 	cobra.OnInitialize(initConfig)
 	rootCmd.PersistentFlags().BoolVarP(&Verbose, "verbose", "v", false, "Show verbose output")
+	rootCmd.PersistentFlags().StringVarP(&Output, "output", "o", outputTable, "Output format, one of: table, json, yaml")
+	rootCmd.PersistentFlags().BoolVar(&NonInteractive, "non-interactive", false, "Fail on missing values instead of prompting")
+	rootCmd.PersistentFlags().StringVar(&APIURL, "api-url", "", "Backend API url (default "+defaultAPIURL+")")
+	rootCmd.PersistentFlags().StringVar(&Runtime, "runtime", "", "Container runtime, one of: "+strings.Join(engine.Runtimes, ", ")+" (default detected)")
 }
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
-	// Find home directory.
-	home, err := homedir.Dir()
-	if err != nil {
-		fmt.Println(err)
+	if err := validateOutput(); err != nil {
+		bad(err.Error())
 		os.Exit(1)
 	}
+	profile := activeProfile()
+	if err := validateProfile(profile); err != nil {
+		bad(err.Error())
+		os.Exit(1)
+	}
+	if profile == defaultProfile {
+		// Find home directory.
+		home, err := homedir.Dir()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
 
-	// Search config in home directory with name ".dmc" (without extension).
-	viper.AddConfigPath(home)
-	viper.SetConfigName(".dmc")
+		// Search config in home directory with name ".dmc" (without extension).
+		viper.AddConfigPath(home)
+		viper.SetConfigName(".dmc")
+	} else {
+		path, err := profilePath(profile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		viper.SetConfigFile(path)
+	}
 
 	viper.AutomaticEnv() // read in environment variables that match
 
 	// If a config file is found, read it in.
 	viper.ReadInConfig()
+
+	if err := loadSecrets(); err != nil {
+		warn(fmt.Sprintf("Could not read secrets: %s", err))
+	}
 }
@@ -0,0 +1,264 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/airpelago/dmctl/secrets"
+	"github.com/spf13/viper"
+	"gopkg.in/yaml.v2"
+)
+
+// secretKeys are settings kept in the secret store instead of the config
+// file.
+var secretKeys = []string{"PASSWORD", "TOKEN"}
+
+var secretStore secrets.Store
+
+// secretStoreKind is the kind of secretStore, keyring or file.
+var secretStoreKind string
+
+// secretsErr is set when secrets saved to the store couldn't be read, which
+// the drone can't be started without.
+var secretsErr error
+
+// getSecretStore returns the store selected by SECRET_STORE: the OS keyring,
+// an encrypted file in the config directory, or by default the keyring if
+// one is reachable and the file otherwise. The default is resolved once and
+// saved with the config, so that a later run without the keyring, like one
+// from a systemd unit, doesn't silently use the file.
+func getSecretStore() (secrets.Store, error) {
+	if secretStore != nil {
+		return secretStore, nil
+	}
+	kind := viper.GetString("SECRET_STORE")
+	if kind == "" || kind == "auto" || kind == "keyring" {
+		keyring, err := secrets.NewKeyring("dmctl")
+		if err == nil {
+			secretStore = keyring
+			secretStoreKind = "keyring"
+			return secretStore, nil
+		}
+		if kind == "keyring" {
+			return nil, err
+		}
+	}
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	secretStore = secrets.NewFileStore(filepath.Join(dir, "secrets"), filepath.Join(dir, "secrets.key"))
+	secretStoreKind = "file"
+	return secretStore, nil
+}
+
+func secretName(profile, key string) string {
+	return profile + "/" + key
+}
+
+func isSecret(key string) bool {
+	for _, k := range secretKeys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// isStored reports whether the config says a secret was saved to the store.
+func isStored(key string) bool {
+	for _, k := range strings.Split(viper.GetString("STORED_SECRETS"), ",") {
+		if k == key {
+			return true
+		}
+	}
+	return false
+}
+
+// loadSecrets makes the secrets of the active profile available through
+// viper, unless they are overridden by the environment. Secrets still in
+// the config file from older versions are moved to the store. Secrets that
+// were saved but can't be read are an error, also kept in secretsErr.
+func loadSecrets() error {
+	secretsErr = readSecrets()
+	return secretsErr
+}
+
+func readSecrets() error {
+	migrate := false
+	for _, key := range secretKeys {
+		if viper.InConfig(strings.ToLower(key)) {
+			migrate = true
+		}
+	}
+	if migrate {
+		return writeConfig()
+	}
+	store, err := getSecretStore()
+	if err != nil {
+		return err
+	}
+	var missing []string
+	for _, key := range secretKeys {
+		if viper.IsSet(key) {
+			continue
+		}
+		value, err := store.Get(secretName(activeProfile(), key))
+		if err == secrets.ErrNotFound {
+			if isStored(key) {
+				missing = append(missing, key)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		viper.Set(key, value)
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s saved but not found in the %s store, run dmctl as the user that saved it or set it again", strings.Join(missing, ", "), secretStoreKind)
+	}
+	return nil
+}
+
+// secretFromEnv reports whether the value of a secret comes from the
+// environment, which is only meant to last for one run.
+func secretFromEnv(key string) bool {
+	env, ok := os.LookupEnv(key)
+	return ok && viper.GetString(key) == env
+}
+
+// writeConfig writes the settings of the active profile to its config file,
+// readable only by the owner, and the secrets that weren't given through the
+// environment to the secret store.
+func writeConfig() error {
+	path, err := configFile()
+	if err != nil {
+		return err
+	}
+	store, err := getSecretStore()
+	if err != nil {
+		return err
+	}
+	if kind := viper.GetString("SECRET_STORE"); (kind == "" || kind == "auto") && secretStoreKind != "" {
+		viper.Set("SECRET_STORE", secretStoreKind)
+	}
+	var stored []string
+	for _, key := range secretKeys {
+		if secretFromEnv(key) {
+			if isStored(key) {
+				stored = append(stored, key)
+			}
+			continue
+		}
+		name := secretName(activeProfile(), key)
+		if value := viper.GetString(key); value != "" {
+			err = store.Set(name, value)
+			stored = append(stored, key)
+		} else {
+			err = store.Delete(name)
+		}
+		if err != nil {
+			return fmt.Errorf("could not store %s: %s", key, err)
+		}
+	}
+	viper.Set("STORED_SECRETS", strings.Join(stored, ","))
+	settings := viper.AllSettings()
+	for _, key := range secretKeys {
+		delete(settings, strings.ToLower(key))
+	}
+	out, err := yaml.Marshal(settings)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(path, out, 0600); err != nil {
+		return err
+	}
+	// WriteFile keeps the mode of existing files, which used to be created
+	// world-readable.
+	return os.Chmod(path, 0600)
+}
+
+// deleteSecrets removes all secrets of a profile.
+func deleteSecrets(profile string) error {
+	store, err := getSecretStore()
+	if err != nil {
+		return err
+	}
+	for _, key := range secretKeys {
+		if err := store.Delete(secretName(profile, key)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// moveSecrets moves the secrets of profile from one store to another. They
+// are deleted before they are stored, so that it also works when both are
+// the same store, and put back if storing fails.
+func moveSecrets(from, to secrets.Store, profile string) error {
+	values := map[string]string{}
+	for _, key := range secretKeys {
+		value, err := from.Get(secretName(profile, key))
+		if err == secrets.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		values[key] = value
+	}
+	for key := range values {
+		if err := from.Delete(secretName(profile, key)); err != nil {
+			return err
+		}
+	}
+	for key, value := range values {
+		if err := to.Set(secretName(profile, key), value); err != nil {
+			for key, value := range values {
+				from.Set(secretName(profile, key), value)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copySecrets copies the secrets of profile src to dst.
+func copySecrets(src, dst string) error {
+	store, err := getSecretStore()
+	if err != nil {
+		return err
+	}
+	for _, key := range secretKeys {
+		value, err := store.Get(secretName(src, key))
+		if err == secrets.ErrNotFound {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if err := store.Set(secretName(dst, key), value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/airpelago/dmctl/secrets"
+	"github.com/spf13/viper"
+)
+
+func TestWriteConfigSkipsEnvSecrets(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	store, _ := getSecretStore()
+	name := secretName(defaultProfile, "PASSWORD")
+	viper.Set("PASSWORD", "stored")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A fresh run with the password given through the environment.
+	viper.Reset()
+	viper.AutomaticEnv()
+	viper.Set("IMAGE", "dmc-rpi")
+	os.Setenv("PASSWORD", "from-env")
+	defer os.Unsetenv("PASSWORD")
+	if err := loadSecrets(); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("PASSWORD") != "from-env" {
+		t.Fatalf("environment not used, got %s", viper.GetString("PASSWORD"))
+	}
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := store.Get(name); err != nil || got != "stored" {
+		t.Errorf("stored password replaced by the environment: %s, %v", got, err)
+	}
+}
+
+func TestSetSecretStoreMovesSecrets(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	old, _ := getSecretStore()
+	viper.Set("PASSWORD", "verification-key")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := runConfigSet(nil, []string{"SECRET_STORE", "file"}); err != nil {
+		t.Fatal(err)
+	}
+	name := secretName(defaultProfile, "PASSWORD")
+	if _, err := old.Get(name); err != secrets.ErrNotFound {
+		t.Errorf("password left in the old store: %v", err)
+	}
+	dir, err := configDir()
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := secrets.NewFileStore(filepath.Join(dir, "secrets"), filepath.Join(dir, "secrets.key"))
+	if got, err := store.Get(name); err != nil || got != "verification-key" {
+		t.Errorf("password not moved: %s, %v", got, err)
+	}
+}
+
+func TestWriteConfigSavesResolvedStore(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("SECRET_STORE", "auto")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("SECRET_STORE"); got != "file" {
+		t.Errorf("SECRET_STORE not resolved, got %q", got)
+	}
+}
+
+func TestMissingStoredSecret(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("ID", "drone-1")
+	viper.Set("PASSWORD", "verification-key")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	path, err := configFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A later run whose store doesn't have the password, like one as
+	// another user.
+	store, _ := getSecretStore()
+	store.Delete(secretName(defaultProfile, "PASSWORD"))
+	viper.Reset()
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSecrets(); err == nil || !strings.Contains(err.Error(), "PASSWORD") {
+		t.Fatalf("missing password not reported: %v", err)
+	}
+	if _, _, err := droneSpec(); err == nil {
+		t.Error("drone spec built without the password")
+	}
+}
+
+func TestUnsetStoredSecret(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	viper.Set("PASSWORD", "verification-key")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runConfigUnset(nil, []string{"PASSWORD"}); err != nil {
+		t.Fatal(err)
+	}
+	path, err := configFile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	viper.Reset()
+	viper.SetConfigFile(path)
+	if err := viper.ReadInConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := loadSecrets(); err != nil {
+		t.Errorf("unset password reported missing: %v", err)
+	}
+	store, _ := getSecretStore()
+	if _, err := store.Get(secretName(defaultProfile, "PASSWORD")); err != secrets.ErrNotFound {
+		t.Errorf("password left in the store: %v", err)
+	}
+}
@@ -0,0 +1,422 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	ServiceDevice string
+
+	systemdDir    = "/etc/systemd/system"
+	serviceEnvDir = "/etc/dmctl"
+)
+
+// serviceCmd represents the service command
+var serviceCmd = &cobra.Command{
+	Use:   "service",
+	Short: "Manage the drone container as a systemd service",
+}
+
+var serviceInstallCmd = &cobra.Command{
+	Use:   "install",
+	Short: "Installs and starts a systemd service running the drone container",
+	Args:  cobra.NoArgs,
+	RunE:  runServiceInstall,
+}
+
+var serviceUninstallCmd = &cobra.Command{
+	Use:   "uninstall",
+	Short: "Stops and removes the drone systemd service",
+	Args:  cobra.NoArgs,
+	RunE:  runServiceUninstall,
+}
+
+var serviceStatusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Shows the status of the drone systemd service",
+	Args:  cobra.NoArgs,
+	RunE:  runServiceStatus,
+}
+
+func runServiceInstall(cmd *cobra.Command, args []string) error {
+	img, spec, err := droneSpec()
+	if err != nil {
+		return err
+	}
+	name := containerName("drone")
+	prepareSpec(name, img, spec)
+
+	runtime := runtimeName()
+	if runtime == "" {
+		runtime = engine.Detect()
+	}
+	envFile := filepath.Join(serviceEnvDir, name+".env")
+	cmds, err := engine.NewServiceCommands(runtime, spec, envFile)
+	if err != nil {
+		return err
+	}
+	device := ServiceDevice
+	if device == "" {
+		device = serialDevice(viper.GetString("FCU_URL"))
+	}
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	var helpers []serviceHelper
+	if routerEnabled() {
+		// The router holds the FCU link, so it is the one bound to the
+		// device.
+		helpers = append(helpers, serviceHelper{
+			name: containerName("router"),
+			unit: serviceHelperUnit("MAVLink router", []string{exe, "--profile", activeProfile(), "fcu", "router"}, device),
+		})
+		device = ""
+	}
+	if viper.GetBool("LOG_ARCHIVE") {
+		helpers = append(helpers, serviceHelper{
+			name: containerName("archiver"),
+			unit: serviceHelperUnit("log archiver", []string{exe, "--profile", activeProfile(), "logs", "archive", "run"}, ""),
+		})
+	}
+	unit := serviceUnit(name, exe, cmds, device)
+
+	// A container started by dmctl start would be restarted by the runtime
+	// alongside the one run by systemd.
+	if running, err := containerRunning(name); err != nil {
+		return err
+	} else if running {
+		if err := stopContainer(name, false); err != nil {
+			return err
+		}
+	}
+
+	if err := os.MkdirAll(serviceEnvDir, 0700); err != nil {
+		return err
+	}
+	env := strings.Join(spec.Env, "\n") + "\n"
+	if err := ioutil.WriteFile(envFile, []byte(env), 0600); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(serviceUnitPath(name), []byte(unit), 0644); err != nil {
+		return err
+	}
+	for _, h := range helpers {
+		if err := ioutil.WriteFile(serviceUnitPath(h.name), []byte(h.unit), 0644); err != nil {
+			return err
+		}
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	for _, h := range helpers {
+		if err := enableUnit(serviceUnitName(h.name)); err != nil {
+			return err
+		}
+		good(fmt.Sprintf("Installed %s", serviceUnitName(h.name)))
+	}
+	if err := enableUnit(serviceUnitName(name)); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Installed %s", serviceUnitName(name)))
+	return nil
+}
+
+func runServiceUninstall(cmd *cobra.Command, args []string) error {
+	if _, err := os.Stat(serviceUnitPath(containerName("drone"))); err == nil {
+		if err := checkArmed("uninstall " + serviceUnitName(containerName("drone"))); err != nil {
+			return err
+		}
+	}
+	for _, helper := range []string{containerName("router"), containerName("archiver")} {
+		if _, err := os.Stat(serviceUnitPath(helper)); err != nil {
+			continue
+		}
+		if err := systemctl("disable", "--now", serviceUnitName(helper)); err != nil {
+			return err
+		}
+		if err := os.Remove(serviceUnitPath(helper)); err != nil {
+			return err
+		}
+		good(fmt.Sprintf("Uninstalled %s", serviceUnitName(helper)))
+	}
+	name := containerName("drone")
+	path := serviceUnitPath(name)
+	if _, err := os.Stat(path); os.IsNotExist(err) {
+		bad(serviceUnitName(name) + " not installed")
+		return nil
+	}
+	if err := systemctl("disable", "--now", serviceUnitName(name)); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(serviceEnvDir, name+".env")); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err := systemctl("daemon-reload"); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Uninstalled %s", serviceUnitName(name)))
+	return nil
+}
+
+// serviceStatus is the schema of dmctl service status --output json|yaml.
+type serviceStatus struct {
+	Unit        string `json:"unit" yaml:"unit"`
+	Installed   bool   `json:"installed" yaml:"installed"`
+	Enabled     bool   `json:"enabled" yaml:"enabled"`
+	ActiveState string `json:"active_state" yaml:"active_state"`
+	SubState    string `json:"sub_state" yaml:"sub_state"`
+	MainPID     int    `json:"main_pid" yaml:"main_pid"`
+}
+
+// runServiceStatus exits with exitNotRunning unless the service is active.
+func runServiceStatus(cmd *cobra.Command, args []string) error {
+	name := containerName("drone")
+	status := serviceStatus{Unit: serviceUnitName(name)}
+	if _, err := os.Stat(serviceUnitPath(name)); os.IsNotExist(err) {
+		bad(serviceUnitName(name) + " not installed")
+		if machineOutput() {
+			if err := printResult(status, nil); err != nil {
+				return err
+			}
+		}
+		return &exitError{Code: exitNotRunning}
+	}
+	status.Installed = true
+
+	if !machineOutput() {
+		err := systemctl("status", "--no-pager", serviceUnitName(name))
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 3 {
+			// systemctl status exits with 3 when the unit is not active.
+			return &exitError{Code: exitNotRunning}
+		}
+		return err
+	}
+
+	c := exec.Command("systemctl", "show", "--property=UnitFileState,ActiveState,SubState,MainPID", serviceUnitName(name))
+	c.Stderr = os.Stderr
+	out, err := c.Output()
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		parts := strings.SplitN(line, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		switch parts[0] {
+		case "UnitFileState":
+			status.Enabled = parts[1] == "enabled"
+		case "ActiveState":
+			status.ActiveState = parts[1]
+		case "SubState":
+			status.SubState = parts[1]
+		case "MainPID":
+			status.MainPID, _ = strconv.Atoi(parts[1])
+		}
+	}
+	if err := printResult(status, nil); err != nil {
+		return err
+	}
+	if status.ActiveState != "active" {
+		return &exitError{Code: exitNotRunning}
+	}
+	return nil
+}
+
+func serviceUnitName(name string) string {
+	return "dmctl-" + name + ".service"
+}
+
+func serviceUnitPath(name string) string {
+	return filepath.Join(systemdDir, serviceUnitName(name))
+}
+
+// serviceUnit renders the systemd unit running a container under dmctl
+// service supervise, which feeds the watchdog while the container runs. If
+// device is set the service is bound to it, so that it starts once the FCU is
+// plugged in and stops when it disappears.
+func serviceUnit(name, exe string, cmds *engine.ServiceCommands, device string) string {
+	var after, requires []string
+	if cmds.Requires != "" {
+		after = append(after, cmds.Requires)
+		requires = append(requires, cmds.Requires)
+	}
+	after = append(after, "network-online.target")
+	var bindsTo string
+	if device != "" {
+		bindsTo = deviceUnit(device)
+		after = append(after, bindsTo)
+	}
+
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "[Unit]")
+	fmt.Fprintf(&b, "Description=Drone Mission Control onboard software (%s)\n", name)
+	fmt.Fprintln(&b, "Wants=network-online.target")
+	fmt.Fprintf(&b, "After=%s\n", strings.Join(after, " "))
+	if len(requires) > 0 {
+		fmt.Fprintf(&b, "Requires=%s\n", strings.Join(requires, " "))
+	}
+	if bindsTo != "" {
+		fmt.Fprintf(&b, "BindsTo=%s\n", bindsTo)
+	}
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Service]")
+	fmt.Fprintln(&b, "Type=notify")
+	fmt.Fprintf(&b, "ExecStartPre=-%s\n", execLine(cmds.Cleanup))
+	supervise := []string{exe, "--profile", activeProfile(), "service", "supervise", name, "--"}
+	fmt.Fprintf(&b, "ExecStart=%s\n", execLine(append(supervise, cmds.Run...)))
+	fmt.Fprintf(&b, "ExecStop=%s\n", execLine(cmds.Stop))
+	// The image may have to be pulled before the container runs.
+	fmt.Fprintln(&b, "TimeoutStartSec=15min")
+	fmt.Fprintf(&b, "WatchdogSec=%d\n", watchdogSec)
+	if cmds.StopTimeout > 0 {
+		// Leave the runtime time to kill the container before systemd does.
+		fmt.Fprintf(&b, "TimeoutStopSec=%d\n", int(cmds.StopTimeout.Seconds())+10)
+	}
+	fmt.Fprintln(&b, "Restart=always")
+	fmt.Fprintln(&b, "RestartSec=5")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Install]")
+	fmt.Fprintln(&b, "WantedBy=multi-user.target")
+	return b.String()
+}
+
+// serviceHelper is a unit installed alongside the drone service.
+type serviceHelper struct {
+	name string
+	unit string
+}
+
+// serviceHelperUnit renders the systemd unit of a dmctl command running
+// alongside the drone, bound to device if it is set.
+func serviceHelperUnit(description string, args []string, device string) string {
+	after := []string{"network-online.target"}
+	if device != "" {
+		after = append(after, deviceUnit(device))
+	}
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "[Unit]")
+	fmt.Fprintf(&b, "Description=Drone Mission Control %s (%s)\n", description, activeProfile())
+	fmt.Fprintln(&b, "Wants=network-online.target")
+	fmt.Fprintf(&b, "After=%s\n", strings.Join(after, " "))
+	if device != "" {
+		fmt.Fprintf(&b, "BindsTo=%s\n", deviceUnit(device))
+	}
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Service]")
+	fmt.Fprintf(&b, "ExecStart=%s\n", execLine(args))
+	fmt.Fprintln(&b, "Restart=always")
+	fmt.Fprintln(&b, "RestartSec=5")
+	fmt.Fprintln(&b)
+	fmt.Fprintln(&b, "[Install]")
+	fmt.Fprintln(&b, "WantedBy=multi-user.target")
+	return b.String()
+}
+
+// execLine formats a command for an Exec= setting, resolving the binary to an
+// absolute path as systemd requires.
+func execLine(args []string) string {
+	bin := args[0]
+	if path, err := exec.LookPath(bin); err == nil {
+		bin = path
+	} else if !filepath.IsAbs(bin) {
+		bin = "/usr/bin/" + bin
+	}
+	quoted := []string{bin}
+	for _, arg := range args[1:] {
+		arg = strings.Replace(arg, "%", "%%", -1)
+		arg = strings.Replace(arg, "$", "$$", -1)
+		if strings.ContainsAny(arg, " \t\"'\\") {
+			arg = `"` + strings.Replace(strings.Replace(arg, `\`, `\\`, -1), `"`, `\"`, -1) + `"`
+		}
+		quoted = append(quoted, arg)
+	}
+	return strings.Join(quoted, " ")
+}
+
+// deviceUnit returns the systemd device unit of a device path, escaped like
+// systemd-escape --path --suffix=device.
+func deviceUnit(path string) string {
+	path = strings.Trim(filepath.Clean(path), "/")
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			b.WriteByte('-')
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_', c == '.' && i > 0:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		}
+	}
+	return b.String() + ".device"
+}
+
+// serialDevice returns the device of a serial FCU url such as
+// serial:///dev/ttyACM0:57600, or an empty string for network urls.
+func serialDevice(fcuURL string) string {
+	u, err := url.Parse(fcuURL)
+	if err != nil || u.Scheme != "serial" {
+		return ""
+	}
+	path := u.Path
+	if i := strings.LastIndex(path, ":"); i > 0 {
+		path = path[:i]
+	}
+	return path
+}
+
+// enableUnit enables and restarts unit, since enable --now leaves a unit
+// that is already active running with its old ExecStart.
+func enableUnit(unit string) error {
+	if err := systemctl("enable", unit); err != nil {
+		return err
+	}
+	return systemctl("restart", unit)
+}
+
+var systemctl = func(args ...string) error {
+	c := exec.Command("systemctl", args...)
+	c.Stdout = stdout
+	c.Stderr = os.Stderr
+	return c.Run()
+}
+
+func init() {
+	rootCmd.AddCommand(serviceCmd)
+	serviceCmd.AddCommand(serviceInstallCmd, serviceUninstallCmd, serviceStatusCmd)
+
+	serviceInstallCmd.Flags().StringVar(&ServiceDevice, "device", "", "Device the service depends on (default serial device of FCU_URL)")
+}
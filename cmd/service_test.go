@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/viper"
+)
+
+func TestServiceReinstallRestarts(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	oldDirs := []string{systemdDir, serviceEnvDir}
+	oldSystemctl := systemctl
+	defer func() {
+		systemdDir, serviceEnvDir = oldDirs[0], oldDirs[1]
+		systemctl = oldSystemctl
+	}()
+	systemdDir = filepath.Join(os.Getenv("HOME"), "systemd")
+	serviceEnvDir = filepath.Join(os.Getenv("HOME"), "env")
+	os.MkdirAll(systemdDir, 0700)
+	var calls []string
+	systemctl = func(args ...string) error {
+		calls = append(calls, strings.Join(args, " "))
+		return nil
+	}
+	viper.Set("RUNTIME", engine.RuntimeDocker)
+
+	for i := 0; i < 2; i++ {
+		calls = nil
+		if err := runServiceInstall(nil, nil); err != nil {
+			t.Fatal(err)
+		}
+		want := "daemon-reload,enable dmctl-drone.service,restart dmctl-drone.service"
+		if got := strings.Join(calls, ","); got != want {
+			t.Errorf("install %d ran systemctl %s, want %s", i+1, got, want)
+		}
+	}
+}
+
+func TestServiceUnit(t *testing.T) {
+	spec := &engine.Spec{
+		Name:        "drone",
+		Image:       imageBase() + "dmc-rpi",
+		Env:         []string{"ID=1"},
+		Privileged:  true,
+		NetworkMode: "host",
+		Labels:      map[string]string{profileLabel: defaultProfile},
+		StopTimeout: 30 * time.Second,
+		Devices:     []string{"/dev/ttyACM0", "/dev/ttyUSB0:/dev/radio"},
+		Ports:       []string{"8554:8554/udp"},
+	}
+	cmds, err := engine.NewServiceCommands(engine.RuntimeDocker, spec, "/etc/dmctl/drone.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	unit := serviceUnit("drone", "/usr/bin/dmctl", cmds, serialDevice("serial:///dev/ttyACM0:57600"))
+	for _, want := range []string{
+		"Type=notify\n",
+		"ExecStart=/usr/bin/dmctl --profile default service supervise drone -- ",
+		"WatchdogSec=30\n",
+		"Requires=docker.service\n",
+		"BindsTo=dev-ttyACM0.device\n",
+		"After=docker.service network-online.target dev-ttyACM0.device\n",
+		" run --rm --name drone --env-file /etc/dmctl/drone.env --log-driver journald --privileged --network host --device /dev/ttyACM0:/dev/ttyACM0:rwm --device /dev/ttyUSB0:/dev/radio:rwm --publish 8554:8554/udp --label dmctl.profile=default docker.io/tobiasfriden/dmc-rpi\n",
+		" stop --time 30 drone\n",
+		"TimeoutStopSec=40\n",
+		"Restart=always\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	if strings.Contains(unit, "ID=1") {
+		t.Error("environment leaked into unit file")
+	}
+}
+
+func TestContainerdServiceDevices(t *testing.T) {
+	spec := &engine.Spec{Name: "drone", Image: "dmc-rpi", Devices: []string{"/dev/ttyACM0"}}
+	cmds, err := engine.NewServiceCommands(engine.RuntimeContainerd, spec, "/etc/dmctl/drone.env")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if run := strings.Join(cmds.Run, " "); !strings.Contains(run, " --device /dev/ttyACM0 ") {
+		t.Errorf("device missing from %s", run)
+	}
+	spec.Ports = []string{"8554:8554/udp"}
+	if _, err := engine.NewServiceCommands(engine.RuntimeContainerd, spec, "/etc/dmctl/drone.env"); err == nil {
+		t.Error("expected ports to be refused")
+	}
+}
+
+func TestExecLineQuoting(t *testing.T) {
+	got := execLine([]string{"/bin/true", "--location 1,2,3,0", "100%", "$HOME"})
+	want := `/bin/true "--location 1,2,3,0" 100%% $$HOME`
+	if got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+}
+
+func TestDeviceUnit(t *testing.T) {
+	for path, want := range map[string]string{
+		"/dev/ttyACM0":                      "dev-ttyACM0.device",
+		"/dev/serial/by-id/usb-CubePilot_0": `dev-serial-by\x2did-usb\x2dCubePilot_0.device`,
+	} {
+		if got := deviceUnit(path); got != want {
+			t.Errorf("deviceUnit(%s) = %s, want %s", path, got, want)
+		}
+	}
+	if got := serialDevice("udp://:14650@"); got != "" {
+		t.Errorf("unexpected device %s for udp url", got)
+	}
+}
+
+func TestServiceHelperUnit(t *testing.T) {
+	unit := serviceHelperUnit("log archiver", []string{"/usr/bin/dmctl", "--profile", "default", "logs", "archive", "run"}, "")
+	for _, want := range []string{
+		"Description=Drone Mission Control log archiver (default)\n",
+		"After=network-online.target\n",
+		"ExecStart=/usr/bin/dmctl --profile default logs archive run\n",
+	} {
+		if !strings.Contains(unit, want) {
+			t.Errorf("unit missing %q:\n%s", want, unit)
+		}
+	}
+	if strings.Contains(unit, "BindsTo") {
+		t.Errorf("unit bound to a device:\n%s", unit)
+	}
+}
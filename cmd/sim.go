@@ -0,0 +1,409 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+const (
+	simImage         = "dmc-sim"
+	simInstanceLabel = "dmctl.sim.instance"
+	// SITL offsets its ports by 10 for every instance, like ArduPilot's -I.
+	simBasePort   = 5760
+	simPortOffset = 10
+	simParamsDir  = "/params"
+)
+
+var (
+	SimCount  int
+	SimDrones []string
+
+	simType     string
+	simLocation string
+	simHeading  string
+	simSpeedup  string
+	simWind     string
+	simParams   []string
+)
+
+// simCmd represents the sim command
+var simCmd = &cobra.Command{
+	Use:   "sim",
+	Short: "Start simulated drones",
+	Long: `Starts one or more simulated drones. Options given as flags are saved to
+the profile, so that dmctl start runs the same simulation.
+
+Every instance needs its own registered drone. The first uses the drone of
+the profile, the others the drones given with --drone. With more than one
+instance the simulators share the host network and instance N listens for
+MAVLink on TCP port 5760+10*N.`,
+	Args: cobra.NoArgs,
+	RunE: runSim,
+}
+
+var simStopCmd = &cobra.Command{
+	Use:   "stop",
+	Short: "Stops all simulated drones",
+	Args:  cobra.NoArgs,
+	RunE:  runSimStop,
+}
+
+var simListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists running simulated drones",
+	Args:  cobra.NoArgs,
+	RunE:  runSimList,
+}
+
+// simDrone is the registered drone a simulator instance connects as.
+type simDrone struct {
+	ID       string
+	Password string
+}
+
+// isSimImage reports whether the profile runs the simulator, also when IMAGE
+// is a full reference such as docker.io/tobiasfriden/dmc-sim.
+func isSimImage() bool {
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return false
+	}
+	if !strings.Contains(img, "/") {
+		img = imageBase() + img
+	}
+	return registry.ParseReference(img).Name() == registry.ParseReference(imageBase()+simImage).Name()
+}
+
+func runSim(cmd *cobra.Command, args []string) error {
+	if !isSimImage() {
+		return fmt.Errorf("profile is not configured for simulation, run dmctl config obc --obc sim-copter")
+	}
+	if SimCount < 1 {
+		return fmt.Errorf("--count must be at least 1")
+	}
+	drones, err := parseSimDrones(SimDrones)
+	if err != nil {
+		return err
+	}
+	if len(drones) < SimCount-1 {
+		return fmt.Errorf("%d instances need %d more registered drones, pass --drone ID:VERIFICATION_KEY for each", SimCount, SimCount-1-len(drones))
+	}
+	if err := saveSimOptions(cmd); err != nil {
+		return err
+	}
+	for i := 0; i < SimCount; i++ {
+		spec, err := simulatedInstanceSpec(i, SimCount)
+		if err != nil {
+			return err
+		}
+		if i > 0 {
+			spec.Env = setEnv(spec.Env, "ID", drones[i-1].ID)
+			spec.Env = setEnv(spec.Env, "PASSWORD", drones[i-1].Password)
+		}
+		spec.Labels[serviceLabel] = droneService
+		if err := startContainer(simInstanceName(i), droneImage(simImage), spec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// saveSimOptions validates the options given as flags and saves them.
+func saveSimOptions(cmd *cobra.Command) error {
+	options := []struct {
+		flag, key string
+		value     string
+	}{
+		{"type", "SIM_TYPE", simType},
+		{"location", "MOCK_POSITION", simLocation},
+		{"heading", "SIM_HEADING", simHeading},
+		{"speedup", "SIM_SPEEDUP", simSpeedup},
+		{"wind", "SIM_WIND", simWind},
+		{"params", "SIM_PARAMS", strings.Join(simParams, ",")},
+	}
+	for _, o := range options {
+		if !cmd.Flags().Changed(o.flag) {
+			continue
+		}
+		key, err := lookupKey(o.key)
+		if err != nil {
+			return err
+		}
+		value := o.value
+		if o.key == "SIM_PARAMS" {
+			var abs []string
+			for _, p := range simParams {
+				if p, err = filepath.Abs(p); err != nil {
+					return err
+				}
+				abs = append(abs, p)
+			}
+			value = strings.Join(abs, ",")
+		}
+		if value != "" && key.Validate != nil {
+			if err := key.Validate(value); err != nil {
+				return fmt.Errorf("invalid --%s: %s", o.flag, err)
+			}
+		}
+		viper.Set(key.Name, value)
+	}
+	return writeConfig()
+}
+
+// simulatedInstanceSpec returns the container spec of instance i out of
+// count simulated drones.
+func simulatedInstanceSpec(i, count int) (*engine.Spec, error) {
+	location := viper.GetString("MOCK_POSITION")
+	if location == "" {
+		return nil, errors.New("location must be set for simulation")
+	}
+	vehicle := viper.GetString("SIM_TYPE")
+	if vehicle == "" {
+		return nil, errors.New("simulation type not set, run dmctl config obc")
+	}
+	heading := viper.GetString("SIM_HEADING")
+	if heading == "" {
+		heading = "0"
+	}
+	droneEnv := backendEnv(envList("ID", "PASSWORD", "DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION"))
+	spec := &engine.Spec{
+		Env: droneEnv,
+		Cmd: []string{
+			fmt.Sprintf("--location %s,%s", location, heading),
+			fmt.Sprintf("--%s", vehicle),
+		},
+		Tty:    true,
+		Labels: map[string]string{simInstanceLabel: strconv.Itoa(i)},
+	}
+	if speedup := viper.GetString("SIM_SPEEDUP"); speedup != "" && speedup != "1" {
+		spec.Cmd = append(spec.Cmd, "--speedup "+speedup)
+	}
+	if wind := viper.GetString("SIM_WIND"); wind != "" {
+		spec.Cmd = append(spec.Cmd, "--wind "+wind)
+	}
+	if params := splitList(viper.GetString("SIM_PARAMS")); len(params) > 0 {
+		var files []string
+		for _, p := range params {
+			inContainer := fmt.Sprintf("%s/%d-%s", simParamsDir, len(files), filepath.Base(p))
+			spec.Mounts = append(spec.Mounts, p+":"+inContainer+":ro")
+			files = append(files, inContainer)
+		}
+		spec.Cmd = append(spec.Cmd, "--params "+strings.Join(files, ","))
+	}
+	if count > 1 {
+		spec.NetworkMode = "host"
+		spec.Cmd = append(spec.Cmd, fmt.Sprintf("--instance %d", i), fmt.Sprintf("--sysid %d", i+1))
+	}
+	return spec, nil
+}
+
+// simInstanceName returns the container name of instance i. The first
+// instance is the drone container of the profile, the others are named
+// sim-N so that they don't take the name of the drone of a profile N.
+func simInstanceName(i int) string {
+	if i == 0 {
+		return containerName(droneService)
+	}
+	return containerName(fmt.Sprintf("sim-%d", i+1))
+}
+
+func parseSimDrones(values []string) ([]simDrone, error) {
+	var drones []simDrone
+	for _, v := range values {
+		parts := strings.SplitN(v, ":", 2)
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid --drone %s, expected ID:VERIFICATION_KEY", v)
+		}
+		drones = append(drones, simDrone{ID: parts[0], Password: parts[1]})
+	}
+	return drones, nil
+}
+
+// setEnv replaces or adds KEY=value in env.
+func setEnv(env []string, key, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, key+"=") {
+			env[i] = key + "=" + value
+			return env
+		}
+	}
+	return append(env, key+"="+value)
+}
+
+// simInstances returns the running simulator containers of the active
+// profile, ordered by instance.
+func simInstances(ctx context.Context) ([]engine.Container, error) {
+	eng, err := getEngine()
+	if err != nil {
+		return nil, err
+	}
+	containers, err := eng.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var instances []engine.Container
+	for _, c := range containers {
+		if c.Labels[simInstanceLabel] != "" && c.Labels[profileLabel] == activeProfile() {
+			instances = append(instances, c)
+		}
+	}
+	sort.Slice(instances, func(i, j int) bool {
+		return simInstance(instances[i]) < simInstance(instances[j])
+	})
+	return instances, nil
+}
+
+func simInstance(c engine.Container) int {
+	i, _ := strconv.Atoi(c.Labels[simInstanceLabel])
+	return i
+}
+
+func runSimStop(cmd *cobra.Command, args []string) error {
+	instances, err := simInstances(context.Background())
+	if err != nil {
+		return err
+	}
+	if len(instances) == 0 {
+		bad("No simulated drones running")
+		return nil
+	}
+	for i := len(instances) - 1; i >= 0; i-- {
+		if err := stopContainer(instances[i].Name, keepStopped()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// simInstanceStatus is the schema of dmctl sim list --output json|yaml.
+// MavlinkPort is only set for instances sharing the host network.
+type simInstanceStatus struct {
+	Instance      int    `json:"instance" yaml:"instance"`
+	Name          string `json:"name" yaml:"name"`
+	SystemID      int    `json:"system_id" yaml:"system_id"`
+	MavlinkPort   int    `json:"mavlink_port,omitempty" yaml:"mavlink_port,omitempty"`
+	UptimeSeconds int64  `json:"uptime_seconds" yaml:"uptime_seconds"`
+}
+
+type simListResult struct {
+	Instances []simInstanceStatus `json:"instances" yaml:"instances"`
+}
+
+func runSimList(cmd *cobra.Command, args []string) error {
+	instances, err := simInstances(context.Background())
+	if err != nil {
+		return err
+	}
+	result := simListResult{Instances: []simInstanceStatus{}}
+	for _, c := range instances {
+		i := simInstance(c)
+		status := simInstanceStatus{
+			Instance:      i,
+			Name:          c.Name,
+			SystemID:      1,
+			UptimeSeconds: int64(time.Since(c.Created).Seconds()),
+		}
+		if len(instances) > 1 {
+			status.SystemID = i + 1
+			status.MavlinkPort = simBasePort + simPortOffset*i
+		}
+		result.Instances = append(result.Instances, status)
+	}
+	return printResult(result, func(w io.Writer) {
+		if len(result.Instances) == 0 {
+			bad("No simulated drones running")
+			return
+		}
+		fmt.Fprintln(w, "INSTANCE\tNAME\tSYSID\tPORT\tUP")
+		for _, s := range result.Instances {
+			port := "-"
+			if s.MavlinkPort != 0 {
+				port = strconv.Itoa(s.MavlinkPort)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%s\n", s.Instance, s.Name, s.SystemID, port, time.Duration(s.UptimeSeconds)*time.Second)
+		}
+	})
+}
+
+func validateHeading(v string) error {
+	h, err := strconv.ParseFloat(v, 64)
+	if err != nil || h < 0 || h >= 360 {
+		return fmt.Errorf("expected degrees from 0 to 360")
+	}
+	return nil
+}
+
+func validateSpeedup(v string) error {
+	s, err := strconv.ParseFloat(v, 64)
+	if err != nil || s <= 0 {
+		return fmt.Errorf("expected a factor above 0")
+	}
+	return nil
+}
+
+func validateWind(v string) error {
+	parts := strings.Split(v, ",")
+	if len(parts) != 2 {
+		return fmt.Errorf("expected SPEED,DIRECTION")
+	}
+	if speed, err := strconv.ParseFloat(parts[0], 64); err != nil || speed < 0 {
+		return fmt.Errorf("invalid wind speed %s", parts[0])
+	}
+	return validateHeading(parts[1])
+}
+
+func validateParams(v string) error {
+	for _, p := range splitList(v) {
+		info, err := os.Stat(p)
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return fmt.Errorf("%s is a directory", p)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(simCmd)
+	simCmd.AddCommand(simStopCmd, simListCmd)
+
+	simCmd.Flags().StringVar(&simType, "type", "", "Vehicle type, one of: copter, plane, vtol, rover (default SIM_TYPE)")
+	simCmd.Flags().StringVarP(&simLocation, "location", "l", "", "Home location (LAT,LNG,ALT)")
+	simCmd.Flags().StringVar(&simHeading, "heading", "", "Home heading in degrees (default 0)")
+	simCmd.Flags().StringVar(&simSpeedup, "speedup", "", "Simulation speedup factor (default 1)")
+	simCmd.Flags().StringVar(&simWind, "wind", "", "Wind as SPEED,DIRECTION in m/s and degrees, empty for none")
+	simCmd.Flags().StringArrayVar(&simParams, "params", nil, "Parameter file to load, can be repeated")
+	simCmd.Flags().IntVarP(&SimCount, "count", "c", 1, "Number of simulated drones")
+	simCmd.Flags().StringArrayVar(&SimDrones, "drone", nil, "ID:VERIFICATION_KEY of the drone of an additional instance, can be repeated")
+	simCmd.Flags().BoolVarP(&Recreate, "recreate", "r", false, "Recreate if already running")
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+func setupSim(t *testing.T) func() {
+	viper.Set("IMAGE", simImage)
+	viper.Set("SIM_TYPE", "copter")
+	viper.Set("MOCK_POSITION", "57.7,11.9,0")
+	viper.Set("ID", "drone-1")
+	viper.Set("PASSWORD", "key-1")
+	return func() {
+		SimCount, SimDrones, simParams = 1, nil, nil
+		simType, simLocation, simHeading, simSpeedup, simWind = "", "", "", "", ""
+		simCmd.Flags().VisitAll(func(f *pflag.Flag) {
+			f.Changed = false
+		})
+	}
+}
+
+func TestSimulatedInstanceSpec(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	defer setupSim(t)()
+
+	spec, err := simulatedInstanceSpec(0, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"--location 57.7,11.9,0,0", "--copter"}; !reflect.DeepEqual(spec.Cmd, want) {
+		t.Errorf("got %q, want %q", spec.Cmd, want)
+	}
+	if spec.NetworkMode != "" || len(spec.Mounts) > 0 {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+
+	viper.Set("SIM_TYPE", "vtol")
+	viper.Set("SIM_HEADING", "90")
+	viper.Set("SIM_SPEEDUP", "5")
+	viper.Set("SIM_WIND", "4,270")
+	viper.Set("SIM_PARAMS", "/tmp/a.parm,/tmp/b/a.parm")
+	spec, err = simulatedInstanceSpec(2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		"--location 57.7,11.9,0,90", "--vtol", "--speedup 5", "--wind 4,270",
+		"--params /params/0-a.parm,/params/1-a.parm", "--instance 2", "--sysid 3",
+	}
+	if !reflect.DeepEqual(spec.Cmd, want) {
+		t.Errorf("got %q, want %q", spec.Cmd, want)
+	}
+	if mounts := []string{"/tmp/a.parm:/params/0-a.parm:ro", "/tmp/b/a.parm:/params/1-a.parm:ro"}; !reflect.DeepEqual(spec.Mounts, mounts) {
+		t.Errorf("unexpected mounts %q", spec.Mounts)
+	}
+	if spec.NetworkMode != "host" || spec.Labels[simInstanceLabel] != "2" {
+		t.Errorf("unexpected spec %+v", spec)
+	}
+}
+
+func TestSim(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	defer setupSim(t)()
+
+	dir, err := ioutil.TempDir("", "params")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	params := filepath.Join(dir, "copter.parm")
+	ioutil.WriteFile(params, []byte("SIM_BATT_VOLTAGE 16.8\n"), 0644)
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	// The drone of profile 2 isn't in the way of the second instance.
+	ctx := context.Background()
+	other, err := fake.Create(ctx, &engine.Spec{Name: "drone-2", Image: droneImage(simImage), Labels: map[string]string{profileLabel: "2"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fake.Start(ctx, other)
+	for name, value := range map[string]string{"type": "plane", "speedup": "10", "params": params, "count": "2"} {
+		if err := simCmd.Flags().Set(name, value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := runSim(simCmd, nil); err == nil || !strings.Contains(err.Error(), "--drone") {
+		t.Fatalf("expected missing drone error, got %v", err)
+	}
+	simCmd.Flags().Set("drone", "drone-2:key-2")
+	if err := runSim(simCmd, nil); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("SIM_TYPE") != "plane" || viper.GetString("SIM_SPEEDUP") != "10" || viper.GetString("SIM_PARAMS") != params {
+		t.Error("options not saved")
+	}
+	second := fake.Get("sim-2")
+	if second == nil || !second.Running {
+		t.Fatal("second instance not running")
+	}
+	env := strings.Join(second.Spec.Env, " ")
+	if !strings.Contains(env, "ID=drone-2") || !strings.Contains(env, "PASSWORD=key-2") {
+		t.Errorf("second instance has wrong drone: %s", env)
+	}
+	if first := fake.Get("drone"); first == nil || !strings.Contains(strings.Join(first.Spec.Env, " "), "ID=drone-1") {
+		t.Error("first instance not running as the profile's drone")
+	}
+
+	out.Reset()
+	Output = outputJSON
+	if err := runSimList(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var result simListResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Instances) != 2 || result.Instances[1].SystemID != 2 || result.Instances[1].MavlinkPort != 5770 {
+		t.Errorf("unexpected instances %+v", result.Instances)
+	}
+
+	Output = outputTable
+	if err := runSimStop(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"drone", "sim-2"} {
+		if c := fake.Get(name); c != nil && c.Running {
+			t.Errorf("%s still running", name)
+		}
+	}
+	if c := fake.Get("drone-2"); c == nil || !c.Running {
+		t.Error("drone of profile 2 stopped")
+	}
+}
+
+func TestIsSimImage(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	for img, want := range map[string]bool{
+		simImage:                      true,
+		imageBase() + simImage:        true,
+		imageBase() + "dmc-sim:1.2.0": true,
+		"dmc-rpi":                     false,
+		"":                            false,
+	} {
+		viper.Set("IMAGE", img)
+		if got := isSimImage(); got != want {
+			t.Errorf("isSimImage() with IMAGE %q = %v, want %v", img, got, want)
+		}
+	}
+}
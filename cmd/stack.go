@@ -0,0 +1,285 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/registry"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	droneService = "drone"
+	serviceLabel = "dmctl.service"
+)
+
+var serviceNameRe = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// stack is the set of containers started alongside each other, read from
+// the stack file of the active profile. The drone service is always part of
+// it and is configured by the profile, the stack file may only give it
+// dependencies.
+type stack struct {
+	Services map[string]*stackService `yaml:"services"`
+}
+
+// stackService is a container in a stack. Services share the host network
+// unless they set another network.
+type stackService struct {
+	Image      string            `yaml:"image"`
+	Command    []string          `yaml:"command,omitempty"`
+	Env        map[string]string `yaml:"env,omitempty"`
+	Devices    []string          `yaml:"devices,omitempty"`
+	Ports      []string          `yaml:"ports,omitempty"`
+	Network    string            `yaml:"network,omitempty"`
+	Privileged bool              `yaml:"privileged,omitempty"`
+	DependsOn  []string          `yaml:"depends_on,omitempty"`
+}
+
+// stackPath returns the stack file of a profile.
+func stackPath(profile string) (string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	if profile == defaultProfile {
+		return filepath.Join(dir, "stack.yaml"), nil
+	}
+	return filepath.Join(dir, "stacks", profile+".yaml"), nil
+}
+
+// loadStack reads the stack of the active profile, which is just the drone
+// service if there is no stack file.
+func loadStack() (*stack, error) {
+	s := &stack{Services: map[string]*stackService{}}
+	path, err := stackPath(activeProfile())
+	if err != nil {
+		return nil, err
+	}
+	raw, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		if err := yaml.UnmarshalStrict(raw, s); err != nil {
+			return nil, fmt.Errorf("invalid stack %s: %s", path, err)
+		}
+	}
+	if s.Services == nil {
+		s.Services = map[string]*stackService{}
+	}
+	if s.Services[droneService] == nil {
+		s.Services[droneService] = &stackService{}
+	}
+	if err := s.validate(); err != nil {
+		return nil, fmt.Errorf("invalid stack %s: %s", path, err)
+	}
+	return s, nil
+}
+
+func (s *stack) validate() error {
+	for name, svc := range s.Services {
+		if svc == nil {
+			return fmt.Errorf("service %s is empty", name)
+		}
+		if !serviceNameRe.MatchString(name) {
+			return fmt.Errorf("invalid service name %q", name)
+		}
+		if name == droneService {
+			drone := stackService{DependsOn: svc.DependsOn}
+			if fmt.Sprint(*svc) != fmt.Sprint(drone) {
+				return fmt.Errorf("the drone service is configured by the profile, only depends_on can be set")
+			}
+		} else if svc.Image == "" {
+			return fmt.Errorf("service %s has no image", name)
+		}
+		if len(svc.Ports) > 0 && (svc.Network == "" || svc.Network == "host") {
+			return fmt.Errorf("service %s publishes ports on the host network, set network: bridge", name)
+		}
+		for _, dep := range svc.DependsOn {
+			if s.Services[dep] == nil {
+				return fmt.Errorf("service %s depends on unknown service %s", name, dep)
+			}
+		}
+	}
+	_, err := s.order(s.names())
+	return err
+}
+
+// names returns the names of all services, sorted.
+func (s *stack) names() []string {
+	names := make([]string, 0, len(s.Services))
+	for name := range s.Services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// order returns the named services and everything they depend on, with
+// dependencies before the services that depend on them.
+func (s *stack) order(names []string) ([]string, error) {
+	const (
+		visiting = 1
+		done     = 2
+	)
+	state := map[string]int{}
+	var ordered []string
+	var visit func(name string, path []string) error
+	visit = func(name string, path []string) error {
+		switch state[name] {
+		case done:
+			return nil
+		case visiting:
+			return fmt.Errorf("dependency cycle %s", strings.Join(append(path, name), " -> "))
+		}
+		svc := s.Services[name]
+		if svc == nil {
+			return fmt.Errorf("unknown service %s, must be one of: %s", name, strings.Join(s.names(), ", "))
+		}
+		state[name] = visiting
+		deps := append([]string(nil), svc.DependsOn...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			if err := visit(dep, append(path, name)); err != nil {
+				return err
+			}
+		}
+		state[name] = done
+		ordered = append(ordered, name)
+		return nil
+	}
+	for _, name := range names {
+		if err := visit(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ordered, nil
+}
+
+// image returns the reference a service runs, defaulting to the latest tag.
+func (svc *stackService) image() string {
+	ref := registry.ParseReference(svc.Image)
+	if ref.Tag == "" && ref.Digest == "" {
+		ref.Tag = "latest"
+	}
+	return ref.String()
+}
+
+// spec returns the container spec of a service other than drone.
+func (svc *stackService) spec() *engine.Spec {
+	env := make([]string, 0, len(svc.Env))
+	for k, v := range svc.Env {
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+	network := svc.Network
+	if network == "" {
+		network = "host"
+	}
+	spec := &engine.Spec{
+		Env:         env,
+		Cmd:         svc.Command,
+		Privileged:  svc.Privileged,
+		NetworkMode: network,
+		Devices:     svc.Devices,
+		Ports:       svc.Ports,
+	}
+	if !NoRestart {
+		spec.RestartPolicy = "unless-stopped"
+	}
+	return spec
+}
+
+// startService starts a service of the stack.
+func startService(s *stack, name string) error {
+	img, spec, err := serviceSpec(s, name)
+	if err != nil {
+		return err
+	}
+	return startContainer(containerName(name), img, spec)
+}
+
+// serviceSpec returns the image and container spec of a service of the
+// stack.
+func serviceSpec(s *stack, name string) (string, *engine.Spec, error) {
+	var img string
+	var spec *engine.Spec
+	if name == droneService {
+		var err error
+		if img, spec, err = droneSpec(); err != nil {
+			return "", nil, err
+		}
+	} else {
+		svc := s.Services[name]
+		img, spec = svc.image(), svc.spec()
+	}
+	if spec.Labels == nil {
+		spec.Labels = map[string]string{}
+	}
+	spec.Labels[serviceLabel] = name
+	return img, spec, nil
+}
+
+// pullService pulls the image of a service of the stack.
+func pullService(s *stack, name string) error {
+	if name == droneService {
+		return runPullDrone(nil, nil)
+	}
+	return pullImage(name, s.Services[name].image())
+}
+
+// copyStack copies the stack file of a profile, if it has one.
+func copyStack(src, dst string) error {
+	srcPath, err := stackPath(src)
+	if err != nil {
+		return err
+	}
+	raw, err := ioutil.ReadFile(srcPath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	dstPath, err := stackPath(dst)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(dstPath, raw, 0600)
+}
+
+func deleteStack(profile string) error {
+	path, err := stackPath(profile)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+const testStack = `services:
+  drone:
+    depends_on: [mavros]
+  mavros:
+    image: ros/mavros
+    env:
+      FCU_URL: udp://:14550@
+    devices: [/dev/ttyACM0]
+  camera:
+    image: example.com/camera:1.2
+    network: bridge
+    ports: ["8554:8554/udp"]
+    depends_on: [drone]
+`
+
+func writeStack(t *testing.T, profile, content string) {
+	path, err := stackPath(profile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadStackDefault(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	s, err := loadStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := s.names(); !reflect.DeepEqual(names, []string{"drone"}) {
+		t.Errorf("unexpected services %v", names)
+	}
+}
+
+func TestLoadStackInvalid(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	for _, content := range []string{
+		"services:\n  drone:\n    image: other\n",
+		"services:\n  mavros: {}\n",
+		"services:\n  mavros:\n    image: ros/mavros\n    depends_on: [missing]\n",
+		"services:\n  mavros:\n    image: ros/mavros\n    ports: [\"80:80\"]\n",
+		"services:\n  a:\n    image: a\n    depends_on: [b]\n  b:\n    image: b\n    depends_on: [a]\n",
+		"services:\n  mavros:\n    image: ros/mavros\n    unknown: true\n",
+	} {
+		writeStack(t, defaultProfile, content)
+		if _, err := loadStack(); err == nil {
+			t.Errorf("expected error for %q", content)
+		}
+	}
+}
+
+func TestStackOrder(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+
+	writeStack(t, defaultProfile, testStack)
+	s, err := loadStack()
+	if err != nil {
+		t.Fatal(err)
+	}
+	order, err := s.order(s.names())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"mavros", "drone", "camera"}) {
+		t.Errorf("unexpected order %v", order)
+	}
+	order, err = s.order([]string{"drone"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(order, []string{"mavros", "drone"}) {
+		t.Errorf("unexpected order %v", order)
+	}
+	if _, err := s.order([]string{"missing"}); err == nil {
+		t.Error("expected error for unknown service")
+	}
+}
+
+func TestStartStopStack(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+
+	writeStack(t, defaultProfile, testStack)
+	if err := runPull(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if !fake.Pulled("docker.io/ros/mavros:latest") || !fake.Pulled("example.com/camera:1.2") {
+		t.Fatal("stack images not pulled")
+	}
+	if err := runStart(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"drone", "mavros", "camera"} {
+		c := fake.Get(name)
+		if c == nil || !c.Running {
+			t.Fatalf("%s not running", name)
+		}
+		if c.Labels[serviceLabel] != name || c.Labels[profileLabel] != defaultProfile {
+			t.Errorf("unexpected labels %v", c.Labels)
+		}
+	}
+	if i, j := strings.Index(out.String(), "Creating mavros"), strings.Index(out.String(), "Creating drone"); i < 0 || j < i {
+		t.Errorf("mavros not started before drone in %q", out.String())
+	}
+	mavros := fake.Get("mavros").Spec
+	if mavros.NetworkMode != "host" || !reflect.DeepEqual(mavros.Env, []string{"FCU_URL=udp://:14550@"}) || !reflect.DeepEqual(mavros.Devices, []string{"/dev/ttyACM0"}) {
+		t.Errorf("unexpected mavros spec %+v", mavros)
+	}
+	camera := fake.Get("camera").Spec
+	if camera.NetworkMode != "bridge" || !reflect.DeepEqual(camera.Ports, []string{"8554:8554/udp"}) {
+		t.Errorf("unexpected camera spec %+v", camera)
+	}
+
+	out.Reset()
+	if err := runStopStack(nil, []string{"camera"}); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("camera"); c != nil && c.Running {
+		t.Error("camera still running")
+	}
+	if !fake.Get("drone").Running {
+		t.Error("drone stopped with camera")
+	}
+	out.Reset()
+	if err := runStopStack(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if i, j := strings.Index(out.String(), "Stopping drone"), strings.Index(out.String(), "Stopping mavros"); i < 0 || j < i {
+		t.Errorf("drone not stopped before mavros in %q", out.String())
+	}
+}
+
+func TestPsStack(t *testing.T) {
+	_, out, teardown := setupFake(t)
+	defer teardown()
+
+	writeStack(t, defaultProfile, testStack)
+	if err := runPull(nil, []string{"mavros"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStart(nil, []string{"mavros"}); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err := runPs(nil, nil)
+	if exit, ok := err.(*exitError); !ok || exit.Code != exitNotRunning {
+		t.Fatalf("expected exit code %d, got %v", exitNotRunning, err)
+	}
+	if !strings.Contains(out.String(), "mavros running for") || !strings.Contains(out.String(), "drone not running") {
+		t.Errorf("unexpected output %q", out.String())
+	}
+}
@@ -16,9 +16,7 @@ limitations under the License.
 package cmd
 
 import (
-	"fmt"
-
-	"github.com/docker/docker/api/types/container"
+	"github.com/airpelago/dmctl/engine"
 	"github.com/pkg/errors"
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
@@ -31,9 +29,11 @@ var (
 
 // startCmd represents the start command
 var startCmd = &cobra.Command{
-	Use:   "start",
+	Use:   "start [SERVICE...]",
 	Short: "Start dmc containers",
-	RunE:  runStartDrone,
+	Long: `Starts the services of the stack, or only the given services and the
+services they depend on. Dependencies are started first.`,
+	RunE: runStart,
 }
 
 // startDroneCmd represents the start drone command
@@ -43,60 +43,82 @@ var startDroneCmd = &cobra.Command{
 	RunE:  runStartDrone,
 }
 
+func runStart(cmd *cobra.Command, args []string) error {
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	names := args
+	if len(names) == 0 {
+		names = s.names()
+	}
+	order, err := s.order(names)
+	if err != nil {
+		return err
+	}
+	for _, name := range order {
+		if err := startService(s, name); err != nil {
+			return err
+		}
+		if name == droneService && routerEnabled() && !routerRunning() {
+			warn("The MAVLink router is not running, start it with dmctl fcu router or dmctl service install")
+		}
+		if name == droneService && viper.GetBool("LOG_ARCHIVE") && !archiverRunning() {
+			warn("The log archiver is not running, start it with dmctl logs archive run or dmctl service install")
+		}
+	}
+	return nil
+}
+
 func runStartDrone(cmd *cobra.Command, args []string) error {
+	return runStart(cmd, []string{droneService})
+}
+
+// droneSpec returns the image and container spec of the drone container for
+// the configured OBC.
+func droneSpec() (string, *engine.Spec, error) {
 	img := viper.GetString("IMAGE")
 	if img == "" {
-		return errNoImage
+		return "", nil, errNoImage
 	}
-	if img == "dmc-sim" {
-		return runSimulatedDrone(img)
+	if secretsErr != nil {
+		return "", nil, errors.Wrap(secretsErr, "could not read secrets")
+	}
+	if isSimImage() {
+		spec, err := simulatedDroneSpec()
+		return droneImage(simImage), spec, err
 	} else {
-		return runOnboardDrone(img)
+		return droneImage(img), onboardDroneSpec(), nil
 	}
 }
 
-func runOnboardDrone(imageName string) error {
-	droneEnv := envList("ID", "PASSWORD", "FCU_URL", "GCS_URL", "DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION")
-	config := &container.Config{
-		Env: droneEnv,
-		Cmd: []string{},
-		Tty: true,
+func onboardDroneSpec() *engine.Spec {
+	droneEnv := backendEnv(envList("ID", "PASSWORD", "GCS_URL", "DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION"))
+	if url := droneFCUURL(); url != "" {
+		droneEnv = append(droneEnv, "FCU_URL="+url)
 	}
-	policy := container.RestartPolicy{}
-	if !NoRestart {
-		policy.Name = "unless-stopped"
+	spec := &engine.Spec{
+		Env:         droneEnv,
+		Cmd:         []string{},
+		Tty:         true,
+		Privileged:  true,
+		NetworkMode: "host",
 	}
-	hostConfig := &container.HostConfig{
-		Privileged:    true,
-		NetworkMode:   "host",
-		RestartPolicy: policy,
+	if !NoRestart {
+		spec.RestartPolicy = "unless-stopped"
 	}
-	return startContainer("drone", imageName, config, hostConfig)
+	return spec
 }
 
-func runSimulatedDrone(imageName string) error {
-	location := viper.GetString("MOCK_POSITION")
-	if location == "" {
-		return errors.New("location must be set for simulation")
+func simulatedDroneSpec() (*engine.Spec, error) {
+	spec, err := simulatedInstanceSpec(0, 1)
+	if err != nil {
+		return nil, err
 	}
 	if err := writeConfig(); err != nil {
-		return errors.New("failed writing location to config")
-	}
-	simType := viper.GetString("SIM_TYPE")
-	if simType == "" {
-		return errors.New("simulation type not set, run dmctl config obc")
-	}
-	droneEnv := envList("ID", "PASSWORD", "DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION")
-	config := &container.Config{
-		Env: droneEnv,
-		Cmd: []string{
-			fmt.Sprintf("--location %s,0", location),
-			fmt.Sprintf("--%s", simType),
-		},
-		Tty: true,
+		return nil, errors.New("failed writing location to config")
 	}
-	hostConfig := &container.HostConfig{}
-	return startContainer("drone", imageName, config, hostConfig)
+	return spec, nil
 }
 
 func init() {
@@ -109,6 +131,6 @@ func init() {
 		panic(err)
 	}
 
-	startDroneCmd.PersistentFlags().BoolVarP(&NoRestart, "no_restart", "n", false, "Do not enable automatic restart")
+	startCmd.PersistentFlags().BoolVarP(&NoRestart, "no_restart", "n", false, "Do not enable automatic restart")
 
 }
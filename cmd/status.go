@@ -0,0 +1,420 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/mavlink"
+	"github.com/airpelago/dmctl/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var StatusTimeout time.Duration
+
+// statusCmd represents the status command
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show the health of the drone container, FCU link and backend",
+	Args:  cobra.NoArgs,
+	RunE:  runStatus,
+}
+
+// statusResult is the schema of dmctl status --output json|yaml. Checks
+// that could not be made have their error set.
+type statusResult struct {
+	Profile   string          `json:"profile" yaml:"profile"`
+	Image     imageStatus     `json:"image" yaml:"image"`
+	Container containerHealth `json:"container" yaml:"container"`
+	FCU       fcuStatus       `json:"fcu" yaml:"fcu"`
+	Backend   backendStatus   `json:"backend" yaml:"backend"`
+}
+
+type imageStatus struct {
+	Name    string `json:"name" yaml:"name"`
+	Version string `json:"version" yaml:"version"`
+	Digest  string `json:"digest,omitempty" yaml:"digest,omitempty"`
+	// RemoteDigest is what Version currently points to in the registry.
+	RemoteDigest  string `json:"remote_digest,omitempty" yaml:"remote_digest,omitempty"`
+	LatestVersion string `json:"latest_version,omitempty" yaml:"latest_version,omitempty"`
+	// UpToDate is only known if a digest is Pinned, which dmctl pull does.
+	UpToDate bool   `json:"up_to_date" yaml:"up_to_date"`
+	Pinned   bool   `json:"pinned" yaml:"pinned"`
+	Error    string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type containerHealth struct {
+	Name          string     `json:"name" yaml:"name"`
+	State         string     `json:"state" yaml:"state"`
+	Running       bool       `json:"running" yaml:"running"`
+	RestartCount  int        `json:"restart_count" yaml:"restart_count"`
+	UptimeSeconds int64      `json:"uptime_seconds" yaml:"uptime_seconds"`
+	ExitCode      int        `json:"exit_code" yaml:"exit_code"`
+	FinishedAt    *time.Time `json:"finished_at,omitempty" yaml:"finished_at,omitempty"`
+	CPUPercent    float64    `json:"cpu_percent" yaml:"cpu_percent"`
+	MemoryBytes   uint64     `json:"memory_bytes" yaml:"memory_bytes"`
+	MemoryLimit   uint64     `json:"memory_limit_bytes" yaml:"memory_limit_bytes"`
+	// DmctlVersion is the version of dmctl that created the container.
+	DmctlVersion string `json:"dmctl_version,omitempty" yaml:"dmctl_version,omitempty"`
+	// Drift is why the container doesn't match the current configuration.
+	Drift string `json:"drift,omitempty" yaml:"drift,omitempty"`
+	Error string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type fcuStatus struct {
+	URL string `json:"url" yaml:"url"`
+	// Endpoint is where heartbeats were listened for, the GCS_URL forward
+	// while the drone container holds FCU_URL.
+	Endpoint    string `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Heartbeat   bool   `json:"heartbeat" yaml:"heartbeat"`
+	SystemID    uint8  `json:"system_id,omitempty" yaml:"system_id,omitempty"`
+	ComponentID uint8  `json:"component_id,omitempty" yaml:"component_id,omitempty"`
+	Autopilot   string `json:"autopilot,omitempty" yaml:"autopilot,omitempty"`
+	Type        string `json:"type,omitempty" yaml:"type,omitempty"`
+	Armed       bool   `json:"armed" yaml:"armed"`
+	Error       string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+type backendStatus struct {
+	URL       string `json:"url" yaml:"url"`
+	Reachable bool   `json:"reachable" yaml:"reachable"`
+	LatencyMS int64  `json:"latency_ms,omitempty" yaml:"latency_ms,omitempty"`
+	Error     string `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// runStatus exits with exitNotRunning if the drone container isn't running.
+func runStatus(cmd *cobra.Command, args []string) error {
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return errNoImage
+	}
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	ctx := context.Background()
+	result := statusResult{
+		Profile:   activeProfile(),
+		Container: checkContainer(ctx, eng, s, droneService),
+	}
+
+	// The network checks can each take up to StatusTimeout, run them side by
+	// side.
+	var wg sync.WaitGroup
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		result.Image = checkImage(ctx, img)
+	}()
+	go func() {
+		defer wg.Done()
+		result.FCU = checkFCU(ctx, result.Container.Running)
+	}()
+	go func() {
+		defer wg.Done()
+		result.Backend = checkBackend(ctx)
+	}()
+	wg.Wait()
+
+	if err := printResult(result, func(w io.Writer) { printStatus(w, &result) }); err != nil {
+		return err
+	}
+	if !result.Container.Running {
+		return &exitError{Code: exitNotRunning}
+	}
+	return nil
+}
+
+func checkContainer(ctx context.Context, eng engine.Engine, s *stack, service string) containerHealth {
+	health := containerHealth{Name: containerName(service), State: "not created"}
+	state, err := eng.Inspect(ctx, health.Name)
+	if err != nil {
+		// Inspecting a container that doesn't exist is not an error here.
+		return health
+	}
+	health.State = state.Status
+	health.Running = state.Running
+	health.DmctlVersion = state.Labels[versionLabel]
+	health.Drift = serviceDrift(s, service, state.Labels)
+	health.RestartCount = state.RestartCount
+	health.ExitCode = state.ExitCode
+	if !state.FinishedAt.IsZero() {
+		health.FinishedAt = &state.FinishedAt
+	}
+	if !state.Running {
+		return health
+	}
+	if !state.StartedAt.IsZero() {
+		health.UptimeSeconds = int64(time.Since(state.StartedAt).Seconds())
+	}
+	stats, err := eng.Stats(ctx, health.Name)
+	if err != nil {
+		health.Error = err.Error()
+		return health
+	}
+	health.CPUPercent = stats.CPUPercent
+	health.MemoryBytes = stats.MemoryUsage
+	health.MemoryLimit = stats.MemoryLimit
+	return health
+}
+
+func checkImage(ctx context.Context, img string) imageStatus {
+	ref := registry.ParseReference(imageBase() + img + ":" + imageVersion())
+	status := imageStatus{
+		Name:    ref.Name(),
+		Version: imageVersion(),
+		Digest:  viper.GetString("IMAGE_DIGEST"),
+	}
+	status.Pinned = status.Digest != ""
+	ctx, cancel := context.WithTimeout(ctx, StatusTimeout)
+	defer cancel()
+	creds, err := registryCredentials(ref.Registry)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	client := &registry.Client{HTTPClient: httpClient, Credentials: creds}
+	if status.RemoteDigest, err = client.Digest(ctx, ref); err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.UpToDate = status.Pinned && status.Digest == status.RemoteDigest
+	tags, err := client.Tags(ctx, ref)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	registry.SortTags(tags)
+	if len(tags) > 0 && tags[0] != "latest" {
+		status.LatestVersion = tags[0]
+	}
+	return status
+}
+
+// checkFCU listens for a heartbeat on FCU_URL. The drone container or the
+// MAVLink router holds that endpoint while it runs, so then a forward to
+// this host is listened on instead.
+func checkFCU(ctx context.Context, running bool) fcuStatus {
+	status := fcuStatus{URL: viper.GetString("FCU_URL")}
+	if status.URL == "" {
+		status.Error = "FCU_URL is not configured"
+		return status
+	}
+	ep, err := mavlink.ParseURL(status.URL)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if routerEnabled() && routerRunning() {
+		ep = nil
+		for _, f := range append([]string{viper.GetString("GCS_URL")}, splitList(viper.GetString("GCS_FORWARDS"))...) {
+			if ep = localForward(f); ep != nil {
+				break
+			}
+		}
+		if ep == nil {
+			status.Error = "the MAVLink router holds the FCU link, add a local udp forwarding endpoint to monitor it"
+			return status
+		}
+	} else if running {
+		ep = localForward(viper.GetString("GCS_URL"))
+		if ep == nil {
+			status.Error = "the drone container holds the FCU link, set GCS_URL to a local udp endpoint to monitor it"
+			return status
+		}
+	}
+	status.Endpoint = ep.String()
+
+	ctx, cancel := context.WithTimeout(ctx, StatusTimeout)
+	defer cancel()
+	r, err := ep.Open(ctx)
+	if err == mavlink.ErrInUse {
+		status.Error = fmt.Sprintf("%s is in use by another process", ep)
+		return status
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	defer r.Close()
+	hb, err := mavlink.WaitHeartbeat(ctx, r)
+	if err == context.DeadlineExceeded {
+		status.Error = fmt.Sprintf("no heartbeat within %s", StatusTimeout)
+		return status
+	}
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	status.Heartbeat = true
+	status.SystemID = hb.SystemID
+	status.ComponentID = hb.ComponentID
+	status.Autopilot = hb.AutopilotName()
+	status.Type = hb.TypeName()
+	status.Armed = hb.Armed()
+	return status
+}
+
+// localForward returns an endpoint receiving what mavros forwards to a
+// GCS_URL on this host, or nil if it forwards elsewhere.
+func localForward(gcsURL string) *mavlink.Endpoint {
+	ep, err := mavlink.ParseURL(gcsURL)
+	if err != nil || ep.Scheme != "udp" || ep.Remote == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(ep.Remote)
+	if err != nil {
+		return nil
+	}
+	if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return nil
+	}
+	return &mavlink.Endpoint{Scheme: "udp", Bind: ep.Remote}
+}
+
+// checkBackend makes a request to the backend the onboard software uses. Any
+// HTTP response counts as reachable.
+func checkBackend(ctx context.Context) backendStatus {
+	status := backendStatus{URL: viper.GetString("DMC_URI")}
+	if status.URL == "" {
+		status.URL = apiURL()
+	}
+	u, err := url.Parse(status.URL)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	switch u.Scheme {
+	case "ws":
+		u.Scheme = "http"
+	case "wss":
+		u.Scheme = "https"
+	}
+	client, err := apiHTTPClient()
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	ctx, cancel := context.WithTimeout(ctx, StatusTimeout)
+	defer cancel()
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	start := time.Now()
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	resp.Body.Close()
+	status.Reachable = true
+	status.LatencyMS = int64(time.Since(start) / time.Millisecond)
+	return status
+}
+
+func printStatus(w io.Writer, s *statusResult) {
+	fmt.Fprintf(w, "Profile\t%s\n", s.Profile)
+
+	img := fmt.Sprintf("%s:%s", s.Image.Name, s.Image.Version)
+	if s.Image.Digest != "" {
+		img += fmt.Sprintf(" (%s)", shortDigest(s.Image.Digest))
+	}
+	fmt.Fprintf(w, "Image\t%s\n", img)
+	switch {
+	case s.Image.Error != "":
+		fmt.Fprintf(w, "Latest\tunknown, %s\n", s.Image.Error)
+	case !s.Image.Pinned:
+		fmt.Fprintf(w, "Latest\tunknown, no digest is pinned, run dmctl pull to pin %s\n", s.Image.Version)
+	case !s.Image.UpToDate:
+		fmt.Fprintf(w, "Latest\t%s points to %s, run dmctl upgrade\n", s.Image.Version, shortDigest(s.Image.RemoteDigest))
+	case s.Image.LatestVersion != "" && s.Image.LatestVersion != s.Image.Version:
+		fmt.Fprintf(w, "Latest\t%s is available, run dmctl upgrade --version %s\n", s.Image.LatestVersion, s.Image.LatestVersion)
+	default:
+		fmt.Fprintf(w, "Latest\tup to date\n")
+	}
+
+	c := s.Container
+	if c.Running {
+		fmt.Fprintf(w, "Container\t%s %s for %s, %d restarts\n", c.Name, c.State, time.Duration(c.UptimeSeconds)*time.Second, c.RestartCount)
+	} else {
+		fmt.Fprintf(w, "Container\t%s %s\n", c.Name, c.State)
+	}
+	if c.Drift != "" {
+		fmt.Fprintf(w, "Drift\t%s, run dmctl start --recreate\n", c.Drift)
+	}
+	if c.FinishedAt != nil {
+		fmt.Fprintf(w, "Last exit\tcode %d at %s\n", c.ExitCode, c.FinishedAt.Local().Format(time.RFC1123))
+	}
+	if c.Error != "" {
+		fmt.Fprintf(w, "Resources\tunknown, %s\n", c.Error)
+	} else if c.Running {
+		mem := formatBytes(c.MemoryBytes)
+		if c.MemoryLimit > 0 {
+			mem += " / " + formatBytes(c.MemoryLimit)
+		}
+		fmt.Fprintf(w, "Resources\tCPU %.1f%%, memory %s\n", c.CPUPercent, mem)
+	}
+
+	if s.FCU.Heartbeat {
+		armed := "disarmed"
+		if s.FCU.Armed {
+			armed = "armed"
+		}
+		fmt.Fprintf(w, "FCU\theartbeat from system %d (%s %s, %s)\n", s.FCU.SystemID, s.FCU.Autopilot, s.FCU.Type, armed)
+	} else {
+		fmt.Fprintf(w, "FCU\t%s\n", s.FCU.Error)
+	}
+
+	if s.Backend.Reachable {
+		fmt.Fprintf(w, "Backend\t%s reachable in %dms\n", s.Backend.URL, s.Backend.LatencyMS)
+	} else {
+		fmt.Fprintf(w, "Backend\t%s unreachable, %s\n", s.Backend.URL, s.Backend.Error)
+	}
+}
+
+func formatBytes(n uint64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := uint64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+
+	statusCmd.Flags().DurationVar(&StatusTimeout, "timeout", 3*time.Second, "How long to wait for heartbeats and network checks")
+}
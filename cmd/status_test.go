@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/airpelago/dmctl/mavlink"
+	"github.com/spf13/viper"
+)
+
+// sendHeartbeats sends armed autopilot heartbeats to addr until stop is
+// closed.
+func sendHeartbeats(t *testing.T, addr string, stop chan struct{}) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hb := &mavlink.Heartbeat{Type: 2, Autopilot: 3, BaseMode: 0x80}
+	frame := mavlink.Encode(&mavlink.Frame{SystemID: 1, ComponentID: 1, MessageID: mavlink.MsgHeartbeat, Payload: hb.Payload()})
+	go func() {
+		defer conn.Close()
+		for {
+			conn.Write(frame)
+			select {
+			case <-stop:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+		}
+	}()
+}
+
+func freeUDPAddr(t *testing.T) string {
+	l, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.LocalAddr().String()
+}
+
+func TestStatus(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	Output = outputJSON
+	stderr = &bytes.Buffer{}
+	StatusTimeout = time.Second
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.NotFound(w, r)
+	}))
+	defer backend.Close()
+	viper.Set("DMC_URI", strings.Replace(backend.URL, "http", "ws", 1))
+	viper.Set("REGISTRY", "127.0.0.1:1")
+	gcs := freeUDPAddr(t)
+	viper.Set("FCU_URL", "serial:///dev/ttyACM0:921600")
+	viper.Set("GCS_URL", "udp://@"+gcs)
+	stop := make(chan struct{})
+	defer close(stop)
+	sendHeartbeats(t, gcs, stop)
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.SetStats("drone", engine.Stats{CPUPercent: 12.5, MemoryUsage: 64 << 20, MemoryLimit: 1 << 30})
+	out.Reset()
+	if err := runStatus(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	var result statusResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("invalid json %q: %v", out.String(), err)
+	}
+	if c := result.Container; !c.Running || c.CPUPercent != 12.5 || c.MemoryBytes != 64<<20 || c.Drift != "" {
+		t.Errorf("unexpected container status %+v", c)
+	}
+	if f := result.FCU; !f.Heartbeat || !f.Armed || f.SystemID != 1 || f.Endpoint != "udp://"+gcs+"@" {
+		t.Errorf("unexpected fcu status %+v", f)
+	}
+	if !result.Backend.Reachable {
+		t.Errorf("unexpected backend status %+v", result.Backend)
+	}
+	if result.Image.Error == "" || result.Image.Digest == "" || !result.Image.Pinned {
+		t.Errorf("unexpected image status %+v", result.Image)
+	}
+}
+
+func TestStatusNotRunning(t *testing.T) {
+	fake, out, teardown := setupFake(t)
+	defer teardown()
+	StatusTimeout = 100 * time.Millisecond
+	viper.Set("REGISTRY", "127.0.0.1:1")
+	viper.Set("DMC_URI", "http://127.0.0.1:1")
+	viper.Set("FCU_URL", "udp://"+freeUDPAddr(t)+"@")
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	fake.OnStart = func(c *engine.FakeContainer) {
+		c.Running = false
+		c.ExitCode = 2
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	out.Reset()
+	err := runStatus(nil, nil)
+	if exit, ok := err.(*exitError); !ok || exit.Code != exitNotRunning {
+		t.Fatalf("expected not running exit code, got %v", err)
+	}
+	for _, want := range []string{"drone exited", "no heartbeat within 100ms", "unreachable"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("missing %q in %q", want, out.String())
+		}
+	}
+}
+
+func TestLocalForward(t *testing.T) {
+	if ep := localForward("udp://@127.0.0.1:14550"); ep == nil || ep.Bind != "127.0.0.1:14550" {
+		t.Errorf("unexpected forward %+v", ep)
+	}
+	for _, u := range []string{"", "udp://@10.0.0.5:14550", "udp://:14550@", "tcp://localhost"} {
+		if ep := localForward(u); ep != nil {
+			t.Errorf("%s: unexpected forward %+v", u, ep)
+		}
+	}
+}
+
+func TestPrintStatusUnpinned(t *testing.T) {
+	result := &statusResult{
+		Profile: defaultProfile,
+		Image:   imageStatus{Name: "docker.io/tobiasfriden/dmc-rpi", Version: "latest", RemoteDigest: "sha256:200"},
+	}
+	var out bytes.Buffer
+	printStatus(&out, result)
+	if !strings.Contains(out.String(), "no digest is pinned") || strings.Contains(out.String(), "dmctl upgrade") {
+		t.Errorf("unpinned image reported as outdated: %q", out.String())
+	}
+}
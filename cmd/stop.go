@@ -16,15 +16,32 @@ limitations under the License.
 package cmd
 
 import (
+	"fmt"
+	"time"
+
 	"github.com/spf13/cobra"
 	"github.com/spf13/viper"
 )
 
+const defaultStopTimeout = 10 * time.Second
+
+var (
+	StopTimeout time.Duration
+	KeepStopped bool
+)
+
 // stopCmd represents the stop command
 var stopCmd = &cobra.Command{
-	Use:   "stop",
+	Use:   "stop [SERVICE...]",
 	Short: "Stop dmc containers",
-	RunE:  runStopDrone,
+	Long: `Stops the services of the stack, or only the given services. Services
+are stopped before the services they depend on.
+
+Containers are sent SIGTERM and killed if they haven't exited within
+--time, or STOP_TIMEOUT. They are then removed, unless --keep or
+KEEP_STOPPED is set, in which case they are kept for inspection until
+dmctl rm or the next dmctl start.`,
+	RunE: runStopStack,
 }
 
 // stopCmd represents the stop command
@@ -34,16 +51,50 @@ var stopDroneCmd = &cobra.Command{
 	RunE:  runStopDrone,
 }
 
+func runStopStack(cmd *cobra.Command, args []string) error {
+	s, err := loadStack()
+	if err != nil {
+		return err
+	}
+	if _, err := s.order(args); err != nil {
+		return err
+	}
+	order, err := s.order(s.names())
+	if err != nil {
+		return err
+	}
+	stop := map[string]bool{}
+	for _, name := range args {
+		stop[name] = true
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		name := order[i]
+		if len(args) > 0 && !stop[name] {
+			continue
+		}
+		var err error
+		if name == droneService {
+			err = runStopDrone(cmd, nil)
+		} else {
+			err = runStop(containerName(name))
+		}
+		if err != nil {
+			return fmt.Errorf("failed stopping %s: %s", name, err)
+		}
+	}
+	return nil
+}
+
 func runStopDrone(cmd *cobra.Command, args []string) error {
 	img := viper.GetString("IMAGE")
 	if img == "" {
 		return errNoImage
 	}
-	return runStop("drone", img)
+	return runStop(containerName("drone"))
 }
 
-func runStop(name, imageName string) error {
-	running, err := containerRunning(imageName)
+func runStop(name string) error {
+	running, err := containerRunning(name)
 	if err != nil {
 		return err
 	}
@@ -51,11 +102,14 @@ func runStop(name, imageName string) error {
 		bad(name + " not running")
 		return nil
 	}
-	return stopContainer(name, imageName)
+	return stopContainer(name, keepStopped())
 }
 
 func init() {
 	rootCmd.AddCommand(stopCmd)
 
 	stopCmd.AddCommand(stopDroneCmd)
+
+	stopCmd.PersistentFlags().DurationVarP(&StopTimeout, "time", "t", 0, "How long containers get to exit before they are killed (default STOP_TIMEOUT or 10s)")
+	stopCmd.PersistentFlags().BoolVar(&KeepStopped, "keep", false, "Keep stopped containers for inspection until dmctl rm")
 }
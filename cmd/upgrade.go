@@ -0,0 +1,284 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	HealthWindow time.Duration
+	FailMarkers  []string
+
+	healthInterval = 2 * time.Second
+)
+
+// droneKeys are the settings besides the image version that the drone
+// container is created from. They are kept with the previous image on
+// upgrade, so that a rollback recreates the container the way it was.
+var droneKeys = []string{
+	"IMAGE", "REGISTRY", "NAMESPACE", "ID", "FCU_URL", "MAVLINK_ROUTER", "GCS_URL",
+	"DMC_URI", "DMC_SESSION_URI", "DMC_ANIP_URI", "MOCK_IMSI", "MOCK_POSITION",
+	"SIM_TYPE", "SIM_HEADING", "SIM_SPEEDUP", "SIM_WIND",
+}
+
+// upgradeCmd represents the upgrade command
+var upgradeCmd = &cobra.Command{
+	Use:   "upgrade",
+	Short: "Upgrade the drone container, rolling back if it fails to start",
+	Args:  cobra.NoArgs,
+	RunE:  runUpgrade,
+}
+
+// rollbackCmd represents the rollback command
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Roll the drone container back to the version before the last upgrade",
+	Args:  cobra.NoArgs,
+	RunE:  runRollback,
+}
+
+func runUpgrade(cmd *cobra.Command, args []string) error {
+	img := viper.GetString("IMAGE")
+	if img == "" {
+		return errNoImage
+	}
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	// Refuse before the config is changed, so that it isn't left pointing
+	// at a version that wasn't started.
+	if err := checkArmed("upgrade " + containerName(droneService)); err != nil {
+		return err
+	}
+	saved := map[string]string{}
+	for _, key := range []string{"IMAGE_VERSION", "IMAGE_DIGEST", "PREVIOUS_IMAGE_VERSION", "PREVIOUS_IMAGE_DIGEST"} {
+		saved[key] = viper.GetString(key)
+	}
+	savedSettings := viper.GetStringMapString("PREVIOUS_DRONE_SETTINGS")
+	prevSettings := droneSettings()
+	prevVersion := imageVersion()
+	prevDigest := viper.GetString("IMAGE_DIGEST")
+	if prevDigest == "" {
+		prevDigest, _ = eng.ImageDigest(context.Background(), droneImage(img))
+	}
+
+	if err := runPullDrone(cmd, args); err != nil {
+		return err
+	}
+	digest := viper.GetString("IMAGE_DIGEST")
+	running, err := containerRunning(containerName("drone"))
+	if err != nil {
+		return err
+	}
+	if running && digest != "" && digest == prevDigest {
+		good("Drone is already up to date")
+		return nil
+	}
+
+	if prevDigest == "" {
+		// A previous version left from an older upgrade isn't what runs
+		// now, rolling back to it would skip a version.
+		warn("Could not resolve the current digest, rollback will not be possible")
+		prevVersion, prevSettings = "", map[string]string{}
+	}
+	viper.Set("PREVIOUS_IMAGE_VERSION", prevVersion)
+	viper.Set("PREVIOUS_IMAGE_DIGEST", prevDigest)
+	viper.Set("PREVIOUS_DRONE_SETTINGS", prevSettings)
+	if err := writeConfig(); err != nil {
+		return err
+	}
+
+	Recreate = true
+	if err := runStartDrone(cmd, args); err != nil {
+		if armedRefusal(err) {
+			// The vehicle was armed after the check above, the old
+			// container still runs.
+			for key, value := range saved {
+				viper.Set(key, value)
+			}
+			viper.Set("PREVIOUS_DRONE_SETTINGS", savedSettings)
+			if err := writeConfig(); err != nil {
+				return err
+			}
+			return err
+		}
+		return rollbackAfter(err)
+	}
+	if err := watchHealth(containerName("drone"), HealthWindow); err != nil {
+		return rollbackAfter(err)
+	}
+	good(fmt.Sprintf("Upgraded drone to %s", imageVersion()))
+	return nil
+}
+
+// rollbackAfter rolls back after a failed upgrade, if there is something to
+// roll back to.
+func rollbackAfter(cause error) error {
+	bad(fmt.Sprintf("Upgrade failed: %s", cause))
+	if viper.GetString("PREVIOUS_IMAGE_DIGEST") == "" {
+		return errors.Wrap(cause, "upgrade failed")
+	}
+	if err := rollback(); err != nil {
+		if armedRefusal(err) {
+			return err
+		}
+		return errors.Wrap(err, "rollback failed")
+	}
+	return errors.Wrap(cause, fmt.Sprintf("upgrade failed, rolled back to %s", imageVersion()))
+}
+
+func runRollback(cmd *cobra.Command, args []string) error {
+	if viper.GetString("PREVIOUS_IMAGE_DIGEST") == "" {
+		return errors.New("nothing to roll back to, no upgrade has been made")
+	}
+	if err := checkArmed("roll back " + containerName(droneService)); err != nil {
+		return err
+	}
+	if err := rollback(); err != nil {
+		return err
+	}
+	good(fmt.Sprintf("Rolled drone back to %s", imageVersion()))
+	return nil
+}
+
+// rollback swaps the current and previous image and drone settings and
+// recreates the drone container, so that a second rollback undoes the first.
+// The swap is undone if the interlock refuses to replace the container.
+func rollback() error {
+	if err := swapPrevious(); err != nil {
+		return err
+	}
+	Recreate = true
+	if err := runStartDrone(nil, nil); err != nil {
+		if armedRefusal(err) {
+			if err := swapPrevious(); err != nil {
+				return err
+			}
+		}
+		return err
+	}
+	return nil
+}
+
+func swapPrevious() error {
+	version, digest, settings := imageVersion(), viper.GetString("IMAGE_DIGEST"), droneSettings()
+	viper.Set("IMAGE_VERSION", viper.GetString("PREVIOUS_IMAGE_VERSION"))
+	viper.Set("IMAGE_DIGEST", viper.GetString("PREVIOUS_IMAGE_DIGEST"))
+	// Upgrades made by older versions didn't keep the settings.
+	if prev := viper.GetStringMapString("PREVIOUS_DRONE_SETTINGS"); len(prev) > 0 {
+		for _, key := range droneKeys {
+			viper.Set(key, prev[strings.ToLower(key)])
+		}
+	}
+	viper.Set("PREVIOUS_IMAGE_VERSION", version)
+	viper.Set("PREVIOUS_IMAGE_DIGEST", digest)
+	viper.Set("PREVIOUS_DRONE_SETTINGS", settings)
+	return writeConfig()
+}
+
+// droneSettings returns the current values of droneKeys.
+func droneSettings() map[string]string {
+	settings := map[string]string{}
+	for _, key := range droneKeys {
+		settings[strings.ToLower(key)] = viper.GetString(key)
+	}
+	return settings
+}
+
+// watchHealth fails if the named container stops, restarts or logs one of
+// the fail markers within window.
+func watchHealth(name string, window time.Duration) error {
+	eng, err := getEngine()
+	if err != nil {
+		return err
+	}
+	markers := make([]*regexp.Regexp, len(FailMarkers))
+	for i, m := range FailMarkers {
+		if markers[i], err = regexp.Compile(m); err != nil {
+			return errors.Wrap(err, "invalid fail marker")
+		}
+	}
+	ctx := context.Background()
+	initial, err := eng.Inspect(ctx, name)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdout, "Watching %s for %s..\n", name, window)
+	deadline := time.Now().Add(window)
+	for {
+		state, err := eng.Inspect(ctx, name)
+		if err != nil {
+			return err
+		}
+		if !state.Running {
+			return fmt.Errorf("%s exited with code %d", name, state.ExitCode)
+		}
+		if state.RestartCount > initial.RestartCount {
+			return fmt.Errorf("%s restarted %d times", name, state.RestartCount-initial.RestartCount)
+		}
+		if err := checkFailMarkers(eng, name, markers); err != nil {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return nil
+		}
+		time.Sleep(healthInterval)
+	}
+}
+
+func checkFailMarkers(eng engine.Engine, name string, markers []*regexp.Regexp) error {
+	if len(markers) == 0 {
+		return nil
+	}
+	out, err := eng.Logs(context.Background(), name, engine.LogOptions{})
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	logs, err := ioutil.ReadAll(out)
+	if err != nil {
+		return err
+	}
+	for _, line := range strings.Split(string(logs), "\n") {
+		for _, m := range markers {
+			if m.MatchString(line) {
+				return fmt.Errorf("%s logged %q", name, strings.TrimSpace(line))
+			}
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(upgradeCmd, rollbackCmd)
+
+	upgradeCmd.Flags().StringVar(&ImageVersion, "version", "", "Version to upgrade to (default configured version)")
+	upgradeCmd.Flags().DurationVar(&HealthWindow, "health-window", time.Minute, "How long the new container must stay healthy")
+	upgradeCmd.Flags().StringSliceVar(&FailMarkers, "fail-marker", []string{"panic:", "fatal error:"}, "Log pattern that fails the upgrade")
+}
@@ -0,0 +1,182 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/airpelago/dmctl/engine"
+	"github.com/spf13/viper"
+)
+
+func setupUpgrade(t *testing.T) (*engine.Fake, func()) {
+	fake, _, teardown := setupFake(t)
+	healthInterval = time.Millisecond
+	HealthWindow = 5 * time.Millisecond
+	FailMarkers = []string{"panic:"}
+
+	fake.SetDigest(imageBase()+"dmc-rpi:1.0.0", "sha256:100")
+	fake.SetDigest(imageBase()+"dmc-rpi:2.0.0", "sha256:200")
+	ImageVersion = "1.0.0"
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	ImageVersion = "2.0.0"
+	return fake, func() {
+		healthInterval = 2 * time.Second
+		HealthWindow = time.Minute
+		FailMarkers = nil
+		teardown()
+	}
+}
+
+func TestUpgrade(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+
+	if err := runUpgrade(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("drone"); c == nil || c.Image != imageBase()+"dmc-rpi@sha256:200" {
+		t.Fatalf("drone not upgraded: %+v", c)
+	}
+	if viper.GetString("PREVIOUS_IMAGE_DIGEST") != "sha256:100" {
+		t.Errorf("previous digest not kept")
+	}
+
+	if err := runRollback(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if c := fake.Get("drone"); c == nil || c.Image != imageBase()+"dmc-rpi@sha256:100" {
+		t.Fatalf("drone not rolled back: %+v", c)
+	}
+	if imageVersion() != "1.0.0" || viper.GetString("PREVIOUS_IMAGE_VERSION") != "2.0.0" {
+		t.Errorf("versions not swapped")
+	}
+}
+
+func TestUpgradeCrashRollsBack(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+
+	fake.OnStart = func(c *engine.FakeContainer) {
+		if strings.HasSuffix(c.Image, "sha256:200") {
+			c.Running = false
+			c.ExitCode = 2
+		}
+	}
+	err := runUpgrade(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "rolled back to 1.0.0") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	c := fake.Get("drone")
+	if c == nil || !c.Running || c.Image != imageBase()+"dmc-rpi@sha256:100" {
+		t.Fatalf("drone not rolled back: %+v", c)
+	}
+}
+
+func TestUpgradeFailMarkerRollsBack(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+
+	fake.OnStart = func(c *engine.FakeContainer) {
+		if strings.HasSuffix(c.Image, "sha256:200") {
+			c.Output = "starting\npanic: no FCU heartbeat\n"
+		}
+	}
+	err := runUpgrade(nil, nil)
+	if err == nil || !strings.Contains(err.Error(), "panic: no FCU heartbeat") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	if c := fake.Get("drone"); c == nil || c.Image != imageBase()+"dmc-rpi@sha256:100" {
+		t.Fatalf("drone not rolled back: %+v", c)
+	}
+}
+
+func TestUpgradeWhileArmed(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+	defer armedHeartbeats(t)()
+
+	err := runUpgrade(nil, nil)
+	if !armedRefusal(err) {
+		t.Fatalf("expected upgrade to be refused, got %v", err)
+	}
+	if fake.Pulled(imageBase() + "dmc-rpi:2.0.0") {
+		t.Error("image pulled while armed")
+	}
+	if imageVersion() != "1.0.0" || viper.GetString("PREVIOUS_IMAGE_DIGEST") != "" {
+		t.Errorf("config changed while armed")
+	}
+	if c := fake.Get("drone"); c == nil || !c.Running || c.Image != imageBase()+"dmc-rpi@sha256:100" {
+		t.Fatalf("drone replaced while armed: %+v", c)
+	}
+}
+
+func TestRollbackWhileArmed(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+	if err := runUpgrade(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer armedHeartbeats(t)()
+
+	err := runRollback(nil, nil)
+	if !armedRefusal(err) {
+		t.Fatalf("expected rollback to be refused, got %v", err)
+	}
+	if imageVersion() != "2.0.0" || viper.GetString("PREVIOUS_IMAGE_VERSION") != "1.0.0" {
+		t.Errorf("versions swapped while armed")
+	}
+	if c := fake.Get("drone"); c == nil || c.Image != imageBase()+"dmc-rpi@sha256:200" {
+		t.Fatalf("drone replaced while armed: %+v", c)
+	}
+}
+
+func TestRollbackRestoresSettings(t *testing.T) {
+	fake, teardown := setupUpgrade(t)
+	defer teardown()
+	viper.Set("FCU_URL", "udp://:14550")
+
+	if err := runUpgrade(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	viper.Set("FCU_URL", "tcp://127.0.0.1:5760")
+	if err := writeConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if err := runRollback(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := viper.GetString("FCU_URL"); got != "udp://:14550" {
+		t.Errorf("FCU_URL not rolled back, got %s", got)
+	}
+	c := fake.Get("drone")
+	if c == nil || !strings.Contains(strings.Join(c.Spec.Env, " "), "FCU_URL=udp://:14550") {
+		t.Fatalf("drone not recreated with the previous settings: %+v", c)
+	}
+}
+
+func TestUpgradeUnresolvedDigestClearsPrevious(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	healthInterval = time.Millisecond
+	HealthWindow = 5 * time.Millisecond
+	defer func() {
+		healthInterval = 2 * time.Second
+		HealthWindow = time.Minute
+	}()
+	// Left from an upgrade before the image was changed.
+	viper.Set("PREVIOUS_IMAGE_VERSION", "0.9.0")
+	viper.Set("PREVIOUS_IMAGE_DIGEST", "sha256:090")
+
+	if err := runUpgrade(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if viper.GetString("PREVIOUS_IMAGE_VERSION") != "" || viper.GetString("PREVIOUS_IMAGE_DIGEST") != "" {
+		t.Errorf("stale previous version kept: %s %s", viper.GetString("PREVIOUS_IMAGE_VERSION"), viper.GetString("PREVIOUS_IMAGE_DIGEST"))
+	}
+}
@@ -0,0 +1,85 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/airpelago/dmctl/registry"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// versionsCmd represents the versions command
+var versionsCmd = &cobra.Command{
+	Use:   "versions [IMAGE]",
+	Short: "Lists available versions of the onboard software",
+	Args:  cobra.MaximumNArgs(1),
+	RunE:  runVersions,
+}
+
+// versionsResult is the schema of dmctl versions --output json|yaml.
+// Versions are sorted newest first.
+type versionsResult struct {
+	Image    string   `json:"image" yaml:"image"`
+	Current  string   `json:"current,omitempty" yaml:"current,omitempty"`
+	Digest   string   `json:"digest,omitempty" yaml:"digest,omitempty"`
+	Versions []string `json:"versions" yaml:"versions"`
+}
+
+func runVersions(cmd *cobra.Command, args []string) error {
+	img := viper.GetString("IMAGE")
+	if len(args) == 1 {
+		img = args[0]
+	}
+	if img == "" {
+		return errNoImage
+	}
+	ref := registry.ParseReference(imageBase() + img)
+	creds, err := registryCredentials(ref.Registry)
+	if err != nil {
+		return err
+	}
+	client := &registry.Client{HTTPClient: httpClient, Credentials: creds}
+	tags, err := client.Tags(context.Background(), ref)
+	if err != nil {
+		return err
+	}
+	registry.SortTags(tags)
+	result := versionsResult{Image: ref.Name(), Versions: tags}
+	if img == viper.GetString("IMAGE") {
+		result.Current = imageVersion()
+		result.Digest = viper.GetString("IMAGE_DIGEST")
+	}
+	return printResult(result, func(w io.Writer) {
+		for _, tag := range tags {
+			if tag == result.Current {
+				fmt.Fprintf(w, "* %s\n", tag)
+			} else {
+				fmt.Fprintf(w, "  %s\n", tag)
+			}
+		}
+		if result.Current != "" && result.Digest != "" {
+			fmt.Fprintf(w, "\n%s is pinned to %s\n", result.Current, result.Digest)
+		}
+	})
+}
+
+func init() {
+	rootCmd.AddCommand(versionsCmd)
+}
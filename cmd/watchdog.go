@@ -0,0 +1,132 @@
+/*
+Copyright © 2019 NAME HERE <EMAIL ADDRESS>
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"context"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// watchdogSec is the WatchdogSec of the drone service.
+const watchdogSec = 30
+
+var superviseInterval = 5 * time.Second
+
+var serviceSuperviseCmd = &cobra.Command{
+	Use:    "supervise NAME -- COMMAND...",
+	Short:  "Runs a container for systemd, notifying it while the container runs",
+	Hidden: true,
+	Args:   cobra.MinimumNArgs(2),
+	RunE:   runServiceSupervise,
+}
+
+// runServiceSupervise runs the command that runs the named container and
+// tells systemd the service is ready once the container runs. The watchdog
+// is only fed while the runtime reports the container running, so a hung
+// runtime or a container that stopped behind the command's back gets the
+// service restarted.
+func runServiceSupervise(cmd *cobra.Command, args []string) error {
+	name, run := args[0], args[1:]
+	c := exec.Command(run[0], run[1:]...)
+	c.Stdout, c.Stderr = os.Stdout, os.Stderr
+	if err := c.Start(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- c.Wait()
+	}()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, os.Interrupt)
+	defer signal.Stop(signals)
+
+	interval := superviseInterval
+	if usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC")); err == nil && usec > 0 {
+		if half := time.Duration(usec) * time.Microsecond / 2; half < interval {
+			interval = half
+		}
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	ready := false
+	for {
+		select {
+		case err := <-done:
+			if exitErr, ok := err.(*exec.ExitError); ok {
+				return &exitError{Code: exitErr.ExitCode()}
+			}
+			return err
+		case sig := <-signals:
+			c.Process.Signal(sig)
+		case <-ticker.C:
+			if !supervisedRunning(name, interval) {
+				continue
+			}
+			if !ready {
+				sdNotify("READY=1")
+				ready = true
+			}
+			sdNotify("WATCHDOG=1")
+		}
+	}
+}
+
+// supervisedRunning reports whether the runtime answers within timeout that
+// the named container runs.
+func supervisedRunning(name string, timeout time.Duration) bool {
+	eng, err := getEngine()
+	if err != nil {
+		return false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	state, err := eng.Inspect(ctx, name)
+	return err == nil && state.Running
+}
+
+// sdNotify sends a state to the service manager, if dmctl runs under one
+// that listens.
+func sdNotify(state string) error {
+	socket := os.Getenv("NOTIFY_SOCKET")
+	if socket == "" {
+		return nil
+	}
+	if socket[0] == '@' {
+		// An abstract socket.
+		socket = "\x00" + socket[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// Don't hang on a service manager that stopped reading.
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err = conn.Write([]byte(state))
+	return err
+}
+
+func init() {
+	serviceCmd.AddCommand(serviceSuperviseCmd)
+}
@@ -0,0 +1,60 @@
+package cmd
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceSupervise(t *testing.T) {
+	_, _, teardown := setupFake(t)
+	defer teardown()
+	superviseInterval = 10 * time.Millisecond
+	defer func() {
+		superviseInterval = 5 * time.Second
+	}()
+	socket := filepath.Join(os.Getenv("HOME"), "notify")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: socket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	os.Setenv("NOTIFY_SOCKET", socket)
+	defer os.Unsetenv("NOTIFY_SOCKET")
+
+	// Nothing is sent before the container runs.
+	if err := runServiceSupervise(nil, []string{"drone", "sh", "-c", "sleep 0.05"}); err != nil {
+		t.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	buf := make([]byte, 64)
+	if n, err := conn.Read(buf); err == nil {
+		t.Fatalf("notified %q without a running container", buf[:n])
+	}
+
+	if err := runPullDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := runStartDrone(nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	err = runServiceSupervise(nil, []string{"drone", "sh", "-c", "sleep 0.05; exit 3"})
+	if exit, ok := err.(*exitError); !ok || exit.Code != 3 {
+		t.Errorf("exit code not passed on: %v", err)
+	}
+	var states []string
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for len(states) < 2 {
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		states = append(states, string(buf[:n]))
+	}
+	if got := strings.Join(states, ","); got != "READY=1,WATCHDOG=1" {
+		t.Errorf("unexpected notifications %s", got)
+	}
+}
@@ -0,0 +1,467 @@
+package engine
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/registry"
+)
+
+// Containerd is an Engine backed by containerd. It drives the ctr CLI that
+// ships with containerd rather than linking the containerd client.
+//
+// Containers run without a TTY since ctr can't combine one with a log file,
+// restart policies rely on the containerd restart monitor and ports can't
+// be published without CNI.
+type Containerd struct {
+	Namespace string
+	LogDir    string
+
+	run func(ctx context.Context, args ...string) ([]byte, error)
+}
+
+const restartLabel = "containerd.io/restart.status"
+
+// NewContainerd checks that ctr can reach containerd and returns an Engine
+// using the dmctl namespace.
+func NewContainerd() (*Containerd, error) {
+	if _, err := exec.LookPath("ctr"); err != nil {
+		return nil, fmt.Errorf("ctr not found, install containerd")
+	}
+	c := &Containerd{
+		Namespace: "dmctl",
+		LogDir:    "/var/log/dmctl",
+		run:       runCtr,
+	}
+	if _, err := c.ctr(context.Background(), "version"); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+func runCtr(ctx context.Context, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, "ctr", args...)
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("ctr: %s", msg)
+		}
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *Containerd) ctr(ctx context.Context, args ...string) ([]byte, error) {
+	return c.run(ctx, append([]string{"--namespace", c.Namespace}, args...)...)
+}
+
+// Version returns the server version printed by ctr version.
+func (c *Containerd) Version(ctx context.Context) (string, error) {
+	out, err := c.ctr(ctx, "version")
+	if err != nil {
+		return "", err
+	}
+	version := ""
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		// The client version comes first, the server version last.
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 && fields[0] == "Version:" {
+			version = fields[1]
+		}
+	}
+	if version == "" {
+		return "", fmt.Errorf("could not parse ctr version output")
+	}
+	return version, scanner.Err()
+}
+
+// Pull only supports user name and password credentials, ctr has no way to
+// pass identity tokens.
+func (c *Containerd) Pull(ctx context.Context, ref string, creds *registry.Credentials, w io.Writer) error {
+	args := []string{"images", "pull"}
+	if creds != nil && creds.Username != "" {
+		args = append(args, "--user", creds.Username+":"+creds.Password)
+	}
+	out, err := c.ctr(ctx, append(args, ref)...)
+	if err != nil {
+		return err
+	}
+	if w != nil {
+		_, err = w.Write(out)
+	}
+	return err
+}
+
+// ImageDigest looks ref up in the REF TYPE DIGEST table printed by ctr
+// images list.
+func (c *Containerd) ImageDigest(ctx context.Context, ref string) (string, error) {
+	out, err := c.ctr(ctx, "images", "list")
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 3 && fields[0] == ref {
+			return fields[2], nil
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("image %s not found", ref)
+}
+
+func (c *Containerd) Create(ctx context.Context, spec *Spec) (string, error) {
+	if spec.Name == "" {
+		return "", fmt.Errorf("containerd containers must be named")
+	}
+	args := []string{"containers", "create"}
+	if spec.Privileged {
+		args = append(args, "--privileged")
+	}
+	if spec.NetworkMode == "host" {
+		args = append(args, "--net-host")
+	}
+	for _, env := range spec.Env {
+		args = append(args, "--env", env)
+	}
+	for k, v := range spec.Labels {
+		args = append(args, "--label", k+"="+v)
+	}
+	for _, d := range spec.Devices {
+		if host, inContainer := splitDevice(d); host != inContainer {
+			return "", fmt.Errorf("containerd can't map device %s to another path", d)
+		}
+		args = append(args, "--device", d)
+	}
+	mounts, err := ctrMounts(spec.Mounts)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, mounts...)
+	if len(spec.Ports) > 0 {
+		return "", fmt.Errorf("containerd can't publish ports, use the host network")
+	}
+	if spec.RestartPolicy != "" {
+		args = append(args, "--label", restartLabel+"=running")
+	}
+	args = append(args, spec.Image, spec.Name)
+	args = append(args, spec.Cmd...)
+	if _, err := c.ctr(ctx, args...); err != nil {
+		return "", err
+	}
+	return spec.Name, nil
+}
+
+// ctrMounts returns the ctr --mount flags of bind mounts.
+func ctrMounts(mounts []string) ([]string, error) {
+	var args []string
+	for _, m := range mounts {
+		host, inContainer, readOnly, err := splitMount(m)
+		if err != nil {
+			return nil, err
+		}
+		options := "rbind:rw"
+		if readOnly {
+			options = "rbind:ro"
+		}
+		args = append(args, "--mount", fmt.Sprintf("type=bind,src=%s,dst=%s,options=%s", host, inContainer, options))
+	}
+	return args, nil
+}
+
+func (c *Containerd) Start(ctx context.Context, id string) error {
+	if err := os.MkdirAll(c.LogDir, 0755); err != nil {
+		return err
+	}
+	_, err := c.ctr(ctx, "tasks", "start", "--detach", "--log-uri", "file://"+c.logPath(id), id)
+	return err
+}
+
+func (c *Containerd) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	running, err := c.runningTasks(ctx)
+	if err != nil || !running[id] {
+		return err
+	}
+	if _, err := c.ctr(ctx, "tasks", "kill", "--signal", "SIGTERM", id); err != nil {
+		return err
+	}
+	if c.waitStopped(ctx, id, timeout) {
+		return nil
+	}
+	if _, err := c.ctr(ctx, "tasks", "kill", "--signal", "SIGKILL", id); err != nil {
+		return err
+	}
+	if !c.waitStopped(ctx, id, 5*time.Second) {
+		return fmt.Errorf("container %s did not stop", id)
+	}
+	return nil
+}
+
+func (c *Containerd) Remove(ctx context.Context, id string, force bool) error {
+	if force {
+		// The task may already have exited, in which case kill fails.
+		c.ctr(ctx, "tasks", "kill", "--signal", "SIGKILL", id)
+		c.waitStopped(ctx, id, 5*time.Second)
+	}
+	if _, err := c.ctr(ctx, "tasks", "delete", id); err != nil && !strings.Contains(err.Error(), "not found") {
+		return err
+	}
+	_, err := c.ctr(ctx, "containers", "delete", id)
+	return err
+}
+
+// waitStopped reports whether the task of id stopped within timeout.
+func (c *Containerd) waitStopped(ctx context.Context, id string, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for {
+		running, err := c.runningTasks(ctx)
+		if err != nil || !running[id] {
+			return true
+		}
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+type containerdInfo struct {
+	ID        string            `json:"ID"`
+	Labels    map[string]string `json:"Labels"`
+	Image     string            `json:"Image"`
+	CreatedAt time.Time         `json:"CreatedAt"`
+}
+
+func (c *Containerd) List(ctx context.Context) ([]Container, error) {
+	running, err := c.runningTasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var list []Container
+	for id := range running {
+		out, err := c.ctr(ctx, "containers", "info", id)
+		if err != nil {
+			return nil, err
+		}
+		var info containerdInfo
+		if err := json.Unmarshal(out, &info); err != nil {
+			return nil, err
+		}
+		list = append(list, Container{
+			ID:      info.ID,
+			Name:    info.ID,
+			Image:   info.Image,
+			Labels:  info.Labels,
+			Created: info.CreatedAt,
+		})
+	}
+	return list, nil
+}
+
+// Inspect only reports the task status, ctr does not expose restart counts
+// or exit codes.
+func (c *Containerd) Inspect(ctx context.Context, id string) (*State, error) {
+	out, err := c.ctr(ctx, "containers", "info", id)
+	if err != nil {
+		return nil, err
+	}
+	var info containerdInfo
+	if err := json.Unmarshal(out, &info); err != nil {
+		return nil, err
+	}
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	status, ok := tasks[id]
+	if !ok {
+		status = "CREATED"
+	}
+	return &State{
+		Status:  strings.ToLower(status),
+		Running: status == "RUNNING",
+		ID:      info.ID,
+		Image:   info.Image,
+		Labels:  info.Labels,
+		Created: info.CreatedAt,
+	}, nil
+}
+
+func (c *Containerd) runningTasks(ctx context.Context) (map[string]bool, error) {
+	tasks, err := c.tasks(ctx)
+	if err != nil {
+		return nil, err
+	}
+	running := map[string]bool{}
+	for id, status := range tasks {
+		if status == "RUNNING" {
+			running[id] = true
+		}
+	}
+	return running, nil
+}
+
+// tasks parses the TASK PID STATUS table printed by ctr tasks list.
+func (c *Containerd) tasks(ctx context.Context) (map[string]string, error) {
+	out, err := c.ctr(ctx, "tasks", "list")
+	if err != nil {
+		return nil, err
+	}
+	tasks := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(out))
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[0] == "TASK" {
+			continue
+		}
+		tasks[fields[0]] = fields[2]
+	}
+	return tasks, scanner.Err()
+}
+
+// Logs reads the file the task logs to, which carries no timestamps, so
+// only Follow and Tail are supported.
+func (c *Containerd) Logs(ctx context.Context, id string, opts LogOptions) (io.ReadCloser, error) {
+	if !opts.Since.IsZero() || !opts.Until.IsZero() || opts.Timestamps {
+		return nil, fmt.Errorf("containerd logs have no timestamps, since, until and timestamps are not supported")
+	}
+	f, err := os.Open(c.logPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if opts.Tail > 0 {
+		offset, err := tailOffset(f, opts.Tail)
+		if err == nil {
+			_, err = f.Seek(offset, io.SeekStart)
+		}
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+	if !opts.Follow {
+		return f, nil
+	}
+	return &followReader{ctx: ctx, f: f}, nil
+}
+
+// tailOffset returns the offset of the last n lines of r.
+func tailOffset(r io.Reader, n int) (int64, error) {
+	// starts holds the offsets of the last n lines seen.
+	starts := make([]int64, 0, n)
+	var offset int64
+	br := bufio.NewReader(r)
+	for {
+		line, err := br.ReadBytes('\n')
+		if len(line) > 0 {
+			if len(starts) == n {
+				starts = starts[1:]
+			}
+			starts = append(starts, offset)
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+	if len(starts) == 0 {
+		return offset, nil
+	}
+	return starts[0], nil
+}
+
+func (c *Containerd) logPath(id string) string {
+	return filepath.Join(c.LogDir, id+".log")
+}
+
+// followReader keeps reading a file as it grows until ctx is done.
+type followReader struct {
+	ctx context.Context
+	f   *os.File
+}
+
+func (r *followReader) Read(p []byte) (int, error) {
+	for {
+		n, err := r.f.Read(p)
+		if n > 0 || err != io.EOF {
+			return n, err
+		}
+		select {
+		case <-r.ctx.Done():
+			return 0, io.EOF
+		case <-time.After(250 * time.Millisecond):
+		}
+	}
+}
+
+func (r *followReader) Close() error {
+	return r.f.Close()
+}
+
+// Stats is not supported, ctr prints raw cgroup metrics that differ between
+// cgroup versions.
+func (c *Containerd) Stats(ctx context.Context, id string) (*Stats, error) {
+	return nil, fmt.Errorf("resource usage is not available with containerd")
+}
+
+// Save exports through a temporary file since ctr only writes archives to
+// files.
+func (c *Containerd) Save(ctx context.Context, refs []string, w io.Writer) error {
+	f, err := ioutil.TempFile("", "dmctl-export")
+	if err != nil {
+		return err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+	if _, err := c.ctr(ctx, append([]string{"images", "export", f.Name()}, refs...)...); err != nil {
+		return err
+	}
+	f, err = os.Open(f.Name())
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(w, f)
+	return err
+}
+
+func (c *Containerd) Load(ctx context.Context, r io.Reader, w io.Writer) error {
+	f, err := ioutil.TempFile("", "dmctl-import")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	_, err = io.Copy(f, r)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	out, err := c.ctr(ctx, "images", "import", f.Name())
+	if err != nil {
+		return err
+	}
+	if w != nil {
+		_, err = w.Write(out)
+	}
+	return err
+}
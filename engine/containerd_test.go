@@ -0,0 +1,150 @@
+package engine
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func fakeCtr(calls *[]string, outputs map[string]string) func(context.Context, ...string) ([]byte, error) {
+	return func(ctx context.Context, args ...string) ([]byte, error) {
+		call := strings.Join(args, " ")
+		*calls = append(*calls, call)
+		for prefix, out := range outputs {
+			if strings.HasPrefix(call, prefix) {
+				return []byte(out), nil
+			}
+		}
+		return nil, fmt.Errorf("unexpected call ctr %s", call)
+	}
+}
+
+func TestContainerdList(t *testing.T) {
+	var calls []string
+	c := &Containerd{
+		Namespace: "dmctl",
+		run: fakeCtr(&calls, map[string]string{
+			"--namespace dmctl tasks list": "TASK     PID     STATUS\n" +
+				"drone    1234    RUNNING\n" +
+				"old      0       STOPPED\n",
+			"--namespace dmctl containers info drone": `{
+				"ID": "drone",
+				"Labels": {"dmctl.profile": "default"},
+				"Image": "docker.io/tobiasfriden/dmc-rpi:latest",
+				"CreatedAt": "2019-08-01T10:00:00Z"
+			}`,
+		}),
+	}
+	list, err := c.List(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 {
+		t.Fatalf("expected 1 container, got %d", len(list))
+	}
+	got := list[0]
+	if got.Name != "drone" || got.Image != "docker.io/tobiasfriden/dmc-rpi:latest" || got.Labels["dmctl.profile"] != "default" {
+		t.Errorf("unexpected container %+v", got)
+	}
+	if got.Created.Year() != 2019 {
+		t.Errorf("unexpected created time %s", got.Created)
+	}
+}
+
+func TestContainerdCreate(t *testing.T) {
+	var calls []string
+	c := &Containerd{
+		Namespace: "dmctl",
+		run: fakeCtr(&calls, map[string]string{
+			"--namespace dmctl containers create": "",
+		}),
+	}
+	id, err := c.Create(context.Background(), &Spec{
+		Name:          "drone",
+		Image:         "docker.io/tobiasfriden/dmc-rpi",
+		Env:           []string{"ID=1"},
+		Privileged:    true,
+		NetworkMode:   "host",
+		RestartPolicy: "unless-stopped",
+		Mounts:        []string{"/home/pi/copter.parm:/params/copter.parm:ro"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != "drone" {
+		t.Errorf("unexpected id %s", id)
+	}
+	want := "--namespace dmctl containers create --privileged --net-host --env ID=1 " +
+		"--mount type=bind,src=/home/pi/copter.parm,dst=/params/copter.parm,options=rbind:ro --label " +
+		restartLabel + "=running docker.io/tobiasfriden/dmc-rpi drone"
+	if len(calls) != 1 || calls[0] != want {
+		t.Errorf("unexpected calls %q", calls)
+	}
+}
+
+func TestContainerdStop(t *testing.T) {
+	for _, ignoreTerm := range []bool{false, true} {
+		var calls []string
+		status := "RUNNING"
+		c := &Containerd{
+			Namespace: "dmctl",
+			run: func(ctx context.Context, args ...string) ([]byte, error) {
+				call := strings.Join(args[2:], " ")
+				calls = append(calls, call)
+				switch call {
+				case "tasks list":
+					return []byte("TASK     PID     STATUS\ndrone    1234    " + status + "\n"), nil
+				case "tasks kill --signal SIGTERM drone":
+					if !ignoreTerm {
+						status = "STOPPED"
+					}
+				case "tasks kill --signal SIGKILL drone":
+					status = "STOPPED"
+				default:
+					return nil, fmt.Errorf("unexpected call ctr %s", call)
+				}
+				return nil, nil
+			},
+		}
+		if err := c.Stop(context.Background(), "drone", 200*time.Millisecond); err != nil {
+			t.Fatal(err)
+		}
+		killed := strings.Contains(strings.Join(calls, "\n"), "SIGKILL")
+		if killed != ignoreTerm {
+			t.Errorf("ignoring SIGTERM %v, killed %v: %v", ignoreTerm, killed, calls)
+		}
+	}
+}
+
+func TestContainerdVersion(t *testing.T) {
+	var calls []string
+	c := &Containerd{
+		Namespace: "dmctl",
+		run: fakeCtr(&calls, map[string]string{
+			"--namespace dmctl version": "Client:\n  Version:  v1.2.5\n  Revision: bb71b10\n\n" +
+				"Server:\n  Version:  v1.2.6\n  Revision: 894b81a\n",
+		}),
+	}
+	version, err := c.Version(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != "v1.2.6" {
+		t.Errorf("unexpected version %s", version)
+	}
+}
+
+func TestTailOffset(t *testing.T) {
+	log := "one\ntwo\nthree\n"
+	for n, want := range map[int]string{1: "three\n", 2: "two\nthree\n", 5: log} {
+		offset, err := tailOffset(strings.NewReader(log), n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := log[offset:]; got != want {
+			t.Errorf("tail %d: got %q, want %q", n, got, want)
+		}
+	}
+}
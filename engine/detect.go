@@ -0,0 +1,62 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	RuntimeDocker     = "docker"
+	RuntimePodman     = "podman"
+	RuntimeContainerd = "containerd"
+)
+
+// Runtimes lists the supported container runtimes.
+var Runtimes = []string{RuntimeDocker, RuntimePodman, RuntimeContainerd}
+
+const (
+	dockerSocket     = "/var/run/docker.sock"
+	containerdSocket = "/run/containerd/containerd.sock"
+)
+
+// New connects to the named runtime, detecting one if name is empty.
+func New(name string) (Engine, error) {
+	if name == "" {
+		name = Detect()
+	}
+	switch name {
+	case RuntimeDocker:
+		return NewDocker("")
+	case RuntimePodman:
+		return NewPodman()
+	case RuntimeContainerd:
+		return NewContainerd()
+	}
+	return nil, fmt.Errorf("unknown runtime %s, must be one of: %s", name, strings.Join(Runtimes, ", "))
+}
+
+// Detect picks a runtime based on which sockets are available, preferring
+// Docker, and falls back to Docker if none is found.
+func Detect() string {
+	if os.Getenv("DOCKER_HOST") != "" || exists(dockerSocket) {
+		return RuntimeDocker
+	}
+	if os.Getenv("CONTAINER_HOST") != "" {
+		return RuntimePodman
+	}
+	for _, sock := range podmanSockets() {
+		if exists(sock) {
+			return RuntimePodman
+		}
+	}
+	if exists(containerdSocket) {
+		return RuntimeContainerd
+	}
+	return RuntimeDocker
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
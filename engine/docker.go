@@ -0,0 +1,318 @@
+package engine
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/registry"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/jsonmessage"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/docker/go-connections/nat"
+)
+
+// Docker is an Engine backed by the Docker daemon.
+type Docker struct {
+	client *client.Client
+}
+
+// NewDocker connects to the Docker daemon configured by the environment, or
+// to the Docker compatible API at host if it is not empty.
+func NewDocker(host string) (*Docker, error) {
+	opts := []func(*client.Client) error{client.FromEnv}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := cli.ContainerList(context.Background(), types.ContainerListOptions{}); err != nil {
+		return nil, err
+	}
+	return &Docker{client: cli}, nil
+}
+
+func (d *Docker) Version(ctx context.Context) (string, error) {
+	v, err := d.client.ServerVersion(ctx)
+	if err != nil {
+		return "", err
+	}
+	return v.Version, nil
+}
+
+func (d *Docker) Pull(ctx context.Context, ref string, creds *registry.Credentials, w io.Writer) error {
+	var opts types.ImagePullOptions
+	if creds != nil {
+		auth, err := json.Marshal(types.AuthConfig{
+			Username:      creds.Username,
+			Password:      creds.Password,
+			IdentityToken: creds.IdentityToken,
+			ServerAddress: registry.ParseReference(ref).Registry,
+		})
+		if err != nil {
+			return err
+		}
+		opts.RegistryAuth = base64.URLEncoding.EncodeToString(auth)
+	}
+	out, err := d.client.ImagePull(ctx, ref, opts)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return displayProgress(out, w)
+}
+
+// displayProgress writes the JSON progress stream of the Docker API to w.
+func displayProgress(out io.Reader, w io.Writer) error {
+	if w == nil {
+		_, err := io.Copy(ioutil.Discard, out)
+		return err
+	}
+	var fd uintptr
+	isTerminal := false
+	if f, ok := w.(*os.File); ok {
+		fd = f.Fd()
+		isTerminal = true
+	}
+	return jsonmessage.DisplayJSONMessagesStream(
+		out,
+		w,
+		fd,
+		isTerminal,
+		func(message jsonmessage.JSONMessage) {},
+	)
+}
+
+func (d *Docker) ImageDigest(ctx context.Context, ref string) (string, error) {
+	image, _, err := d.client.ImageInspectWithRaw(ctx, ref)
+	if err != nil {
+		return "", err
+	}
+	name := registry.ParseReference(ref).Name()
+	for _, rd := range image.RepoDigests {
+		parsed := registry.ParseReference(rd)
+		if parsed.Name() == name {
+			return parsed.Digest, nil
+		}
+	}
+	return "", fmt.Errorf("no registry digest for %s", ref)
+}
+
+func (d *Docker) Create(ctx context.Context, spec *Spec) (string, error) {
+	config := &container.Config{
+		Image:  spec.Image,
+		Env:    spec.Env,
+		Cmd:    spec.Cmd,
+		Labels: spec.Labels,
+		Tty:    spec.Tty,
+	}
+	if spec.StopTimeout > 0 {
+		secs := int(spec.StopTimeout.Seconds())
+		config.StopTimeout = &secs
+	}
+	hostConfig := &container.HostConfig{
+		Privileged:    spec.Privileged,
+		NetworkMode:   container.NetworkMode(spec.NetworkMode),
+		RestartPolicy: container.RestartPolicy{Name: spec.RestartPolicy},
+	}
+	for _, d := range spec.Devices {
+		host, inContainer := splitDevice(d)
+		hostConfig.Devices = append(hostConfig.Devices, container.DeviceMapping{
+			PathOnHost:        host,
+			PathInContainer:   inContainer,
+			CgroupPermissions: "rwm",
+		})
+	}
+	for _, m := range spec.Mounts {
+		if _, _, _, err := splitMount(m); err != nil {
+			return "", err
+		}
+		hostConfig.Binds = append(hostConfig.Binds, m)
+	}
+	if len(spec.Ports) > 0 {
+		exposed, bindings, err := nat.ParsePortSpecs(spec.Ports)
+		if err != nil {
+			return "", err
+		}
+		config.ExposedPorts = exposed
+		hostConfig.PortBindings = bindings
+	}
+	resp, err := d.client.ContainerCreate(ctx, config, hostConfig, nil, spec.Name)
+	if err != nil {
+		return "", err
+	}
+	return resp.ID, nil
+}
+
+func (d *Docker) Start(ctx context.Context, id string) error {
+	return d.client.ContainerStart(ctx, id, types.ContainerStartOptions{})
+}
+
+func (d *Docker) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	return d.client.ContainerStop(ctx, id, &timeout)
+}
+
+func (d *Docker) Remove(ctx context.Context, id string, force bool) error {
+	return d.client.ContainerRemove(ctx, id, types.ContainerRemoveOptions{Force: force})
+}
+
+func (d *Docker) List(ctx context.Context) ([]Container, error) {
+	containers, err := d.client.ContainerList(ctx, types.ContainerListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Container, len(containers))
+	for i, c := range containers {
+		var name string
+		if len(c.Names) > 0 {
+			name = strings.TrimPrefix(c.Names[0], "/")
+		}
+		list[i] = Container{
+			ID:      c.ID,
+			Name:    name,
+			Image:   c.Image,
+			Labels:  c.Labels,
+			Created: time.Unix(c.Created, 0),
+		}
+	}
+	return list, nil
+}
+
+func (d *Docker) Inspect(ctx context.Context, id string) (*State, error) {
+	c, err := d.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	state := &State{ID: c.ID, RestartCount: c.RestartCount}
+	state.Created, _ = time.Parse(time.RFC3339Nano, c.Created)
+	if c.Config != nil {
+		state.Image = c.Config.Image
+		state.Labels = c.Config.Labels
+	}
+	if c.State != nil {
+		state.Status = c.State.Status
+		state.Running = c.State.Running
+		state.ExitCode = c.State.ExitCode
+		state.StartedAt, _ = time.Parse(time.RFC3339Nano, c.State.StartedAt)
+		state.FinishedAt, _ = time.Parse(time.RFC3339Nano, c.State.FinishedAt)
+	}
+	return state, nil
+}
+
+// Logs of containers without a tty are multiplexed with a header per
+// frame, they are demultiplexed so that callers always get plain text.
+func (d *Docker) Logs(ctx context.Context, id string, opts LogOptions) (io.ReadCloser, error) {
+	info, err := d.client.ContainerInspect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	logOpts := types.ContainerLogsOptions{
+		ShowStderr: true,
+		ShowStdout: true,
+		Follow:     opts.Follow,
+		Timestamps: opts.Timestamps,
+		Tail:       "all",
+	}
+	if opts.Tail > 0 {
+		logOpts.Tail = strconv.Itoa(opts.Tail)
+	}
+	if !opts.Since.IsZero() {
+		logOpts.Since = strconv.FormatInt(opts.Since.Unix(), 10)
+	}
+	if !opts.Until.IsZero() {
+		logOpts.Until = strconv.FormatInt(opts.Until.Unix(), 10)
+	}
+	rc, err := d.client.ContainerLogs(ctx, id, logOpts)
+	if err != nil {
+		return nil, err
+	}
+	if info.Config != nil && info.Config.Tty {
+		return rc, nil
+	}
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := stdcopy.StdCopy(pw, pw, rc)
+		pw.CloseWithError(err)
+	}()
+	return &demuxReader{PipeReader: pr, rc: rc}, nil
+}
+
+// demuxReader closes the log stream along with the demultiplexed pipe.
+type demuxReader struct {
+	*io.PipeReader
+	rc io.Closer
+}
+
+func (r *demuxReader) Close() error {
+	r.PipeReader.Close()
+	return r.rc.Close()
+}
+
+// Stats takes a single sample, which the daemon computes over about a
+// second.
+func (d *Docker) Stats(ctx context.Context, id string) (*Stats, error) {
+	resp, err := d.client.ContainerStats(ctx, id, false)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var s types.StatsJSON
+	if err := json.NewDecoder(resp.Body).Decode(&s); err != nil {
+		return nil, err
+	}
+	stats := &Stats{
+		MemoryUsage: s.MemoryStats.Usage,
+		MemoryLimit: s.MemoryStats.Limit,
+	}
+	// Page cache is counted as usage by the kernel but can be reclaimed.
+	if cache, ok := s.MemoryStats.Stats["cache"]; ok && cache < stats.MemoryUsage {
+		stats.MemoryUsage -= cache
+	}
+	cpuDelta := float64(s.CPUStats.CPUUsage.TotalUsage) - float64(s.PreCPUStats.CPUUsage.TotalUsage)
+	systemDelta := float64(s.CPUStats.SystemUsage) - float64(s.PreCPUStats.SystemUsage)
+	cpus := float64(s.CPUStats.OnlineCPUs)
+	if cpus == 0 {
+		cpus = float64(len(s.CPUStats.CPUUsage.PercpuUsage))
+	}
+	if cpuDelta > 0 && systemDelta > 0 {
+		stats.CPUPercent = cpuDelta / systemDelta * cpus * 100
+	}
+	return stats, nil
+}
+
+func (d *Docker) Save(ctx context.Context, refs []string, w io.Writer) error {
+	out, err := d.client.ImageSave(ctx, refs)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	_, err = io.Copy(w, out)
+	return err
+}
+
+func (d *Docker) Load(ctx context.Context, r io.Reader, w io.Writer) error {
+	resp, err := d.client.ImageLoad(ctx, r, false)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if !resp.JSON {
+		if w == nil {
+			w = ioutil.Discard
+		}
+		_, err = io.Copy(w, resp.Body)
+		return err
+	}
+	return displayProgress(resp.Body, w)
+}
@@ -0,0 +1,135 @@
+// Package engine abstracts the container runtime used to run the Drone
+// Mission Control containers.
+package engine
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/airpelago/dmctl/registry"
+)
+
+// Engine is the set of container operations dmctl depends on.
+type Engine interface {
+	// Version returns the version of the runtime daemon.
+	Version(ctx context.Context) (string, error)
+	// Pull downloads an image, authenticating with creds if they are not
+	// nil and writing progress to w if it is not nil.
+	Pull(ctx context.Context, ref string, creds *registry.Credentials, w io.Writer) error
+	// ImageDigest returns the registry digest of a local image.
+	ImageDigest(ctx context.Context, ref string) (string, error)
+	// Create creates a container from spec and returns its id.
+	Create(ctx context.Context, spec *Spec) (string, error)
+	Start(ctx context.Context, id string) error
+	// Stop sends SIGTERM to the container and kills it if it hasn't exited
+	// within timeout. The stopped container is kept until removed.
+	Stop(ctx context.Context, id string, timeout time.Duration) error
+	Remove(ctx context.Context, id string, force bool) error
+	// List returns all running containers.
+	List(ctx context.Context) ([]Container, error)
+	// Inspect returns the state of a container by id or name, whether it is
+	// running or not.
+	Inspect(ctx context.Context, id string) (*State, error)
+	Logs(ctx context.Context, id string, opts LogOptions) (io.ReadCloser, error)
+	// Stats returns the resource usage of a running container.
+	Stats(ctx context.Context, id string) (*Stats, error)
+	// Save writes the images refs to w as an archive that Load accepts.
+	Save(ctx context.Context, refs []string, w io.Writer) error
+	// Load imports images saved by Save, writing progress to w if it is not
+	// nil.
+	Load(ctx context.Context, r io.Reader, w io.Writer) error
+}
+
+// Spec describes a container to create.
+type Spec struct {
+	Name          string
+	Image         string
+	Env           []string
+	Cmd           []string
+	Labels        map[string]string
+	Tty           bool
+	Privileged    bool
+	NetworkMode   string
+	RestartPolicy string
+	// Devices are HOST[:CONTAINER] device paths to make available.
+	Devices []string
+	// Ports are HOST:CONTAINER[/PROTOCOL] ports to publish, which only
+	// applies outside the host network.
+	Ports []string
+	// Mounts are HOST:CONTAINER[:ro] paths to bind mount.
+	Mounts []string
+	// StopTimeout is how long the container gets to exit after SIGTERM
+	// when it is stopped by the runtime or a service manager, the runtime
+	// default if 0.
+	StopTimeout time.Duration
+}
+
+// splitDevice splits a HOST[:CONTAINER] device into its paths.
+func splitDevice(device string) (string, string) {
+	parts := strings.SplitN(device, ":", 2)
+	if len(parts) == 1 {
+		return parts[0], parts[0]
+	}
+	return parts[0], parts[1]
+}
+
+// splitMount splits a HOST:CONTAINER[:ro] mount into its paths and whether
+// it is read only.
+func splitMount(mount string) (host, inContainer string, readOnly bool, err error) {
+	parts := strings.Split(mount, ":")
+	if len(parts) == 3 && parts[2] == "ro" {
+		return parts[0], parts[1], true, nil
+	}
+	if len(parts) != 2 {
+		return "", "", false, fmt.Errorf("invalid mount %s, expected HOST:CONTAINER[:ro]", mount)
+	}
+	return parts[0], parts[1], false, nil
+}
+
+// Container is a container known to the engine.
+type Container struct {
+	ID      string
+	Name    string
+	Image   string
+	Labels  map[string]string
+	Created time.Time
+}
+
+// State is the runtime state of a container.
+type State struct {
+	Status       string
+	Running      bool
+	RestartCount int
+	ExitCode     int
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	// ID, Image, Labels and Created are reported like by List, so that
+	// stopped containers can be told apart.
+	ID      string
+	Image   string
+	Labels  map[string]string
+	Created time.Time
+}
+
+// Stats is the resource usage of a container. CPUPercent is relative to
+// one CPU, so a container using two CPUs fully reports 200.
+type Stats struct {
+	CPUPercent  float64
+	MemoryUsage uint64
+	MemoryLimit uint64
+}
+
+// LogOptions controls what Logs returns.
+type LogOptions struct {
+	Follow bool
+	// Tail limits the output to the last Tail lines if it is positive.
+	Tail int
+	// Since and Until limit the output to lines logged in between, when set.
+	Since time.Time
+	Until time.Time
+	// Timestamps prefixes every line with the time it was logged.
+	Timestamps bool
+}
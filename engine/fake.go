@@ -0,0 +1,345 @@
+package engine
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/airpelago/dmctl/registry"
+)
+
+// Fake is an in-memory Engine for tests.
+type Fake struct {
+	mu         sync.Mutex
+	nextID     int
+	images     map[string]string
+	containers map[string]*FakeContainer
+	digests    map[string]string
+	creds      map[string]*registry.Credentials
+	stats      map[string]*Stats
+
+	// OnStart is called with the lock held whenever a container is started,
+	// to simulate crashes.
+	OnStart func(c *FakeContainer)
+}
+
+// FakeContainer is a container created in a Fake.
+type FakeContainer struct {
+	Container
+	Spec         Spec
+	Running      bool
+	Output       string
+	RestartCount int
+	ExitCode     int
+	// LogOptions are the options Logs was last called with.
+	LogOptions LogOptions
+	// StopTimeout is the timeout Stop was last called with.
+	StopTimeout time.Duration
+}
+
+// NewFake returns an empty Fake.
+func NewFake() *Fake {
+	return &Fake{
+		images:     map[string]string{},
+		containers: map[string]*FakeContainer{},
+		creds:      map[string]*registry.Credentials{},
+		stats:      map[string]*Stats{},
+	}
+}
+
+// Pulled reports whether ref has been pulled.
+func (f *Fake) Pulled(ref string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.hasImage(ref)
+}
+
+// SetDigest sets the digest the next pull of ref resolves to.
+func (f *Fake) SetDigest(ref, digest string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.digests == nil {
+		f.digests = map[string]string{}
+	}
+	f.digests[ref] = digest
+}
+
+// Get returns the container with the given name, or nil.
+func (f *Fake) Get(name string) *FakeContainer {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.byName(name)
+}
+
+// SetOutput sets the log output of the named container.
+func (f *Fake) SetOutput(name, output string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if c := f.byName(name); c != nil {
+		c.Output = output
+	}
+}
+
+// SetStats sets the resource usage reported for the named container.
+func (f *Fake) SetStats(name string, stats Stats) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats[name] = &stats
+}
+
+// PulledWith returns the credentials ref was last pulled with.
+func (f *Fake) PulledWith(ref string) *registry.Credentials {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.creds[ref]
+}
+
+func (f *Fake) Version(ctx context.Context) (string, error) {
+	return "fake", nil
+}
+
+func (f *Fake) Pull(ctx context.Context, ref string, creds *registry.Credentials, w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.creds[ref] = creds
+	digest := f.digests[ref]
+	if digest == "" {
+		digest = fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(ref)))
+	}
+	f.images[ref] = digest
+	if w != nil {
+		fmt.Fprintf(w, "Pulled %s\n", ref)
+	}
+	return nil
+}
+
+func (f *Fake) ImageDigest(ctx context.Context, ref string) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	digest, ok := f.images[ref]
+	if !ok {
+		return "", fmt.Errorf("no such image: %s", ref)
+	}
+	return digest, nil
+}
+
+func (f *Fake) Create(ctx context.Context, spec *Spec) (string, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !f.hasImage(spec.Image) {
+		return "", fmt.Errorf("no such image: %s", spec.Image)
+	}
+	if spec.Name != "" && f.byName(spec.Name) != nil {
+		return "", fmt.Errorf("container name %s is already in use", spec.Name)
+	}
+	f.nextID++
+	id := fmt.Sprintf("%012d", f.nextID)
+	labels := map[string]string{}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	f.containers[id] = &FakeContainer{
+		Container: Container{
+			ID:      id,
+			Name:    spec.Name,
+			Image:   spec.Image,
+			Labels:  labels,
+			Created: time.Now(),
+		},
+		Spec: *spec,
+	}
+	return id, nil
+}
+
+func (f *Fake) Start(ctx context.Context, id string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c, ok := f.containers[id]
+	if !ok {
+		return fmt.Errorf("no such container: %s", id)
+	}
+	c.Running = true
+	if f.OnStart != nil {
+		f.OnStart(c)
+	}
+	return nil
+}
+
+func (f *Fake) Stop(ctx context.Context, id string, timeout time.Duration) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.lookup(id)
+	if c == nil {
+		return fmt.Errorf("no such container: %s", id)
+	}
+	c.Running = false
+	c.StopTimeout = timeout
+	return nil
+}
+
+func (f *Fake) Remove(ctx context.Context, id string, force bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.lookup(id)
+	if c == nil {
+		return fmt.Errorf("no such container: %s", id)
+	}
+	if c.Running && !force {
+		return fmt.Errorf("container %s is running", id)
+	}
+	delete(f.containers, c.ID)
+	return nil
+}
+
+func (f *Fake) List(ctx context.Context) ([]Container, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var list []Container
+	for _, c := range f.containers {
+		if c.Running {
+			list = append(list, c.Container)
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list, nil
+}
+
+func (f *Fake) Inspect(ctx context.Context, id string) (*State, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.lookup(id)
+	if c == nil {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	status := "exited"
+	if c.Running {
+		status = "running"
+	}
+	return &State{
+		Status:       status,
+		Running:      c.Running,
+		RestartCount: c.RestartCount,
+		ExitCode:     c.ExitCode,
+		StartedAt:    c.Created,
+		ID:           c.ID,
+		Image:        c.Image,
+		Labels:       c.Labels,
+		Created:      c.Created,
+	}, nil
+}
+
+func (f *Fake) Logs(ctx context.Context, id string, opts LogOptions) (io.ReadCloser, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.lookup(id)
+	if c == nil {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	c.LogOptions = opts
+	output := c.Output
+	if opts.Tail > 0 {
+		lines := strings.SplitAfter(output, "\n")
+		if lines[len(lines)-1] == "" {
+			lines = lines[:len(lines)-1]
+		}
+		if len(lines) > opts.Tail {
+			lines = lines[len(lines)-opts.Tail:]
+		}
+		output = strings.Join(lines, "")
+	}
+	return ioutil.NopCloser(strings.NewReader(output)), nil
+}
+
+func (f *Fake) Stats(ctx context.Context, id string) (*Stats, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	c := f.lookup(id)
+	if c == nil {
+		return nil, fmt.Errorf("no such container: %s", id)
+	}
+	if !c.Running {
+		return nil, fmt.Errorf("container %s is not running", id)
+	}
+	stats := Stats{}
+	if s, ok := f.stats[c.Name]; ok {
+		stats = *s
+	}
+	return &stats, nil
+}
+
+// hasImage reports whether ref, which may be pinned to a digest, has been
+// pulled.
+func (f *Fake) hasImage(ref string) bool {
+	if _, ok := f.images[ref]; ok {
+		return true
+	}
+	want := registry.ParseReference(ref)
+	if want.Digest == "" {
+		return false
+	}
+	for pulled, digest := range f.images {
+		if registry.ParseReference(pulled).Name() == want.Name() && digest == want.Digest {
+			return true
+		}
+	}
+	return false
+}
+
+// lookup finds a container by id or name like the Docker API does.
+func (f *Fake) lookup(id string) *FakeContainer {
+	if c, ok := f.containers[id]; ok {
+		return c
+	}
+	return f.byName(id)
+}
+
+func (f *Fake) byName(name string) *FakeContainer {
+	for _, c := range f.containers {
+		if c.Name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+// Save writes the refs and digests of the images, one per line.
+func (f *Fake) Save(ctx context.Context, refs []string, w io.Writer) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, ref := range refs {
+		digest, ok := f.images[ref]
+		if !ok {
+			return fmt.Errorf("no such image: %s", ref)
+		}
+		if _, err := fmt.Fprintf(w, "%s %s\n", ref, digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (f *Fake) Load(ctx context.Context, r io.Reader, w io.Writer) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid image archive line %q", line)
+		}
+		f.images[fields[0]] = fields[1]
+		if w != nil {
+			fmt.Fprintf(w, "Loaded %s\n", fields[0])
+		}
+	}
+	return nil
+}
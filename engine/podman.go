@@ -0,0 +1,31 @@
+package engine
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// podmanSockets returns the candidate sockets of the Podman API service,
+// rootful first.
+func podmanSockets() []string {
+	sockets := []string{"/run/podman/podman.sock"}
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		sockets = append(sockets, filepath.Join(dir, "podman", "podman.sock"))
+	}
+	return sockets
+}
+
+// NewPodman connects to the Docker compatible API served by podman system
+// service. CONTAINER_HOST takes precedence over the default sockets.
+func NewPodman() (*Docker, error) {
+	if host := os.Getenv("CONTAINER_HOST"); host != "" {
+		return NewDocker(host)
+	}
+	for _, sock := range podmanSockets() {
+		if exists(sock) {
+			return NewDocker("unix://" + sock)
+		}
+	}
+	return nil, fmt.Errorf("podman socket not found, enable it with systemctl enable --now podman.socket")
+}
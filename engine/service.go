@@ -0,0 +1,115 @@
+package engine
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// ServiceCommands are the runtime CLI invocations a service manager uses to
+// run a container in the foreground.
+type ServiceCommands struct {
+	// Cleanup removes a leftover container with the same name.
+	Cleanup []string
+	Run     []string
+	Stop    []string
+	// StopTimeout is how long Stop may take, 0 if the runtime default.
+	StopTimeout time.Duration
+	// Requires is the unit of the runtime daemon, if there is one.
+	Requires string
+}
+
+// NewServiceCommands returns the commands running spec with the given runtime,
+// reading the container environment from envFile instead of spec.Env. The
+// restart policy of spec is ignored since restarts are left to the service
+// manager.
+func NewServiceCommands(runtime string, spec *Spec, envFile string) (*ServiceCommands, error) {
+	labels := make([]string, 0, len(spec.Labels))
+	for k, v := range spec.Labels {
+		labels = append(labels, k+"="+v)
+	}
+	sort.Strings(labels)
+
+	switch runtime {
+	case RuntimeDocker, RuntimePodman:
+		run := []string{runtime, "run", "--rm", "--name", spec.Name, "--env-file", envFile, "--log-driver", "journald"}
+		if spec.Privileged {
+			run = append(run, "--privileged")
+		}
+		if spec.NetworkMode != "" {
+			run = append(run, "--network", spec.NetworkMode)
+		}
+		if spec.Tty {
+			run = append(run, "--tty")
+		}
+		for _, d := range spec.Devices {
+			host, inContainer := splitDevice(d)
+			run = append(run, "--device", host+":"+inContainer+":rwm")
+		}
+		for _, p := range spec.Ports {
+			run = append(run, "--publish", p)
+		}
+		for _, m := range spec.Mounts {
+			if _, _, _, err := splitMount(m); err != nil {
+				return nil, err
+			}
+			run = append(run, "--volume", m)
+		}
+		for _, l := range labels {
+			run = append(run, "--label", l)
+		}
+		run = append(run, spec.Image)
+		run = append(run, spec.Cmd...)
+		stop := []string{runtime, "stop"}
+		if spec.StopTimeout > 0 {
+			stop = append(stop, "--time", strconv.Itoa(int(spec.StopTimeout.Seconds())))
+		}
+		cmds := &ServiceCommands{
+			Cleanup:     []string{runtime, "rm", "--force", spec.Name},
+			Run:         run,
+			Stop:        append(stop, spec.Name),
+			StopTimeout: spec.StopTimeout,
+		}
+		if runtime == RuntimeDocker {
+			cmds.Requires = "docker.service"
+		}
+		return cmds, nil
+	case RuntimeContainerd:
+		ctr := []string{"ctr", "--namespace", "dmctl"}
+		run := append(append([]string{}, ctr...), "run", "--rm", "--env-file", envFile)
+		if spec.Privileged {
+			run = append(run, "--privileged")
+		}
+		if spec.NetworkMode == "host" {
+			run = append(run, "--net-host")
+		}
+		for _, d := range spec.Devices {
+			if host, inContainer := splitDevice(d); host != inContainer {
+				return nil, fmt.Errorf("containerd can't map device %s to another path", d)
+			}
+			run = append(run, "--device", d)
+		}
+		if len(spec.Ports) > 0 {
+			return nil, fmt.Errorf("containerd can't publish ports, use the host network")
+		}
+		mounts, err := ctrMounts(spec.Mounts)
+		if err != nil {
+			return nil, err
+		}
+		run = append(run, mounts...)
+		for _, l := range labels {
+			run = append(run, "--label", l)
+		}
+		run = append(run, spec.Image, spec.Name)
+		run = append(run, spec.Cmd...)
+		return &ServiceCommands{
+			Cleanup:     append(append([]string{}, ctr...), "containers", "delete", spec.Name),
+			Run:         run,
+			Stop:        append(append([]string{}, ctr...), "tasks", "kill", "--signal", "SIGTERM", spec.Name),
+			StopTimeout: spec.StopTimeout,
+			Requires:    "containerd.service",
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown runtime %s", runtime)
+}
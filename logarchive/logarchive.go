@@ -0,0 +1,488 @@
+// Package logarchive keeps the output of containers in rotated, gzipped
+// files so that it outlives the containers.
+//
+// Every container run is a session, a directory named after the time the
+// container was started holding session.json and numbered segments. The
+// segment being written is plain text until it is rotated, when it is
+// gzipped and the archive is pruned to its size and age limits.
+package logarchive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	metaName = "session.json"
+	idLayout = "20060102T150405Z"
+	logExt   = ".log"
+	gzExt    = ".log.gz"
+)
+
+// Session describes the captured output of one container run.
+type Session struct {
+	ID          string    `json:"id"`
+	Container   string    `json:"container"`
+	ContainerID string    `json:"container_id"`
+	Image       string    `json:"image"`
+	Profile     string    `json:"profile"`
+	StartedAt   time.Time `json:"started_at"`
+	// FinishedAt is zero while the container runs.
+	FinishedAt time.Time `json:"finished_at"`
+	ExitCode   *int      `json:"exit_code,omitempty"`
+	// Captured is the number of bytes in the gzipped segments.
+	Captured int64 `json:"captured"`
+
+	// Size, Segments and Updated describe the files of the session.
+	Size     int64     `json:"-"`
+	Segments int       `json:"-"`
+	Updated  time.Time `json:"-"`
+}
+
+// SessionID returns the id of the session of a container started at t.
+func SessionID(t time.Time) string {
+	return t.UTC().Format(idLayout)
+}
+
+// Archive is a directory of sessions.
+type Archive struct {
+	Dir string
+	// SegmentSize is the size at which a segment is rotated.
+	SegmentSize int64
+	// MaxSize and MaxAge limit the sessions kept, no limit if 0.
+	MaxSize int64
+	MaxAge  time.Duration
+}
+
+// Create starts capturing s, or resumes it if the session exists.
+func (a *Archive) Create(s Session) (*Writer, error) {
+	s.ID = SessionID(s.StartedAt)
+	dir := filepath.Join(a.Dir, s.ID)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if old, err := readMeta(dir); err == nil {
+		s.Captured = old.Captured
+		if s.Image == "" {
+			s.Image = old.Image
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+	segments, err := segmentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	w := &Writer{a: a, dir: dir, session: s, seg: len(segments)}
+	// A plain segment is left behind if capturing was interrupted, it is
+	// appended to.
+	if n := len(segments); n > 0 && strings.HasSuffix(segments[n-1], logExt) {
+		w.seg = n - 1
+		info, err := os.Stat(filepath.Join(dir, segments[n-1]))
+		if err != nil {
+			return nil, err
+		}
+		w.size = info.Size()
+	}
+	if err := writeMeta(dir, &w.session); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// Writer appends to a session.
+type Writer struct {
+	a       *Archive
+	dir     string
+	session Session
+	seg     int
+	f       *os.File
+	size    int64
+}
+
+// Captured returns the number of bytes already captured, output that is
+// captured again after a restart should skip them.
+func (w *Writer) Captured() int64 {
+	return w.session.Captured + w.size
+}
+
+// ID returns the id of the session.
+func (w *Writer) ID() string {
+	return w.session.ID
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	if w.f == nil {
+		f, err := os.OpenFile(w.segmentPath(logExt), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+		if err != nil {
+			return 0, err
+		}
+		w.f = f
+	}
+	n, err := w.f.Write(p)
+	w.size += int64(n)
+	if err != nil {
+		return n, err
+	}
+	if w.a.SegmentSize > 0 && w.size >= w.a.SegmentSize {
+		if err := w.rotate(); err != nil {
+			return n, err
+		}
+		if err := w.a.Prune(time.Now(), w.session.ID); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Finish records that the container stopped and closes the session.
+func (w *Writer) Finish(at time.Time, exitCode *int) error {
+	w.session.FinishedAt = at
+	w.session.ExitCode = exitCode
+	return w.Close()
+}
+
+// Close gzips the current segment. The session can be resumed with
+// Create.
+func (w *Writer) Close() error {
+	return w.rotate()
+}
+
+// rotate gzips the current segment, if any, and moves on to the next.
+func (w *Writer) rotate() error {
+	if w.f != nil {
+		if err := w.f.Close(); err != nil {
+			return err
+		}
+		w.f = nil
+	}
+	if w.size > 0 {
+		if err := compress(w.segmentPath(logExt), w.segmentPath(gzExt)); err != nil {
+			return err
+		}
+		w.session.Captured += w.size
+		w.size = 0
+		w.seg++
+	}
+	return writeMeta(w.dir, &w.session)
+}
+
+func (w *Writer) segmentPath(ext string) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%06d%s", w.seg, ext))
+}
+
+// List returns the sessions, newest first.
+func (a *Archive) List() ([]*Session, error) {
+	entries, err := ioutil.ReadDir(a.Dir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var sessions []*Session
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		s, err := a.load(e.Name())
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID > sessions[j].ID })
+	return sessions, nil
+}
+
+// Find returns the session with the given id, or the only one it is a
+// prefix of.
+func (a *Archive) Find(id string) (*Session, error) {
+	sessions, err := a.List()
+	if err != nil {
+		return nil, err
+	}
+	var found *Session
+	for _, s := range sessions {
+		if s.ID == id {
+			return s, nil
+		}
+		if strings.HasPrefix(s.ID, id) {
+			if found != nil {
+				return nil, fmt.Errorf("%s matches several sessions", id)
+			}
+			found = s
+		}
+	}
+	if found == nil {
+		return nil, fmt.Errorf("no session %s", id)
+	}
+	return found, nil
+}
+
+func (a *Archive) load(id string) (*Session, error) {
+	dir := filepath.Join(a.Dir, id)
+	s, err := readMeta(dir)
+	if err != nil {
+		return nil, err
+	}
+	segments, err := segmentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	s.Segments = len(segments)
+	for _, name := range append(segments, metaName) {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			return nil, err
+		}
+		s.Size += info.Size()
+		if info.ModTime().After(s.Updated) {
+			s.Updated = info.ModTime()
+		}
+	}
+	return s, nil
+}
+
+// Open returns the output captured in a session.
+func (a *Archive) Open(id string) (io.ReadCloser, error) {
+	dir := filepath.Join(a.Dir, id)
+	segments, err := segmentNames(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, len(segments))
+	for i, name := range segments {
+		paths[i] = filepath.Join(dir, name)
+	}
+	return &segmentReader{paths: paths}, nil
+}
+
+// Prune removes sessions not updated within MaxAge, then the oldest until
+// the archive fits in MaxSize. The session keep, which is being written,
+// is never removed.
+func (a *Archive) Prune(now time.Time, keep string) error {
+	sessions, err := a.List()
+	if err != nil {
+		return err
+	}
+	var total int64
+	var kept []*Session
+	for _, s := range sessions {
+		if s.ID != keep && a.MaxAge > 0 && now.Sub(s.Updated) > a.MaxAge {
+			if err := os.RemoveAll(filepath.Join(a.Dir, s.ID)); err != nil {
+				return err
+			}
+			continue
+		}
+		total += s.Size
+		kept = append(kept, s)
+	}
+	for i := len(kept) - 1; i >= 0 && a.MaxSize > 0 && total > a.MaxSize; i-- {
+		if kept[i].ID == keep {
+			continue
+		}
+		if err := os.RemoveAll(filepath.Join(a.Dir, kept[i].ID)); err != nil {
+			return err
+		}
+		total -= kept[i].Size
+	}
+	return nil
+}
+
+// Export writes a gzipped tar of the sessions with the given ids, each a
+// directory holding session.json and the output as CONTAINER.log.
+func (a *Archive) Export(ids []string, w io.Writer) error {
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, id := range ids {
+		s, err := a.load(id)
+		if err != nil {
+			return err
+		}
+		meta, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    id + "/" + metaName,
+			Mode:    0600,
+			Size:    int64(len(meta)),
+			ModTime: s.Updated,
+		}); err != nil {
+			return err
+		}
+		if _, err := tw.Write(meta); err != nil {
+			return err
+		}
+		// The size of the output is only known once it is decompressed.
+		size, err := a.copyOutput(id, ioutil.Discard)
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(&tar.Header{
+			Name:    id + "/" + s.Container + logExt,
+			Mode:    0600,
+			Size:    size,
+			ModTime: s.Updated,
+		}); err != nil {
+			return err
+		}
+		if _, err := a.copyOutput(id, tw); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+func (a *Archive) copyOutput(id string, w io.Writer) (int64, error) {
+	r, err := a.Open(id)
+	if err != nil {
+		return 0, err
+	}
+	defer r.Close()
+	return io.Copy(w, r)
+}
+
+// segmentReader reads segments one after the other.
+type segmentReader struct {
+	paths []string
+	f     *os.File
+	r     io.Reader
+}
+
+func (r *segmentReader) Read(p []byte) (int, error) {
+	for {
+		if r.r == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.next(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.r.Read(p)
+		if err == io.EOF {
+			r.f.Close()
+			r.r = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (r *segmentReader) next() error {
+	path := r.paths[0]
+	r.paths = r.paths[1:]
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	r.f, r.r = f, f
+	if strings.HasSuffix(path, gzExt) {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			f.Close()
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		r.r = gz
+	}
+	return nil
+}
+
+func (r *segmentReader) Close() error {
+	if r.r != nil {
+		r.r = nil
+		return r.f.Close()
+	}
+	return nil
+}
+
+// segmentNames returns the segments of the session in dir, in order.
+func segmentNames(dir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), logExt) || strings.HasSuffix(e.Name(), gzExt) {
+			names = append(names, e.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func readMeta(dir string) (*Session, error) {
+	data, err := ioutil.ReadFile(filepath.Join(dir, metaName))
+	if err != nil {
+		return nil, err
+	}
+	var s Session
+	if err := json.Unmarshal(data, &s); err != nil {
+		return nil, fmt.Errorf("%s: %v", filepath.Join(dir, metaName), err)
+	}
+	return &s, nil
+}
+
+// writeMeta replaces session.json atomically, so that a session is never
+// left without one.
+func writeMeta(dir string, s *Session) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := filepath.Join(dir, metaName+".tmp")
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filepath.Join(dir, metaName))
+}
+
+// compress gzips src to dst and removes src.
+func compress(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmp := dst + ".tmp"
+	out, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	if _, err := io.Copy(gz, in); err != nil {
+		out.Close()
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		out.Close()
+		return err
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		return err
+	}
+	in.Close()
+	return os.Remove(src)
+}
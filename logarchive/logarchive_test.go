@@ -0,0 +1,195 @@
+package logarchive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func tempArchive(t *testing.T) (*Archive, func()) {
+	dir, err := ioutil.TempDir("", "logarchive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Archive{Dir: dir, SegmentSize: 16}, func() { os.RemoveAll(dir) }
+}
+
+func readAll(t *testing.T, a *Archive, id string) string {
+	r, err := a.Open(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestWriterRotatesAndResumes(t *testing.T) {
+	a, cleanup := tempArchive(t)
+	defer cleanup()
+
+	started := time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)
+	w, err := a.Create(Session{Container: "drone", StartedAt: started})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.ID() != "20190601T120000Z" {
+		t.Errorf("unexpected id %s", w.ID())
+	}
+	lines := "armed\ntaking off\nmission started\nlanded\n"
+	for _, l := range strings.SplitAfter(lines, "\n") {
+		if _, err := io.WriteString(w, l); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if got := readAll(t, a, w.ID()); got != lines {
+		t.Errorf("got %q while writing", got)
+	}
+	// Interrupted without Close, the plain segment is resumed.
+	w.f.Close()
+	w, err = a.Create(Session{Container: "drone", StartedAt: started})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Captured() != int64(len(lines)) {
+		t.Errorf("captured %d, want %d", w.Captured(), len(lines))
+	}
+	io.WriteString(w, "disarmed\n")
+	code := 0
+	if err := w.Finish(started.Add(time.Hour), &code); err != nil {
+		t.Fatal(err)
+	}
+	if got := readAll(t, a, w.ID()); got != lines+"disarmed\n" {
+		t.Errorf("got %q", got)
+	}
+
+	sessions, err := a.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions", len(sessions))
+	}
+	s := sessions[0]
+	if s.Segments != 3 || s.Captured != int64(len(lines)+9) || s.ExitCode == nil || !s.FinishedAt.Equal(started.Add(time.Hour)) {
+		t.Errorf("unexpected session %+v", s)
+	}
+	names, _ := segmentNames(filepath.Join(a.Dir, s.ID))
+	for _, n := range names {
+		if !strings.HasSuffix(n, gzExt) {
+			t.Errorf("segment %s not compressed", n)
+		}
+	}
+}
+
+func TestFind(t *testing.T) {
+	a, cleanup := tempArchive(t)
+	defer cleanup()
+
+	for _, d := range []int{1, 2} {
+		w, err := a.Create(Session{StartedAt: time.Date(2019, 6, d, 12, 0, 0, 0, time.UTC)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Close()
+	}
+	if s, err := a.Find("20190602"); err != nil || s.ID != "20190602T120000Z" {
+		t.Errorf("got %v, %v", s, err)
+	}
+	if _, err := a.Find("201906"); err == nil {
+		t.Error("expected ambiguous error")
+	}
+	if _, err := a.Find("2018"); err == nil {
+		t.Error("expected not found error")
+	}
+}
+
+func TestPrune(t *testing.T) {
+	a, cleanup := tempArchive(t)
+	defer cleanup()
+	a.SegmentSize = 0
+
+	now := time.Now()
+	var ids []string
+	for i := 0; i < 4; i++ {
+		w, err := a.Create(Session{StartedAt: now.Add(time.Duration(i) * time.Minute)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(w, strings.Repeat("x", 1000))
+		w.Close()
+		ids = append(ids, w.ID())
+	}
+	old := now.Add(-48 * time.Hour)
+	os.Chtimes(filepath.Join(a.Dir, ids[1]), old, old)
+	names, _ := ioutil.ReadDir(filepath.Join(a.Dir, ids[1]))
+	for _, n := range names {
+		os.Chtimes(filepath.Join(a.Dir, ids[1], n.Name()), old, old)
+	}
+
+	a.MaxAge = 24 * time.Hour
+	sessions, _ := a.List()
+	a.MaxSize = sessions[0].Size * 2
+	// The oldest session is kept as it is being written.
+	if err := a.Prune(now, ids[0]); err != nil {
+		t.Fatal(err)
+	}
+	sessions, _ = a.List()
+	var got []string
+	for _, s := range sessions {
+		got = append(got, s.ID)
+	}
+	want := []string{ids[3], ids[0]}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestExport(t *testing.T) {
+	a, cleanup := tempArchive(t)
+	defer cleanup()
+
+	w, err := a.Create(Session{Container: "drone", StartedAt: time.Date(2019, 6, 1, 12, 0, 0, 0, time.UTC)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.WriteString(w, "connected to FCU\nheartbeat lost\n")
+	w.Close()
+
+	var buf bytes.Buffer
+	if err := a.Export([]string{w.ID()}, &buf); err != nil {
+		t.Fatal(err)
+	}
+	gz, err := gzip.NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	files := map[string]string{}
+	for {
+		h, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := ioutil.ReadAll(tr)
+		files[h.Name] = string(data)
+	}
+	if files["20190601T120000Z/drone.log"] != "connected to FCU\nheartbeat lost\n" {
+		t.Errorf("unexpected files %v", files)
+	}
+	if !strings.Contains(files["20190601T120000Z/session.json"], `"container": "drone"`) {
+		t.Errorf("unexpected session.json %q", files["20190601T120000Z/session.json"])
+	}
+}
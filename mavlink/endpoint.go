@@ -0,0 +1,316 @@
+package mavlink
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Endpoint is a MAVLink link in the mavros fcu_url format:
+//
+//	udp://[bind_host][:port]@[remote_host][:port]
+//	udp-b://[bind_host][:port]@[:port]
+//	tcp://[server_host][:port]
+//	tcp-l://[bind_host][:port]
+//	serial:///path/to/device[:baudrate]
+type Endpoint struct {
+	Scheme string
+	// Bind is the local address of udp and tcp-l endpoints.
+	Bind string
+	// Remote is the peer address of udp and tcp endpoints.
+	Remote string
+	Device string
+	Baud   int
+}
+
+// Default ports and baud rate, as used by mavros.
+const (
+	DefaultBindPort   = 14555
+	DefaultRemotePort = 14550
+	DefaultTCPPort    = 5760
+	DefaultBaud       = 57600
+)
+
+// ErrInUse is returned by Open when another process has the endpoint bound.
+var ErrInUse = errors.New("endpoint is in use by another process")
+
+// ParseURL parses a mavros style endpoint url.
+func ParseURL(s string) (*Endpoint, error) {
+	i := strings.Index(s, "://")
+	if i < 0 {
+		return nil, fmt.Errorf("invalid endpoint %s, missing scheme", s)
+	}
+	scheme, rest := s[:i], s[i+3:]
+	// Query parameters such as ?ids= configure mavros only.
+	if j := strings.IndexAny(rest, "?"); j >= 0 {
+		rest = strings.TrimSuffix(rest[:j], "/")
+	}
+	ep := &Endpoint{Scheme: scheme}
+	var err error
+	switch scheme {
+	case "udp", "udp-b":
+		parts := strings.SplitN(rest, "@", 2)
+		if ep.Bind, err = hostPort(parts[0], DefaultBindPort); err != nil {
+			return nil, err
+		}
+		if len(parts) == 2 && parts[1] != "" {
+			if ep.Remote, err = remoteHostPort(parts[1], DefaultRemotePort); err != nil {
+				return nil, err
+			}
+		}
+	case "tcp":
+		if ep.Remote, err = remoteHostPort(rest, DefaultTCPPort); err != nil {
+			return nil, err
+		}
+	case "tcp-l":
+		if ep.Bind, err = hostPort(rest, DefaultTCPPort); err != nil {
+			return nil, err
+		}
+	case "serial", "serial-hwfc":
+		ep.Device, ep.Baud = rest, DefaultBaud
+		if j := strings.LastIndex(rest, ":"); j >= 0 {
+			baud, err := strconv.Atoi(rest[j+1:])
+			if err != nil || baud <= 0 {
+				return nil, fmt.Errorf("invalid baud rate in %s", s)
+			}
+			ep.Device, ep.Baud = rest[:j], baud
+		}
+		if !strings.HasPrefix(ep.Device, "/") {
+			return nil, fmt.Errorf("invalid serial device in %s, use serial:///dev/DEVICE:BAUD", s)
+		}
+	default:
+		return nil, fmt.Errorf("unsupported endpoint scheme %s, use one of: udp, udp-b, tcp, tcp-l, serial", scheme)
+	}
+	return ep, nil
+}
+
+// remoteHostPort is hostPort for addresses that are sent to, which need a
+// port.
+func remoteHostPort(s string, defaultPort int) (string, error) {
+	addr, err := hostPort(s, defaultPort)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasSuffix(addr, ":0") {
+		return "", fmt.Errorf("invalid port in %s", s)
+	}
+	return addr, nil
+}
+
+// hostPort fills in the default port of a [host][:port] address. Port 0
+// binds to any free port.
+func hostPort(s string, defaultPort int) (string, error) {
+	host, port := s, strconv.Itoa(defaultPort)
+	if i := strings.LastIndex(s, ":"); i >= 0 && !strings.HasSuffix(s, "]") {
+		host, port = s[:i], s[i+1:]
+		if port == "" {
+			port = strconv.Itoa(defaultPort)
+		}
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 0 || n > 65535 {
+		return "", fmt.Errorf("invalid port in %s", s)
+	}
+	return net.JoinHostPort(strings.Trim(host, "[]"), port), nil
+}
+
+func (ep *Endpoint) String() string {
+	switch ep.Scheme {
+	case "udp", "udp-b":
+		return fmt.Sprintf("%s://%s@%s", ep.Scheme, ep.Bind, ep.Remote)
+	case "tcp":
+		return "tcp://" + ep.Remote
+	case "tcp-l":
+		return "tcp-l://" + ep.Bind
+	}
+	return fmt.Sprintf("%s://%s:%d", ep.Scheme, ep.Device, ep.Baud)
+}
+
+// Open opens the endpoint. The returned connection is closed when ctx is
+// done, which makes pending reads fail.
+//
+// Like mavros, udp endpoints without a remote address reply to whoever sent
+// the last datagram and udp-b endpoints broadcast until they hear from a
+// peer. Writes are dropped while there is nobody to send to.
+func (ep *Endpoint) Open(ctx context.Context) (io.ReadWriteCloser, error) {
+	var rc io.ReadWriteCloser
+	switch ep.Scheme {
+	case "udp", "udp-b":
+		conn, err := net.ListenPacket("udp", ep.Bind)
+		if err != nil {
+			return nil, inUse(err)
+		}
+		pc := &packetConn{conn: conn}
+		if ep.Remote != "" {
+			host, port, _ := net.SplitHostPort(ep.Remote)
+			if host == "" && ep.Scheme == "udp-b" {
+				host = "255.255.255.255"
+			}
+			if host != "" {
+				if pc.fixed, err = net.ResolveUDPAddr("udp", net.JoinHostPort(host, port)); err != nil {
+					conn.Close()
+					return nil, err
+				}
+			}
+		}
+		rc = pc
+	case "tcp":
+		var d net.Dialer
+		conn, err := d.DialContext(ctx, "tcp", ep.Remote)
+		if err != nil {
+			return nil, err
+		}
+		rc = conn
+	case "tcp-l":
+		l, err := net.Listen("tcp", ep.Bind)
+		if err != nil {
+			return nil, inUse(err)
+		}
+		go func() {
+			<-ctx.Done()
+			l.Close()
+		}()
+		conn, err := l.Accept()
+		l.Close()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		rc = conn
+	default:
+		if err := setBaud(ep.Device, ep.Baud); err != nil {
+			return nil, err
+		}
+		f, err := os.OpenFile(ep.Device, os.O_RDWR, 0)
+		if err != nil {
+			return nil, err
+		}
+		rc = f
+	}
+	go func() {
+		<-ctx.Done()
+		rc.Close()
+	}()
+	return rc, nil
+}
+
+// inUse translates address in use errors to ErrInUse.
+func inUse(err error) error {
+	cause := err
+	if op, ok := cause.(*net.OpError); ok {
+		cause = op.Err
+	}
+	if sys, ok := cause.(*os.SyscallError); ok {
+		cause = sys.Err
+	}
+	if cause == syscall.EADDRINUSE {
+		return ErrInUse
+	}
+	return err
+}
+
+// setBaud puts a serial device in raw mode at baud with stty, which saves
+// dmctl from carrying termios bindings for every platform.
+func setBaud(device string, baud int) error {
+	flag := "-F"
+	if runtime.GOOS == "darwin" {
+		flag = "-f"
+	}
+	out, err := exec.Command("stty", flag, device, strconv.Itoa(baud), "raw", "-echo").CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("stty: %s", msg)
+		}
+		return err
+	}
+	return nil
+}
+
+// packetConn turns datagrams into a byte stream. Datagrams are read whole
+// into buf, since reading them into a short p would truncate them. Each
+// Write is sent as one datagram.
+type packetConn struct {
+	conn net.PacketConn
+	buf  [65536]byte
+	data []byte
+
+	// fixed is the remote address from the url, peer the sender of the last
+	// datagram.
+	fixed net.Addr
+	mu    sync.Mutex
+	peer  net.Addr
+}
+
+func (c *packetConn) Read(p []byte) (int, error) {
+	if len(c.data) == 0 {
+		n, addr, err := c.conn.ReadFrom(c.buf[:])
+		if err != nil {
+			return 0, err
+		}
+		c.mu.Lock()
+		c.peer = addr
+		c.mu.Unlock()
+		c.data = c.buf[:n]
+	}
+	n := copy(p, c.data)
+	c.data = c.data[n:]
+	return n, nil
+}
+
+func (c *packetConn) Write(p []byte) (int, error) {
+	c.mu.Lock()
+	addr := c.peer
+	c.mu.Unlock()
+	if addr == nil || c.fixed != nil && !isBroadcast(c.fixed) {
+		addr = c.fixed
+	}
+	if addr == nil {
+		return len(p), nil
+	}
+	return c.conn.WriteTo(p, addr)
+}
+
+func (c *packetConn) Close() error {
+	return c.conn.Close()
+}
+
+func isBroadcast(addr net.Addr) bool {
+	udp, ok := addr.(*net.UDPAddr)
+	return ok && udp.IP.Equal(net.IPv4bcast)
+}
+
+// WaitHeartbeat returns the first heartbeat of a flight controller read
+// from r, ignoring heartbeats of ground stations and companion computers.
+// If r is closed because ctx is done ctx.Err() is returned.
+func WaitHeartbeat(ctx context.Context, r io.Reader) (*Heartbeat, error) {
+	dec := NewDecoder(r)
+	for {
+		f, err := dec.Next()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		}
+		if f.MessageID != MsgHeartbeat {
+			continue
+		}
+		hb, err := ParseHeartbeat(f)
+		if err != nil {
+			return nil, err
+		}
+		if hb.Autopilot != AutopilotInvalid {
+			return hb, nil
+		}
+	}
+}
@@ -0,0 +1,253 @@
+// Package mavlink decodes just enough MAVLink to check and route a flight
+// controller link: v1 and v2 framing and the HEARTBEAT message.
+package mavlink
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+const (
+	magicV1 = 0xfe
+	magicV2 = 0xfd
+
+	headerLenV1  = 6
+	headerLenV2  = 10
+	signatureLen = 13
+
+	// incompatSigned is set in v2 frames that carry a signature.
+	incompatSigned = 0x01
+)
+
+// MsgHeartbeat is the id of the HEARTBEAT message.
+const MsgHeartbeat = 0
+
+// crcExtra holds the CRC_EXTRA seed of the messages that are decoded.
+// Frames of other messages are returned without checking their checksum.
+var crcExtra = map[uint32]byte{
+	MsgHeartbeat: 50,
+}
+
+// Frame is a MAVLink packet.
+type Frame struct {
+	Version     int
+	Seq         uint8
+	SystemID    uint8
+	ComponentID uint8
+	MessageID   uint32
+	Payload     []byte
+	// Raw is the frame as it was read, including its checksum and signature.
+	Raw []byte
+}
+
+// Decoder reads frames from a byte stream, skipping anything that isn't a
+// valid frame. Only frames of messages with a known CRC_EXTRA can be
+// verified, so line noise may occasionally hide the frame that follows it.
+type Decoder struct {
+	r *bufio.Reader
+}
+
+// NewDecoder returns a Decoder reading from r.
+func NewDecoder(r io.Reader) *Decoder {
+	return &Decoder{r: bufio.NewReaderSize(r, 512)}
+}
+
+// Next returns the next frame.
+func (d *Decoder) Next() (*Frame, error) {
+	for {
+		magic, err := d.r.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		if magic != magicV1 && magic != magicV2 {
+			continue
+		}
+		d.r.UnreadByte()
+		f, n, err := d.peekFrame(magic)
+		if err == io.EOF && d.r.Buffered() > 1 {
+			// A magic byte too close to the end to be a frame.
+			f, err = nil, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if f == nil {
+			// Not a frame after all, resynchronize on the next byte.
+			d.r.Discard(1)
+			continue
+		}
+		d.r.Discard(n)
+		return f, nil
+	}
+}
+
+// peekFrame parses the frame at the start of the buffer without consuming
+// it, returning a nil frame if the checksum doesn't match.
+func (d *Decoder) peekFrame(magic byte) (*Frame, int, error) {
+	headerLen := headerLenV1
+	if magic == magicV2 {
+		headerLen = headerLenV2
+	}
+	header, err := d.r.Peek(headerLen)
+	if err != nil {
+		return nil, 0, err
+	}
+	payloadLen := int(header[1])
+	n := headerLen + payloadLen + 2
+	if magic == magicV2 && header[2]&incompatSigned != 0 {
+		n += signatureLen
+	}
+	buf, err := d.r.Peek(n)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	f := &Frame{Version: 1}
+	if magic == magicV1 {
+		f.Seq, f.SystemID, f.ComponentID = buf[2], buf[3], buf[4]
+		f.MessageID = uint32(buf[5])
+	} else {
+		f.Version = 2
+		f.Seq, f.SystemID, f.ComponentID = buf[4], buf[5], buf[6]
+		f.MessageID = uint32(buf[7]) | uint32(buf[8])<<8 | uint32(buf[9])<<16
+	}
+	if extra, ok := crcExtra[f.MessageID]; ok {
+		end := headerLen + payloadLen
+		sum := checksum(buf[1:end], extra)
+		if binary.LittleEndian.Uint16(buf[end:]) != sum {
+			return nil, 0, nil
+		}
+	}
+	f.Raw = append([]byte(nil), buf...)
+	f.Payload = f.Raw[headerLen : headerLen+payloadLen]
+	return f, n, nil
+}
+
+// checksum is the CRC-16/MCRF4XX (X.25) of data followed by extra.
+func checksum(data []byte, extra byte) uint16 {
+	crc := uint16(0xffff)
+	for _, b := range data {
+		crc = accumulate(crc, b)
+	}
+	return accumulate(crc, extra)
+}
+
+func accumulate(crc uint16, b byte) uint16 {
+	tmp := b ^ byte(crc)
+	tmp ^= tmp << 4
+	return crc>>8 ^ uint16(tmp)<<8 ^ uint16(tmp)<<3 ^ uint16(tmp)>>4
+}
+
+// Encode returns the v2 frame of a message, for tests and simulators.
+func Encode(f *Frame) []byte {
+	buf := []byte{
+		magicV2, byte(len(f.Payload)), 0, 0, f.Seq, f.SystemID, f.ComponentID,
+		byte(f.MessageID), byte(f.MessageID >> 8), byte(f.MessageID >> 16),
+	}
+	if f.Version == 1 {
+		buf = []byte{magicV1, byte(len(f.Payload)), f.Seq, f.SystemID, f.ComponentID, byte(f.MessageID)}
+	}
+	buf = append(buf, f.Payload...)
+	sum := checksum(buf[1:], crcExtra[f.MessageID])
+	return append(buf, byte(sum), byte(sum>>8))
+}
+
+// Heartbeat is the HEARTBEAT message every MAVLink component sends once a
+// second.
+type Heartbeat struct {
+	SystemID       uint8
+	ComponentID    uint8
+	Type           uint8
+	Autopilot      uint8
+	BaseMode       uint8
+	CustomMode     uint32
+	SystemStatus   uint8
+	MavlinkVersion uint8
+}
+
+const (
+	modeFlagSafetyArmed = 0x80
+
+	// AutopilotInvalid is sent by components that are not flight
+	// controllers, such as ground stations and companion computers.
+	AutopilotInvalid = 8
+)
+
+// Armed reports whether the vehicle is armed.
+func (h *Heartbeat) Armed() bool {
+	return h.BaseMode&modeFlagSafetyArmed != 0
+}
+
+// ParseHeartbeat decodes the payload of a HEARTBEAT frame.
+func ParseHeartbeat(f *Frame) (*Heartbeat, error) {
+	if f.MessageID != MsgHeartbeat {
+		return nil, fmt.Errorf("message %d is not a heartbeat", f.MessageID)
+	}
+	// MAVLink 2 truncates trailing zero bytes of the payload.
+	p := make([]byte, 9)
+	copy(p, f.Payload)
+	return &Heartbeat{
+		SystemID:       f.SystemID,
+		ComponentID:    f.ComponentID,
+		CustomMode:     binary.LittleEndian.Uint32(p),
+		Type:           p[4],
+		Autopilot:      p[5],
+		BaseMode:       p[6],
+		SystemStatus:   p[7],
+		MavlinkVersion: p[8],
+	}, nil
+}
+
+// Payload encodes the heartbeat as a frame payload.
+func (h *Heartbeat) Payload() []byte {
+	p := make([]byte, 9)
+	binary.LittleEndian.PutUint32(p, h.CustomMode)
+	p[4], p[5], p[6], p[7], p[8] = h.Type, h.Autopilot, h.BaseMode, h.SystemStatus, h.MavlinkVersion
+	return p
+}
+
+var typeNames = map[uint8]string{
+	0:  "generic",
+	1:  "fixed wing",
+	2:  "quadrotor",
+	3:  "coaxial helicopter",
+	4:  "helicopter",
+	6:  "ground station",
+	10: "ground rover",
+	11: "surface boat",
+	12: "submarine",
+	13: "hexarotor",
+	14: "octorotor",
+	15: "tricopter",
+	18: "onboard controller",
+	19: "VTOL tailsitter",
+	20: "VTOL tailsitter",
+	21: "VTOL tiltrotor",
+	22: "VTOL",
+	29: "dodecarotor",
+}
+
+// TypeName returns a readable name of the vehicle type.
+func (h *Heartbeat) TypeName() string {
+	if name, ok := typeNames[h.Type]; ok {
+		return name
+	}
+	return fmt.Sprintf("type %d", h.Type)
+}
+
+var autopilotNames = map[uint8]string{
+	0:                "generic",
+	3:                "ArduPilot",
+	AutopilotInvalid: "none",
+	12:               "PX4",
+}
+
+// AutopilotName returns a readable name of the autopilot.
+func (h *Heartbeat) AutopilotName() string {
+	if name, ok := autopilotNames[h.Autopilot]; ok {
+		return name
+	}
+	return fmt.Sprintf("autopilot %d", h.Autopilot)
+}
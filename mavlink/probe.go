@@ -0,0 +1,104 @@
+package mavlink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNoHeartbeat is returned by Probe when no flight controller heartbeat
+// arrives in time.
+var ErrNoHeartbeat = errors.New("no heartbeat")
+
+// ProbeResult describes a flight controller found by Probe.
+type ProbeResult struct {
+	Heartbeat *Heartbeat
+	// Version is the MAVLink version of the heartbeat frame.
+	Version int
+	// Rate is the number of frames per second the flight controller's
+	// system sent during the probe window.
+	Rate float64
+}
+
+// Probe waits up to timeout for a flight controller heartbeat on r, then
+// counts the frames its system sends during window to measure the message
+// rate. If ctx is done during the window the rate is measured over the time
+// that passed. r should be closed when ctx is done, as the connections
+// returned by Endpoint.Open are.
+func Probe(ctx context.Context, r io.Reader, timeout, window time.Duration) (*ProbeResult, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	frames := make(chan *Frame)
+	errc := make(chan error, 1)
+	go func() {
+		dec := NewDecoder(r)
+		for {
+			f, err := dec.Next()
+			if err != nil {
+				errc <- err
+				return
+			}
+			select {
+			case frames <- f:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	var result *ProbeResult
+	var count int
+	var start time.Time
+	// done ends the window, measuring the rate over the time that passed.
+	done := func() (*ProbeResult, error) {
+		if elapsed := time.Since(start).Seconds(); elapsed > 0 {
+			result.Rate = float64(count) / elapsed
+		}
+		return result, nil
+	}
+	deadline := time.NewTimer(timeout)
+	defer deadline.Stop()
+	for {
+		select {
+		case f := <-frames:
+			if result == nil {
+				if f.MessageID != MsgHeartbeat {
+					continue
+				}
+				hb, err := ParseHeartbeat(f)
+				if err != nil {
+					return nil, err
+				}
+				if hb.Autopilot == AutopilotInvalid {
+					continue
+				}
+				result = &ProbeResult{Heartbeat: hb, Version: f.Version}
+				start = time.Now()
+				deadline.Stop()
+				deadline = time.NewTimer(window)
+			}
+			if f.SystemID == result.Heartbeat.SystemID {
+				count++
+			}
+		case <-deadline.C:
+			if result == nil {
+				return nil, ErrNoHeartbeat
+			}
+			return done()
+		case err := <-errc:
+			if result != nil {
+				return done()
+			}
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			return nil, err
+		case <-ctx.Done():
+			if result != nil {
+				return done()
+			}
+			return nil, ctx.Err()
+		}
+	}
+}
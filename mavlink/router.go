@@ -0,0 +1,131 @@
+package mavlink
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// RetryInterval is how long a Router waits before reopening a link that
+// failed, for example a serial device that was unplugged.
+var RetryInterval = time.Second
+
+// Router forwards every frame read from one of its endpoints to all the
+// others, so that several ground stations and programs can share one flight
+// controller link. Frames are not routed by target system, every endpoint
+// sees all traffic.
+type Router struct {
+	Endpoints []*Endpoint
+	// Logf, if set, is called when a link opens, fails or drops frames.
+	Logf func(format string, args ...interface{})
+
+	mu    sync.Mutex
+	links map[*Endpoint]*link
+}
+
+// link is an open endpoint. Frames are written by their own goroutine so
+// that a slow link can't stall the others, dropping frames when it falls
+// behind.
+type link struct {
+	conn io.ReadWriteCloser
+	out  chan []byte
+}
+
+const linkQueue = 256
+
+// Run routes frames until ctx is done.
+func (r *Router) Run(ctx context.Context) error {
+	if len(r.Endpoints) < 2 {
+		return errors.New("a router needs at least two endpoints")
+	}
+	r.mu.Lock()
+	r.links = map[*Endpoint]*link{}
+	r.mu.Unlock()
+	var wg sync.WaitGroup
+	for _, ep := range r.Endpoints {
+		wg.Add(1)
+		go func(ep *Endpoint) {
+			defer wg.Done()
+			r.serve(ctx, ep)
+		}(ep)
+	}
+	wg.Wait()
+	return nil
+}
+
+// serve keeps ep open, reading frames from it until ctx is done.
+func (r *Router) serve(ctx context.Context, ep *Endpoint) {
+	for ctx.Err() == nil {
+		conn, err := ep.Open(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				r.logf("%s: %s", ep, err)
+			}
+		} else {
+			r.logf("%s: open", ep)
+			err := r.read(ctx, ep, conn)
+			if ctx.Err() == nil {
+				r.logf("%s: %s", ep, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(RetryInterval):
+		}
+	}
+}
+
+func (r *Router) read(ctx context.Context, ep *Endpoint, conn io.ReadWriteCloser) error {
+	l := &link{conn: conn, out: make(chan []byte, linkQueue)}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for frame := range l.out {
+			conn.Write(frame)
+		}
+	}()
+	r.mu.Lock()
+	r.links[ep] = l
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.links, ep)
+		r.mu.Unlock()
+		close(l.out)
+		<-done
+		conn.Close()
+	}()
+
+	dec := NewDecoder(conn)
+	for {
+		f, err := dec.Next()
+		if err != nil {
+			return err
+		}
+		r.forward(ep, f.Raw)
+	}
+}
+
+// forward queues a frame read from src on every other link.
+func (r *Router) forward(src *Endpoint, frame []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for ep, l := range r.links {
+		if ep == src {
+			continue
+		}
+		select {
+		case l.out <- frame:
+		default:
+			r.logf("%s: dropped frame, link is too slow", ep)
+		}
+	}
+}
+
+func (r *Router) logf(format string, args ...interface{}) {
+	if r.Logf != nil {
+		r.Logf(format, args...)
+	}
+}
@@ -0,0 +1,247 @@
+// Package registry talks to Docker registry v2 APIs to look up image tags
+// and digests.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// Client is a registry API client. The zero value is usable.
+type Client struct {
+	HTTPClient *http.Client
+	// Insecure uses plain http, for local registries.
+	Insecure bool
+	// Credentials are used to authenticate if the registry asks for it.
+	Credentials *Credentials
+
+	tokens map[string]string
+	basic  bool
+}
+
+var (
+	challengeParamRe = regexp.MustCompile(`(\w+)="([^"]*)"`)
+	nextLinkRe       = regexp.MustCompile(`<([^>]+)>;\s*rel="next"`)
+)
+
+const manifestTypes = "application/vnd.docker.distribution.manifest.list.v2+json," +
+	"application/vnd.docker.distribution.manifest.v2+json," +
+	"application/vnd.oci.image.index.v1+json," +
+	"application/vnd.oci.image.manifest.v1+json"
+
+// Tags lists all tags of the repository of ref.
+func (c *Client) Tags(ctx context.Context, ref Reference) ([]string, error) {
+	var tags []string
+	next := c.url(ref, "/tags/list")
+	for next != "" {
+		resp, err := c.do(ctx, "GET", next, ref, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Tags []string `json:"tags"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, fmt.Errorf("bad tags response from %s: %s", ref.Registry, err)
+		}
+		tags = append(tags, page.Tags...)
+		next = ""
+		if m := nextLinkRe.FindStringSubmatch(resp.Header.Get("Link")); m != nil {
+			u, err := resp.Request.URL.Parse(m[1])
+			if err != nil {
+				return nil, err
+			}
+			next = u.String()
+		}
+	}
+	return tags, nil
+}
+
+// Ping checks that the registry can be reached with the client's
+// credentials.
+func (c *Client) Ping(ctx context.Context, registry string) error {
+	ref := Reference{Registry: registry}
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	resp, err := c.do(ctx, "GET", fmt.Sprintf("%s://%s/v2/", scheme, ref.apiHost()), ref, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Digest returns the manifest digest ref currently points to.
+func (c *Client) Digest(ctx context.Context, ref Reference) (string, error) {
+	tag := ref.Tag
+	if tag == "" {
+		tag = "latest"
+	}
+	header := http.Header{"Accept": []string{manifestTypes}}
+	resp, err := c.do(ctx, "HEAD", c.url(ref, "/manifests/"+tag), ref, header)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	digest := resp.Header.Get("Docker-Content-Digest")
+	if digest == "" {
+		return "", fmt.Errorf("%s did not return a digest for %s", ref.Registry, ref)
+	}
+	return digest, nil
+}
+
+func (c *Client) url(ref Reference, path string) string {
+	scheme := "https"
+	if c.Insecure {
+		scheme = "http"
+	}
+	return fmt.Sprintf("%s://%s/v2/%s%s", scheme, ref.apiHost(), ref.Repository, path)
+}
+
+// do sends a request, answering a bearer token challenge once if the
+// registry requires one.
+func (c *Client) do(ctx context.Context, method, u string, ref Reference, header http.Header) (*http.Response, error) {
+	resp, err := c.send(ctx, method, u, ref, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusUnauthorized {
+		challenge := resp.Header.Get("Www-Authenticate")
+		resp.Body.Close()
+		switch {
+		case strings.HasPrefix(strings.ToLower(challenge), "bearer "):
+			if err := c.authorize(ctx, ref, challenge); err != nil {
+				return nil, err
+			}
+		case strings.HasPrefix(strings.ToLower(challenge), "basic ") && c.Credentials != nil && !c.basic:
+			c.basic = true
+		default:
+			return nil, fmt.Errorf("%s requires authentication, run dmctl registry login %s", ref.Registry, ref.Registry)
+		}
+		resp, err = c.send(ctx, method, u, ref, header)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusUnauthorized {
+			resp.Body.Close()
+			return nil, fmt.Errorf("%s rejected the credentials", ref.Registry)
+		}
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		if resp.StatusCode == http.StatusNotFound {
+			return nil, fmt.Errorf("%s not found in %s", ref, ref.Registry)
+		}
+		return nil, fmt.Errorf("%s returned %s", ref.Registry, resp.Status)
+	}
+	return resp, nil
+}
+
+func (c *Client) send(ctx context.Context, method, u string, ref Reference, header http.Header) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if token := c.tokens[ref.Name()]; token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else if c.basic {
+		req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+	}
+	return c.httpClient().Do(req)
+}
+
+// authorize fetches a pull token from the realm named in a challenge like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io".
+func (c *Client) authorize(ctx context.Context, ref Reference, challenge string) error {
+	params := map[string]string{}
+	for _, m := range challengeParamRe.FindAllStringSubmatch(challenge, -1) {
+		params[m[1]] = m[2]
+	}
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return fmt.Errorf("bad authentication challenge from %s", ref.Registry)
+	}
+	q := realm.Query()
+	if service := params["service"]; service != "" {
+		q.Set("service", service)
+	}
+	scope := params["scope"]
+	if scope == "" && ref.Repository != "" {
+		scope = "repository:" + ref.Repository + ":pull"
+	}
+	if scope != "" {
+		q.Set("scope", scope)
+	}
+
+	var req *http.Request
+	if c.Credentials != nil && c.Credentials.IdentityToken != "" {
+		// Identity tokens are OAuth2 refresh tokens.
+		q.Set("grant_type", "refresh_token")
+		q.Set("refresh_token", c.Credentials.IdentityToken)
+		q.Set("client_id", "dmctl")
+		req, err = http.NewRequest("POST", realm.String(), strings.NewReader(q.Encode()))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		realm.RawQuery = q.Encode()
+		req, err = http.NewRequest("GET", realm.String(), nil)
+		if err != nil {
+			return err
+		}
+		if c.Credentials != nil && c.Credentials.Username != "" {
+			req.SetBasicAuth(c.Credentials.Username, c.Credentials.Password)
+		}
+	}
+	resp, err := c.httpClient().Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(ioutil.Discard, resp.Body)
+		if resp.StatusCode == http.StatusUnauthorized {
+			return fmt.Errorf("%s rejected the credentials", ref.Registry)
+		}
+		return fmt.Errorf("%s token request failed: %s", ref.Registry, resp.Status)
+	}
+	var token struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return fmt.Errorf("bad token response from %s: %s", ref.Registry, err)
+	}
+	if c.tokens == nil {
+		c.tokens = map[string]string{}
+	}
+	if token.Token != "" {
+		c.tokens[ref.Name()] = token.Token
+	} else {
+		c.tokens[ref.Name()] = token.AccessToken
+	}
+	return nil
+}
+
+func (c *Client) httpClient() *http.Client {
+	if c.HTTPClient != nil {
+		return c.HTTPClient
+	}
+	return http.DefaultClient
+}
@@ -0,0 +1,204 @@
+package registry
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// dockerHubAuthKey is the key Docker stores Docker Hub credentials under.
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
+// Credentials authenticate against a registry.
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// ConfigFile is a credential file in the format of ~/.docker/config.json.
+// Fields other than credentials are preserved when it is saved.
+type ConfigFile struct {
+	path string
+	raw  map[string]json.RawMessage
+
+	Auths       map[string]authEntry
+	CredsStore  string
+	CredHelpers map[string]string
+}
+
+type authEntry struct {
+	Auth          string `json:"auth,omitempty"`
+	Username      string `json:"username,omitempty"`
+	Password      string `json:"password,omitempty"`
+	IdentityToken string `json:"identitytoken,omitempty"`
+}
+
+// LoadConfigFile reads a credential file. A missing file is treated as empty.
+func LoadConfigFile(path string) (*ConfigFile, error) {
+	f := &ConfigFile{
+		path:        path,
+		raw:         map[string]json.RawMessage{},
+		Auths:       map[string]authEntry{},
+		CredHelpers: map[string]string{},
+	}
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return f, nil
+	} else if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &f.raw); err != nil {
+		return nil, fmt.Errorf("invalid %s: %s", path, err)
+	}
+	for key, dst := range map[string]interface{}{
+		"auths":       &f.Auths,
+		"credsStore":  &f.CredsStore,
+		"credHelpers": &f.CredHelpers,
+	} {
+		if v, ok := f.raw[key]; ok {
+			if err := json.Unmarshal(v, dst); err != nil {
+				return nil, fmt.Errorf("invalid %s in %s: %s", key, path, err)
+			}
+		}
+	}
+	return f, nil
+}
+
+// Credentials returns the credentials stored for a registry, asking the
+// credential helper configured for it if there is one. It returns nil if
+// there are none.
+func (f *ConfigFile) Credentials(registry string) (*Credentials, error) {
+	if helper := f.CredHelpers[registry]; helper != "" {
+		return helperCredentials(helper, serverURL(registry))
+	}
+	for key, entry := range f.Auths {
+		if normalizeHost(key) != registry {
+			continue
+		}
+		creds := &Credentials{
+			Username:      entry.Username,
+			Password:      entry.Password,
+			IdentityToken: entry.IdentityToken,
+		}
+		if entry.Auth != "" {
+			decoded, err := base64.StdEncoding.DecodeString(entry.Auth)
+			if err != nil {
+				return nil, fmt.Errorf("invalid auth for %s in %s", key, f.path)
+			}
+			parts := strings.SplitN(string(decoded), ":", 2)
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("invalid auth for %s in %s", key, f.path)
+			}
+			creds.Username, creds.Password = parts[0], parts[1]
+		}
+		if creds.Username != "" || creds.IdentityToken != "" {
+			return creds, nil
+		}
+	}
+	if f.CredsStore != "" {
+		return helperCredentials(f.CredsStore, serverURL(registry))
+	}
+	return nil, nil
+}
+
+// Set stores credentials for a registry in the file itself.
+func (f *ConfigFile) Set(registry string, creds *Credentials) {
+	f.Remove(registry)
+	entry := authEntry{IdentityToken: creds.IdentityToken}
+	if creds.Username != "" {
+		entry.Auth = base64.StdEncoding.EncodeToString([]byte(creds.Username + ":" + creds.Password))
+	}
+	f.Auths[serverURL(registry)] = entry
+}
+
+// Remove deletes the credentials stored for a registry in the file and
+// reports whether there were any.
+func (f *ConfigFile) Remove(registry string) bool {
+	removed := false
+	for key := range f.Auths {
+		if normalizeHost(key) == registry {
+			delete(f.Auths, key)
+			removed = true
+		}
+	}
+	return removed
+}
+
+// Save writes the file, readable only by the owner.
+func (f *ConfigFile) Save() error {
+	auths, err := json.Marshal(f.Auths)
+	if err != nil {
+		return err
+	}
+	f.raw["auths"] = auths
+	data, err := json.MarshalIndent(f.raw, "", "\t")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(f.path), 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(f.path, data, 0600)
+}
+
+// helperCredentials runs docker-credential-<helper> get.
+func helperCredentials(helper, server string) (*Credentials, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("docker-credential-"+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		msg := strings.TrimSpace(stdout.String() + stderr.String())
+		if strings.Contains(msg, "credentials not found") {
+			return nil, nil
+		}
+		if msg == "" {
+			msg = err.Error()
+		}
+		return nil, fmt.Errorf("docker-credential-%s: %s", helper, msg)
+	}
+	var resp struct {
+		Username string
+		Secret   string
+	}
+	if err := json.Unmarshal(stdout.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("docker-credential-%s: %s", helper, err)
+	}
+	// Helpers store identity tokens with this placeholder user name.
+	if resp.Username == "<token>" {
+		return &Credentials{IdentityToken: resp.Secret}, nil
+	}
+	return &Credentials{Username: resp.Username, Password: resp.Secret}, nil
+}
+
+// serverURL returns the key Docker uses for a registry.
+func serverURL(registry string) string {
+	if registry == DefaultRegistry {
+		return dockerHubAuthKey
+	}
+	return registry
+}
+
+// normalizeHost turns a config.json key such as https://index.docker.io/v1/
+// into a registry host.
+func normalizeHost(key string) string {
+	host := key
+	if i := strings.Index(host, "://"); i >= 0 {
+		host = host[i+3:]
+	}
+	if i := strings.Index(host, "/"); i >= 0 {
+		host = host[:i]
+	}
+	if host == "index.docker.io" || host == "registry-1.docker.io" {
+		return DefaultRegistry
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package registry
+
+import "strings"
+
+// DefaultRegistry is the registry of references without a registry host.
+const DefaultRegistry = "docker.io"
+
+// Reference is a parsed image reference such as
+// docker.io/tobiasfriden/dmc-rpi:1.4.2.
+type Reference struct {
+	Registry   string
+	Repository string
+	Tag        string
+	Digest     string
+}
+
+// ParseReference parses an image reference, normalizing it the way Docker
+// does so that dmc-rpi and docker.io/library/dmc-rpi are equal.
+func ParseReference(s string) Reference {
+	var ref Reference
+	if i := strings.Index(s, "@"); i >= 0 {
+		ref.Digest = s[i+1:]
+		s = s[:i]
+	}
+	if i := strings.LastIndex(s, ":"); i >= 0 && !strings.Contains(s[i:], "/") {
+		ref.Tag = s[i+1:]
+		s = s[:i]
+	}
+	parts := strings.SplitN(s, "/", 2)
+	if len(parts) == 2 && (strings.ContainsAny(parts[0], ".:") || parts[0] == "localhost") {
+		ref.Registry = parts[0]
+		ref.Repository = parts[1]
+	} else {
+		ref.Registry = DefaultRegistry
+		ref.Repository = s
+	}
+	if ref.Registry == "index.docker.io" {
+		ref.Registry = DefaultRegistry
+	}
+	if ref.Registry == DefaultRegistry && !strings.Contains(ref.Repository, "/") {
+		ref.Repository = "library/" + ref.Repository
+	}
+	return ref
+}
+
+// Name returns the reference without tag or digest.
+func (r Reference) Name() string {
+	return r.Registry + "/" + r.Repository
+}
+
+func (r Reference) String() string {
+	s := r.Name()
+	if r.Tag != "" {
+		s += ":" + r.Tag
+	}
+	if r.Digest != "" {
+		s += "@" + r.Digest
+	}
+	return s
+}
+
+// apiHost returns the host serving the registry API.
+func (r Reference) apiHost() string {
+	if r.Registry == DefaultRegistry {
+		return "registry-1.docker.io"
+	}
+	return r.Registry
+}
@@ -0,0 +1,191 @@
+package registry
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseReference(t *testing.T) {
+	for in, want := range map[string]Reference{
+		"docker.io/tobiasfriden/dmc-rpi":           {"docker.io", "tobiasfriden/dmc-rpi", "", ""},
+		"tobiasfriden/dmc-rpi:1.4.2":               {"docker.io", "tobiasfriden/dmc-rpi", "1.4.2", ""},
+		"ubuntu":                                   {"docker.io", "library/ubuntu", "", ""},
+		"mirror.local:5000/dmc/dmc-x86@sha256:abc": {"mirror.local:5000", "dmc/dmc-x86", "", "sha256:abc"},
+		"localhost/dmc-sim:latest":                 {"localhost", "dmc-sim", "latest", ""},
+	} {
+		if got := ParseReference(in); got != want {
+			t.Errorf("ParseReference(%s) = %+v, want %+v", in, got, want)
+		}
+	}
+}
+
+func TestSortTags(t *testing.T) {
+	tags := []string{"latest", "1.9.2", "1.10.0", "1.4.2-rc1", "1.4.2", "v1.4.3", "1.4.2.1"}
+	SortTags(tags)
+	want := []string{"1.10.0", "1.9.2", "v1.4.3", "1.4.2.1", "1.4.2", "1.4.2-rc1", "latest"}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("got %v, want %v", tags, want)
+	}
+}
+
+// newRegistry serves a repository with two pages of tags behind a bearer
+// token challenge.
+func newRegistry(t *testing.T) (*httptest.Server, Reference) {
+	mux := http.NewServeMux()
+	srv := httptest.NewServer(mux)
+	mux.HandleFunc("/token", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("scope") != "repository:dmc/dmc-rpi:pull" {
+			t.Errorf("unexpected scope %s", r.URL.Query().Get("scope"))
+		}
+		fmt.Fprint(w, `{"token":"secret"}`)
+	})
+	mux.HandleFunc("/v2/dmc/dmc-rpi/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("Www-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="test"`, srv.URL))
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch r.URL.Path {
+		case "/v2/dmc/dmc-rpi/tags/list":
+			if r.URL.Query().Get("last") == "" {
+				w.Header().Set("Link", `</v2/dmc/dmc-rpi/tags/list?last=1.0.0>; rel="next"`)
+				fmt.Fprint(w, `{"name":"dmc/dmc-rpi","tags":["1.0.0"]}`)
+			} else {
+				fmt.Fprint(w, `{"name":"dmc/dmc-rpi","tags":["1.1.0","latest"]}`)
+			}
+		case "/v2/dmc/dmc-rpi/manifests/1.1.0":
+			w.Header().Set("Docker-Content-Digest", "sha256:110")
+		default:
+			http.NotFound(w, r)
+		}
+	})
+	u, _ := url.Parse(srv.URL)
+	return srv, Reference{Registry: u.Host, Repository: "dmc/dmc-rpi"}
+}
+
+func TestTags(t *testing.T) {
+	srv, ref := newRegistry(t)
+	defer srv.Close()
+
+	c := &Client{Insecure: true}
+	tags, err := c.Tags(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"1.0.0", "1.1.0", "latest"}; !reflect.DeepEqual(tags, want) {
+		t.Errorf("got %v, want %v", tags, want)
+	}
+}
+
+func TestDigest(t *testing.T) {
+	srv, ref := newRegistry(t)
+	defer srv.Close()
+
+	c := &Client{Insecure: true}
+	ref.Tag = "1.1.0"
+	digest, err := c.Digest(context.Background(), ref)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if digest != "sha256:110" {
+		t.Errorf("unexpected digest %s", digest)
+	}
+	ref.Tag = "9.9.9"
+	if _, err := c.Digest(context.Background(), ref); err == nil {
+		t.Error("expected error for missing tag")
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if user, pass, ok := r.BasicAuth(); !ok || user != "drone" || pass != "hunter2" {
+			w.Header().Set("Www-Authenticate", `Basic realm="mirror"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"tags":["1.0.0"]}`)
+	}))
+	defer srv.Close()
+	u, _ := url.Parse(srv.URL)
+
+	c := &Client{Insecure: true}
+	if err := c.Ping(context.Background(), u.Host); err == nil {
+		t.Error("expected ping without credentials to fail")
+	}
+	c = &Client{Insecure: true, Credentials: &Credentials{Username: "drone", Password: "wrong"}}
+	if err := c.Ping(context.Background(), u.Host); err == nil || !strings.Contains(err.Error(), "rejected") {
+		t.Errorf("expected rejected credentials, got %v", err)
+	}
+	c = &Client{Insecure: true, Credentials: &Credentials{Username: "drone", Password: "hunter2"}}
+	if err := c.Ping(context.Background(), u.Host); err != nil {
+		t.Fatal(err)
+	}
+	tags, err := c.Tags(context.Background(), Reference{Registry: u.Host, Repository: "dmc/dmc-rpi"})
+	if err != nil || len(tags) != 1 {
+		t.Errorf("unexpected tags %v, %v", tags, err)
+	}
+}
+
+func TestConfigFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.json")
+	ioutil.WriteFile(path, []byte(`{
+	"auths": {
+		"https://index.docker.io/v1/": {"auth": "aHViOnNlY3JldA=="},
+		"mirror.local:5000": {"identitytoken": "refresh"}
+	},
+	"experimental": "enabled"
+}`), 0600)
+
+	f, err := LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for host, want := range map[string]*Credentials{
+		"docker.io":         {Username: "hub", Password: "secret"},
+		"mirror.local:5000": {IdentityToken: "refresh"},
+		"quay.io":           nil,
+	} {
+		got, err := f.Credentials(host)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Credentials(%s) = %+v, want %+v", host, got, want)
+		}
+	}
+
+	f.Set("quay.io", &Credentials{Username: "q", Password: "p"})
+	if !f.Remove("docker.io") {
+		t.Error("docker.io credentials not removed")
+	}
+	if err := f.Save(); err != nil {
+		t.Fatal(err)
+	}
+	f, err = LoadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := f.Credentials("quay.io"); got == nil || got.Username != "q" {
+		t.Errorf("quay.io credentials not saved: %+v", got)
+	}
+	if got, _ := f.Credentials("docker.io"); got != nil {
+		t.Errorf("docker.io credentials not removed: %+v", got)
+	}
+	if raw, _ := ioutil.ReadFile(path); !strings.Contains(string(raw), "experimental") {
+		t.Error("unknown fields were dropped")
+	}
+}
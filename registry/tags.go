@@ -0,0 +1,76 @@
+package registry
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// SortTags sorts tags newest version first. Numeric parts compare as numbers
+// so 1.10.0 sorts before 1.9.2, and non-version tags such as latest go last.
+func SortTags(tags []string) {
+	sort.SliceStable(tags, func(i, j int) bool {
+		return compareVersions(tags[i], tags[j]) > 0
+	})
+}
+
+func compareVersions(a, b string) int {
+	av, bv := isVersion(a), isVersion(b)
+	if av != bv {
+		if av {
+			return 1
+		}
+		return -1
+	}
+	ap := splitVersion(a)
+	bp := splitVersion(b)
+	for i := 0; i < len(ap) && i < len(bp); i++ {
+		an, aerr := strconv.Atoi(ap[i])
+		bn, berr := strconv.Atoi(bp[i])
+		switch {
+		case aerr == nil && berr == nil:
+			if an != bn {
+				if an > bn {
+					return 1
+				}
+				return -1
+			}
+		case aerr == nil:
+			return 1
+		case berr == nil:
+			return -1
+		case ap[i] != bp[i]:
+			if ap[i] > bp[i] {
+				return 1
+			}
+			return -1
+		}
+	}
+	// An extra numeric part such as 1.4.2.1 is newer than 1.4.2, but a
+	// pre-release such as 1.4.2-rc1 is older.
+	switch {
+	case len(ap) > len(bp):
+		if _, err := strconv.Atoi(ap[len(bp)]); err == nil {
+			return 1
+		}
+		return -1
+	case len(ap) < len(bp):
+		if _, err := strconv.Atoi(bp[len(ap)]); err == nil {
+			return -1
+		}
+		return 1
+	}
+	return 0
+}
+
+func isVersion(tag string) bool {
+	tag = strings.TrimPrefix(tag, "v")
+	return tag != "" && tag[0] >= '0' && tag[0] <= '9'
+}
+
+func splitVersion(tag string) []string {
+	tag = strings.TrimPrefix(tag, "v")
+	return strings.FieldsFunc(tag, func(r rune) bool {
+		return r == '.' || r == '-' || r == '+'
+	})
+}
@@ -0,0 +1,172 @@
+package secrets
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// FileStore keeps secrets in a file encrypted with AES-256-GCM. The key is
+// kept in a separate file, so the secrets file on its own is of no use if it
+// is copied off the machine, e.g. in a backup of the config directory. Both
+// files are only readable by the owner. This is obfuscation, not protection:
+// anyone who can read both files can read the secrets.
+type FileStore struct {
+	Path    string
+	KeyPath string
+
+	mu sync.Mutex
+}
+
+// NewFileStore returns a store backed by the file at path, encrypted with the
+// key at keyPath which is created when the first secret is set.
+func NewFileStore(path, keyPath string) *FileStore {
+	return &FileStore{Path: path, KeyPath: keyPath}
+}
+
+func (s *FileStore) Get(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load(false)
+	if err != nil {
+		return "", err
+	}
+	value, ok := all[name]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (s *FileStore) Set(name, value string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load(true)
+	if err != nil {
+		return err
+	}
+	all[name] = value
+	return s.save(all)
+}
+
+func (s *FileStore) Delete(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	all, err := s.load(false)
+	if err != nil {
+		return err
+	}
+	if _, ok := all[name]; !ok {
+		return nil
+	}
+	delete(all, name)
+	return s.save(all)
+}
+
+// load decrypts all secrets, creating the key if create is set and there is
+// none yet.
+func (s *FileStore) load(create bool) (map[string]string, error) {
+	all := map[string]string{}
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		if create {
+			_, err = s.key(true)
+		} else {
+			err = nil
+		}
+		return all, err
+	} else if err != nil {
+		return nil, err
+	}
+	gcm, err := s.cipher(false)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("%s is corrupt", s.Path)
+	}
+	plain, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	if err != nil {
+		return nil, fmt.Errorf("could not decrypt %s, was %s replaced?", s.Path, s.KeyPath)
+	}
+	if err := json.Unmarshal(plain, &all); err != nil {
+		return nil, fmt.Errorf("%s is corrupt: %s", s.Path, err)
+	}
+	return all, nil
+}
+
+func (s *FileStore) save(all map[string]string) error {
+	plain, err := json.Marshal(all)
+	if err != nil {
+		return err
+	}
+	gcm, err := s.cipher(true)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return err
+	}
+	return writePrivate(s.Path, gcm.Seal(nonce, nonce, plain, nil))
+}
+
+func (s *FileStore) cipher(create bool) (cipher.AEAD, error) {
+	key, err := s.key(create)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func (s *FileStore) key(create bool) ([]byte, error) {
+	key, err := ioutil.ReadFile(s.KeyPath)
+	if os.IsNotExist(err) && create {
+		key = make([]byte, 32)
+		if _, err := io.ReadFull(rand.Reader, key); err != nil {
+			return nil, err
+		}
+		return key, writePrivate(s.KeyPath, key)
+	} else if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("%s is not a valid key", s.KeyPath)
+	}
+	return key, nil
+}
+
+// writePrivate replaces the file at path with data, readable only by the
+// owner.
+func writePrivate(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
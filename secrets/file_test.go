@@ -0,0 +1,64 @@
+package secrets
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "secrets")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	s := NewFileStore(filepath.Join(dir, "secrets"), filepath.Join(dir, "secrets.key"))
+
+	if _, err := s.Get("default/TOKEN"); err != ErrNotFound {
+		t.Fatalf("expected ErrNotFound, got %v", err)
+	}
+	if err := s.Delete("default/TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("default/TOKEN", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Set("quad-3/PASSWORD", "key"); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := s.Get("default/TOKEN"); err != nil || v != "hunter2" {
+		t.Errorf("got %q, %v", v, err)
+	}
+	for _, name := range []string{"secrets", "secrets.key"} {
+		info, err := os.Stat(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if info.Mode().Perm() != 0600 {
+			t.Errorf("%s has mode %v", name, info.Mode())
+		}
+	}
+	raw, _ := ioutil.ReadFile(s.Path)
+	if bytes.Contains(raw, []byte("hunter2")) {
+		t.Error("secret stored in plain text")
+	}
+
+	if err := s.Delete("default/TOKEN"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Get("default/TOKEN"); err != ErrNotFound {
+		t.Errorf("expected ErrNotFound after delete, got %v", err)
+	}
+	if v, _ := s.Get("quad-3/PASSWORD"); v != "key" {
+		t.Errorf("other secret lost, got %q", v)
+	}
+
+	// A different key can't read the file.
+	os.Remove(s.KeyPath)
+	ioutil.WriteFile(s.KeyPath, bytes.Repeat([]byte{1}, 32), 0600)
+	if _, err := s.Get("quad-3/PASSWORD"); err == nil {
+		t.Error("expected decryption to fail with another key")
+	}
+}
@@ -0,0 +1,104 @@
+package secrets
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// Keyring stores secrets in the OS keyring through secret-tool on Linux and
+// security on macOS.
+type Keyring struct {
+	Service string
+}
+
+// NewKeyring returns a keyring store for service, or an error if no keyring
+// is reachable, which is usually the case on headless machines.
+func NewKeyring(service string) (*Keyring, error) {
+	switch runtime.GOOS {
+	case "linux":
+		if _, err := exec.LookPath("secret-tool"); err != nil {
+			return nil, errors.New("secret-tool not found, install libsecret-tools")
+		}
+		if os.Getenv("DBUS_SESSION_BUS_ADDRESS") == "" {
+			return nil, errors.New("no D-Bus session for the keyring")
+		}
+	case "darwin":
+		if _, err := exec.LookPath("security"); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("no keyring support on %s", runtime.GOOS)
+	}
+	return &Keyring{Service: service}, nil
+}
+
+func (k *Keyring) Get(name string) (string, error) {
+	var out []byte
+	var err error
+	if runtime.GOOS == "darwin" {
+		out, err = k.run(nil, "security", "find-generic-password", "-s", k.Service, "-a", name, "-w")
+	} else {
+		out, err = k.run(nil, "secret-tool", "lookup", "service", k.Service, "account", name)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && notFound(exitErr) {
+		return "", ErrNotFound
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(out), "\n"), nil
+}
+
+// Set passes the secret on the command line on macOS, where security has no
+// other non-interactive way to read it.
+func (k *Keyring) Set(name, value string) error {
+	if runtime.GOOS == "darwin" {
+		_, err := k.run(nil, "security", "add-generic-password", "-U", "-s", k.Service, "-a", name, "-w", value)
+		return err
+	}
+	label := fmt.Sprintf("%s %s", k.Service, name)
+	_, err := k.run(strings.NewReader(value), "secret-tool", "store", "--label", label, "service", k.Service, "account", name)
+	return err
+}
+
+func (k *Keyring) Delete(name string) error {
+	var err error
+	if runtime.GOOS == "darwin" {
+		_, err = k.run(nil, "security", "delete-generic-password", "-s", k.Service, "-a", name)
+	} else {
+		_, err = k.run(nil, "secret-tool", "clear", "service", k.Service, "account", name)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && notFound(exitErr) {
+		return nil
+	}
+	return err
+}
+
+func (k *Keyring) run(stdin *strings.Reader, name string, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command(name, args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if exitErr, ok := err.(*exec.ExitError); ok && !notFound(exitErr) {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("%s: %s", name, msg)
+		}
+	}
+	return out, err
+}
+
+// notFound reports whether a keyring command failed because the secret does
+// not exist: secret-tool exits with 1 and security with 44.
+func notFound(err *exec.ExitError) bool {
+	if runtime.GOOS == "darwin" {
+		return err.ExitCode() == 44
+	}
+	return err.ExitCode() == 1
+}
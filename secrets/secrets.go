@@ -0,0 +1,16 @@
+// Package secrets stores credentials outside of the dmctl config files,
+// either in the OS keyring or in an encrypted file.
+package secrets
+
+import "errors"
+
+// ErrNotFound is returned by Get for secrets that have not been set.
+var ErrNotFound = errors.New("secret not found")
+
+// Store is a place to keep secrets by name.
+type Store interface {
+	Get(name string) (string, error)
+	Set(name, value string) error
+	// Delete removes a secret. Deleting a missing secret is not an error.
+	Delete(name string) error
+}